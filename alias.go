@@ -0,0 +1,83 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Command aliases: custom command words sent as PRIVMSG to a service
+// nickname, like "CS REGISTER #foo" becoming "PRIVMSG ChanServ :REGISTER #foo".
+var aliases = DefaultAliases()
+
+func DefaultAliases() map[string]string {
+	return map[string]string{"CS": ChanServ, "CHANSERV": ChanServ}
+}
+
+// Parse aliases file lines "word nickname", like "NS NickServ". Empty
+// lines and comments starting with "#" are skipped. Parsed aliases are
+// added to the default ones.
+func ParseAliases(text string) (map[string]string, error) {
+	parsed := DefaultAliases()
+	for n, line := range strings.Split(text, "\n") {
+		if i := strings.IndexByte(line, '#'); i != -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected word and nickname", n+1)
+		}
+		if !RENickname.MatchString(fields[1]) {
+			return nil, fmt.Errorf("line %d: invalid nickname %s", n+1, fields[1])
+		}
+		parsed[strings.ToUpper(fields[0])] = fields[1]
+	}
+	return parsed, nil
+}
+
+func LoadAliases(fn string) error {
+	text, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	parsed, err := ParseAliases(string(text))
+	if err != nil {
+		return err
+	}
+	aliases = parsed
+	return nil
+}
+
+// Expand aliased command into PRIVMSG to its nickname with the rest of
+// the line as text. Other commands are returned untouched.
+func ExpandAlias(cmd string, cols []string) (string, []string) {
+	nickname, found := aliases[cmd]
+	if !found {
+		return cmd, cols
+	}
+	if len(cols) == 1 || strings.TrimPrefix(cols[1], ":") == "" {
+		return "PRIVMSG", []string{"PRIVMSG", nickname}
+	}
+	return "PRIVMSG", []string{"PRIVMSG", nickname + " :" + strings.TrimPrefix(cols[1], ":")}
+}
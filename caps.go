@@ -0,0 +1,288 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Timestamps format of read markers
+	MarkReadLayout = "2006-01-02T15:04:05.000Z"
+)
+
+var (
+	// IRCv3 capabilities supported by the server
+	Capabilities = []string{
+		"batch",
+		"chghost",
+		"draft/channel-rename",
+		MetadataCap,
+		"draft/read-marker",
+		"labeled-response",
+		"message-tags",
+		"setname",
+		"standard-replies",
+	}
+
+	batchRef uint64
+
+	// The first and the last assigned message identifiers, nanoseconds
+	// timestamps
+	firstMsgID int64
+	lastMsgID  int64
+
+	// Read markers timestamps of accounts' targets, folded. They are
+	// accessed by Daemon only
+	readMarkers = make(map[string]map[string]string)
+
+	tagEscaper   = strings.NewReplacer(";", "\\:", " ", "\\s", "\\", "\\\\", "\r", "\\r", "\n", "\\n")
+	tagUnescaper = strings.NewReplacer("\\:", ";", "\\s", " ", "\\\\", "\\", "\\r", "\r", "\\n", "\n")
+)
+
+// Unique identifier of the channel message, msgid tag value. Identifiers
+// are timestamps, increasing with every message, so later messages of the
+// channel always have greater ones.
+func NextMsgID(now time.Time) string {
+	for {
+		last := atomic.LoadInt64(&lastMsgID)
+		id := now.UnixNano()
+		if id <= last {
+			id = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&lastMsgID, last, id) {
+			atomic.CompareAndSwapInt64(&firstMsgID, 0, id)
+			return strconv.FormatInt(id, 36)
+		}
+	}
+}
+
+// Was the message identifier given by NextMsgID. Messages are not kept,
+// so it is only known that the identifier could have been given.
+func MsgIDIssued(msgid string) bool {
+	id, err := strconv.ParseInt(msgid, 36, 64)
+	if err != nil || strconv.FormatInt(id, 36) != msgid {
+		return false
+	}
+	first := atomic.LoadInt64(&firstMsgID)
+	return first != 0 && first <= id && id <= atomic.LoadInt64(&lastMsgID)
+}
+
+// Has the client negotiated the capability.
+func (c *Client) HasCap(name string) bool {
+	c.capsM.RLock()
+	_, enabled := c.caps[name]
+	c.capsM.RUnlock()
+	return enabled
+}
+
+// Capabilities negotiation. Both registered and unregistered clients
+// can list and request them. Registration is deferred until CAP END if
+// unregistered client has started negotiation.
+func HandlerCap(client *Client, cols []string) {
+	if len(cols) == 1 || len(cols[1]) < 1 {
+		client.ReplyNotEnoughParameters("CAP")
+		return
+	}
+	args := strings.SplitN(cols[1], " ", 2)
+	subcmd := strings.ToUpper(args[0])
+	if !client.registered {
+		switch subcmd {
+		case "LS", "REQ":
+			client.capNegotiating = true
+		case "END":
+			client.capNegotiating = false
+		}
+	}
+	switch subcmd {
+	case "LS":
+		client.Reply("CAP " + *client.nickname + " LS :" + strings.Join(Capabilities, " "))
+	case "LIST":
+		client.capsM.RLock()
+		enabled := make([]string, 0, len(client.caps))
+		for name := range client.caps {
+			enabled = append(enabled, name)
+		}
+		client.capsM.RUnlock()
+		sort.Strings(enabled)
+		client.Reply("CAP " + *client.nickname + " LIST :" + strings.Join(enabled, " "))
+	case "REQ":
+		if len(args) == 1 {
+			client.ReplyNotEnoughParameters("CAP")
+			return
+		}
+		requested := strings.TrimPrefix(args[1], ":")
+		names := strings.Fields(requested)
+		for _, name := range names {
+			if !CapabilitySupported(strings.TrimPrefix(name, "-")) {
+				client.Reply("CAP " + *client.nickname + " NAK :" + requested)
+				return
+			}
+		}
+		client.capsM.Lock()
+		for _, name := range names {
+			if strings.HasPrefix(name, "-") {
+				delete(client.caps, name[1:])
+			} else {
+				client.caps[name] = struct{}{}
+			}
+		}
+		client.capsM.Unlock()
+		client.Reply("CAP " + *client.nickname + " ACK :" + requested)
+	case "END":
+	default:
+		client.ReplyNicknamed("410", args[0], "Invalid CAP command")
+	}
+}
+
+// MARKREAD either queries the read marker of the target, or moves it
+// forward, notifying all the account's sessions.
+func HandlerMarkRead(client *Client, cols []string) {
+	if len(cols) == 1 || len(strings.Fields(cols[1])) == 0 {
+		client.ReplyFail("MARKREAD", "NEED_MORE_PARAMS", "Missing parameters")
+		return
+	}
+	if client.account == nil {
+		client.ReplyFail("MARKREAD", "ACCOUNT_REQUIRED", "You need to be identified")
+		return
+	}
+	args := strings.Fields(cols[1])
+	target := args[0]
+	account := Fold(*client.account)
+	markers, found := readMarkers[account]
+	if !found {
+		markers = make(map[string]string)
+		readMarkers[account] = markers
+	}
+	if len(args) == 1 {
+		client.Reply(markReadLine(target, markers[Fold(target)]))
+		return
+	}
+	timestamp := strings.TrimPrefix(args[1], "timestamp=")
+	if _, err := time.Parse(MarkReadLayout, timestamp); err != nil || timestamp == args[1] {
+		client.ReplyFail("MARKREAD", "INVALID_PARAMS", target, "Invalid timestamp")
+		return
+	}
+	// Layout is lexicographically ordered
+	if timestamp <= markers[Fold(target)] {
+		client.Reply(markReadLine(target, markers[Fold(target)]))
+		return
+	}
+	markers[Fold(target)] = timestamp
+	for _, c := range AccountSessions(account) {
+		if c == client || c.HasCap("draft/read-marker") {
+			c.Reply(markReadLine(target, timestamp))
+		}
+	}
+}
+
+func markReadLine(target, timestamp string) string {
+	if timestamp == "" {
+		return "MARKREAD " + target + " *"
+	}
+	return "MARKREAD " + target + " timestamp=" + timestamp
+}
+
+func CapabilitySupported(name string) bool {
+	for _, supported := range Capabilities {
+		if name == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// Unique BATCH reference tag.
+func NewBatchRef() string {
+	return strconv.FormatUint(atomic.AddUint64(&batchRef, 1), 36)
+}
+
+func EscapeTag(value string) string {
+	return tagEscaper.Replace(value)
+}
+
+func UnescapeTag(value string) string {
+	return tagUnescaper.Replace(value)
+}
+
+// Split IRCv3 message tags from the line. Tags are nil if there are
+// none.
+func ParseTags(line string) (tags map[string]string, rest string) {
+	if !strings.HasPrefix(line, "@") {
+		return nil, line
+	}
+	cols := strings.SplitN(line[1:], " ", 2)
+	if len(cols) > 1 {
+		rest = strings.TrimLeft(cols[1], " ")
+	}
+	tags = make(map[string]string)
+	for _, tag := range strings.Split(cols[0], ";") {
+		if tag == "" {
+			continue
+		}
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) == 2 {
+			tags[kv[0]] = UnescapeTag(kv[1])
+		} else {
+			tags[kv[0]] = ""
+		}
+	}
+	return tags, rest
+}
+
+// Client-only tags, prefixed with "+", escaped and joined to be relayed.
+func ClientTags(tags map[string]string) string {
+	relayed := make([]string, 0)
+	for k, v := range tags {
+		if !strings.HasPrefix(k, "+") {
+			continue
+		}
+		// Replies can only refer to messages this server has seen
+		if k == "+draft/reply" && !MsgIDIssued(v) {
+			continue
+		}
+		if v == "" {
+			relayed = append(relayed, k)
+		} else {
+			relayed = append(relayed, k+"="+EscapeTag(v))
+		}
+	}
+	sort.Strings(relayed)
+	return strings.Join(relayed, ";")
+}
+
+// Line with relayed client-only tags for the client supporting them.
+func TaggedFor(c *Client, tags, msg string) string {
+	if tags == "" || !c.HasCap("message-tags") {
+		return msg
+	}
+	return AddTag(msg, tags)
+}
+
+// Add already escaped key=value tag to the line, that may have tags.
+func AddTag(line, tag string) string {
+	if strings.HasPrefix(line, "@") {
+		return "@" + tag + ";" + line[1:]
+	}
+	return "@" + tag + " " + line
+}
@@ -0,0 +1,82 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"strings"
+)
+
+const ChanServ = "ChanServ"
+
+// Send NOTICE to the client on behalf of ChanServ.
+func ChanServNotice(client *Client, text string) {
+	client.Msg(":" + ChanServ + "!" + ChanServ + "@" + *hostname + " NOTICE " + *client.nickname + " :" + text)
+}
+
+// Built-in channel registration service. Registered channels are kept
+// even when empty and their founder's account is automatically opped.
+func HandlerChanServ(client *Client, text string) {
+	cols := strings.Fields(strings.TrimPrefix(text, ":"))
+	if len(cols) == 0 {
+		cols = []string{"HELP"}
+	}
+	switch strings.ToUpper(cols[0]) {
+	case "REGISTER":
+		if len(cols) < 2 {
+			ChanServNotice(client, "Syntax: REGISTER <#channel>")
+			return
+		}
+		if client.account == nil {
+			ChanServNotice(client, "You need to be identified to register channels")
+			return
+		}
+		roomsM.RLock()
+		r, found := GetRoom(cols[1])
+		if !found {
+			roomsM.RUnlock()
+			ChanServNotice(client, "Channel "+cols[1]+" does not exist")
+			return
+		}
+		roomSinks[r] <- ClientEvent{client, EventRegister, ""}
+		roomsM.RUnlock()
+	case "ENTRYMSG":
+		if len(cols) < 2 {
+			ChanServNotice(client, "Syntax: ENTRYMSG <#channel> [message]")
+			return
+		}
+		var message string
+		if args := strings.SplitN(strings.TrimPrefix(text, ":"), " ", 3); len(args) == 3 {
+			message = strings.TrimSpace(args[2])
+		}
+		roomsM.RLock()
+		r, found := GetRoom(cols[1])
+		if !found {
+			roomsM.RUnlock()
+			ChanServNotice(client, "Channel "+cols[1]+" does not exist")
+			return
+		}
+		roomSinks[r] <- ClientEvent{client, EventEntryMsg, message}
+		roomsM.RUnlock()
+	case "HELP":
+		ChanServNotice(client, "REGISTER <#channel>: register the channel you are operator of")
+		ChanServNotice(client, "ENTRYMSG <#channel> [message]: set or clear message sent to joining users")
+	default:
+		ChanServNotice(client, "Unknown command "+cols[0]+", try HELP")
+	}
+}
@@ -0,0 +1,121 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Legacy 8-bit encoding client can declare with CHARSET command. Its
+// messages are transcoded to UTF-8 and everything sent to it from UTF-8,
+// so it can talk with UTF-8 clients in the same channels.
+type Charset struct {
+	name string
+	// Runes of 0x80-0xFF bytes, lower ones are ASCII
+	high  [128]rune
+	bytes map[rune]byte
+}
+
+var (
+	// Supported charsets by their upper case names and aliases
+	Charsets = make(map[string]*Charset)
+
+	cp1251 = [128]rune{
+		0x0402, 0x0403, 0x201A, 0x0453, 0x201E, 0x2026, 0x2020, 0x2021,
+		0x20AC, 0x2030, 0x0409, 0x2039, 0x040A, 0x040C, 0x040B, 0x040F,
+		0x0452, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+		0xFFFD, 0x2122, 0x0459, 0x203A, 0x045A, 0x045C, 0x045B, 0x045F,
+		0x00A0, 0x040E, 0x045E, 0x0408, 0x00A4, 0x0490, 0x00A6, 0x00A7,
+		0x0401, 0x00A9, 0x0404, 0x00AB, 0x00AC, 0x00AD, 0x00AE, 0x0407,
+		0x00B0, 0x00B1, 0x0406, 0x0456, 0x0491, 0x00B5, 0x00B6, 0x00B7,
+		0x0451, 0x2116, 0x0454, 0x00BB, 0x0458, 0x0405, 0x0455, 0x0457,
+		0x0410, 0x0411, 0x0412, 0x0413, 0x0414, 0x0415, 0x0416, 0x0417,
+		0x0418, 0x0419, 0x041A, 0x041B, 0x041C, 0x041D, 0x041E, 0x041F,
+		0x0420, 0x0421, 0x0422, 0x0423, 0x0424, 0x0425, 0x0426, 0x0427,
+		0x0428, 0x0429, 0x042A, 0x042B, 0x042C, 0x042D, 0x042E, 0x042F,
+		0x0430, 0x0431, 0x0432, 0x0433, 0x0434, 0x0435, 0x0436, 0x0437,
+		0x0438, 0x0439, 0x043A, 0x043B, 0x043C, 0x043D, 0x043E, 0x043F,
+		0x0440, 0x0441, 0x0442, 0x0443, 0x0444, 0x0445, 0x0446, 0x0447,
+		0x0448, 0x0449, 0x044A, 0x044B, 0x044C, 0x044D, 0x044E, 0x044F,
+	}
+)
+
+func init() {
+	var latin1 [128]rune
+	for i := range latin1 {
+		latin1[i] = rune(0x80 + i)
+	}
+	for _, cs := range []*Charset{
+		NewCharset("ISO-8859-1", latin1),
+		NewCharset("CP1251", cp1251),
+	} {
+		Charsets[cs.name] = cs
+	}
+	Charsets["LATIN1"] = Charsets["ISO-8859-1"]
+	Charsets["WINDOWS-1251"] = Charsets["CP1251"]
+}
+
+func NewCharset(name string, high [128]rune) *Charset {
+	cs := Charset{name: name, high: high, bytes: make(map[rune]byte)}
+	for i, r := range high {
+		if r != utf8.RuneError {
+			cs.bytes[r] = byte(0x80 + i)
+		}
+	}
+	return &cs
+}
+
+// Find charset by case insensitive name or alias.
+func LookupCharset(name string) *Charset {
+	return Charsets[strings.ToUpper(name)]
+}
+
+// Transcode client's line to UTF-8.
+func (cs *Charset) Decode(line []byte) string {
+	var b strings.Builder
+	b.Grow(len(line))
+	for _, c := range line {
+		if c < 0x80 {
+			b.WriteByte(c)
+		} else {
+			b.WriteRune(cs.high[c-0x80])
+		}
+	}
+	return b.String()
+}
+
+// Transcode UTF-8 line for the client. Characters missing in the
+// charset are replaced with "?".
+func (cs *Charset) Encode(line []byte) []byte {
+	encoded := make([]byte, 0, len(line))
+	for len(line) > 0 {
+		r, size := utf8.DecodeRune(line)
+		switch {
+		case r < 0x80 && size == 1:
+			encoded = append(encoded, line[0])
+		case cs.bytes[r] != 0:
+			encoded = append(encoded, cs.bytes[r])
+		default:
+			encoded = append(encoded, '?')
+		}
+		line = line[size:]
+	}
+	return encoded
+}
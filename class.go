@@ -0,0 +1,118 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// Connection class: limits applied to clients depending on the
+// listener they arrived on or their address.
+type Class struct {
+	name string
+	// Listener kind (raw, tls or unix), network in CIDR notation or "*"
+	match string
+	// Max number of queued outgoing lines
+	sendq int
+	// Idle time before PING is sent. Clients silent for twice as long
+	// are disconnected
+	pingFreq time.Duration
+	// Max number of the class connections from the same address, 0
+	// means unlimited
+	maxPerIP int
+}
+
+var (
+	DefaultClass = &Class{
+		name:     "default",
+		match:    "*",
+		sendq:    MaxOutBuf,
+		pingFreq: PingThreshold,
+	}
+	// Classes from -classes file, the first matching one is used
+	classes []*Class
+)
+
+// Parse classes file lines "name match sendq pingfreq maxperip", like
+// "tls tls 8192 90 5" or "local 127.0.0.0/8 16384 300 0". Empty lines
+// and comments starting with "#" are skipped.
+func ParseClasses(text string) ([]*Class, error) {
+	var parsed []*Class
+	for n, line := range strings.Split(text, "\n") {
+		if i := strings.IndexByte(line, '#'); i != -1 {
+			line = line[:i]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var class Class
+		var pingFreq int
+		if _, err := fmt.Sscanf(
+			line, "%s %s %d %d %d",
+			&class.name, &class.match, &class.sendq, &pingFreq, &class.maxPerIP,
+		); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n+1, err)
+		}
+		switch class.match {
+		case "*", "raw", "tls", "unix":
+		default:
+			if _, _, err := net.ParseCIDR(class.match); err != nil {
+				return nil, fmt.Errorf("line %d: %v", n+1, err)
+			}
+		}
+		if class.sendq <= 0 || pingFreq <= 0 || class.maxPerIP < 0 {
+			return nil, fmt.Errorf("line %d: invalid limits", n+1)
+		}
+		class.pingFreq = time.Duration(pingFreq) * time.Second
+		parsed = append(parsed, &class)
+	}
+	return parsed, nil
+}
+
+func LoadClasses(fn string) error {
+	text, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	classes, err = ParseClasses(string(text))
+	return err
+}
+
+// Find class of the client connected to the kind of listener from the
+// address. DefaultClass is used if none matches.
+func ClassFor(kind string, addr net.Addr) *Class {
+	var ip net.IP
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		ip = net.ParseIP(host)
+	}
+	for _, class := range classes {
+		switch class.match {
+		case "*", kind:
+			return class
+		}
+		if _, network, err := net.ParseCIDR(class.match); err == nil && ip != nil && network.Contains(ip) {
+			return class
+		}
+	}
+	return DefaultClass
+}
@@ -20,22 +20,37 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"log"
 	"net"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	BufSize   = 1500
+	BufSize = 1500
+	// Default max number of queued outgoing lines
 	MaxOutBuf = 1 << 12
+	// How often output queue is checked while streaming long reply
+	StreamPause = 100 * time.Millisecond
 )
 
 var (
 	CRLF []byte = []byte{'\x0d', '\x0a'}
+	// User modes clients can set and unset themselves. Operator status
+	// is only granted by OPER, but can be dropped
+	UserModes = "BDRiow"
 )
 
+// Client's timestamps are always taken from time.Now(), keeping
+// monotonic clock reading, so idle and lag durations computed with
+// time.Since and Sub are not affected by wall clock steps. Never store
+// times stripped of it, like parsed or Round(0) ones, there.
 type Client struct {
 	conn          net.Conn
 	registered    bool
@@ -43,19 +58,69 @@ type Client struct {
 	username      *string
 	realname      *string
 	password      *string
+	account       *string
+	vhost         *string
 	away          *string
+	modes         map[byte]struct{}
+	caps          map[string]struct{}
+	signon        time.Time
 	recvTimestamp time.Time
 	sendTimestamp time.Time
-	outBuf        chan *string
+	outBuf        chan []byte
 	alive         bool
 	quitMsg       *string
+	// When unknown command of the client was logged last time
+	unknownLogged time.Time
+	// Times of recent nickname changes
+	nickChanges []time.Time
+	// Private messages received while away, delivered on return
+	awayMsgs []string
+	// Legacy charset declared by CHARSET, nil for UTF-8
+	charset *Charset
+	// Connection class limiting the client
+	class *Class
+	// Kind (raw, tls or unix) and address of the listener the client
+	// arrived on
+	kind     string
+	listener string
+	// When the unanswered PING was sent, its argument to be echoed in
+	// PONG and the last measured round trip time, guarded by the mutex
+	pingSent  time.Time
+	pingToken string
+	lag       time.Duration
+	// Unregistered client started capabilities negotiation, so its
+	// registration is deferred until CAP END
+	capNegotiating bool
+	// Number of client's messages queued to or being processed by Daemon
+	pending int32
+	// Label of the command being processed and replies collected for it
+	label   *string
+	labeled []string
+	// Long reply is being streamed in the background
+	streaming bool
+	// Metadata of the client without account, accessed by Daemon only,
+	// and subscribed metadata keys, guarded by the mutex
+	metadata     map[string]string
+	metadataSubs map[string]struct{}
+	// Guards username and vhost, changed by CHGHOST while rooms read them
+	hostM sync.RWMutex
+	// Guards user modes, read by rooms
+	modesM sync.RWMutex
+	// Guards negotiated capabilities, read by rooms
+	capsM sync.RWMutex
 	sync.Mutex
 }
 
 func (c *Client) Host() string {
-	addr := c.conn.RemoteAddr().String()
-	if host, _, err := net.SplitHostPort(addr); err == nil {
-		addr = host
+	c.hostM.RLock()
+	vhost := c.vhost
+	c.hostM.RUnlock()
+	if vhost != nil {
+		return *vhost
+	}
+	addr := c.Addr()
+	if addr == "localhost" {
+		return addr
 	}
 	if domains, err := net.LookupAddr(addr); err == nil {
 		addr = strings.TrimSuffix(domains[0], ".")
@@ -63,15 +128,164 @@ func (c *Client) Host() string {
 	return addr
 }
 
+// Client's address without port. Clients connected through Unix domain
+// socket have no meaningful one and are considered local.
+func (c *Client) Addr() string {
+	remote := c.conn.RemoteAddr()
+	if remote.Network() == "unix" {
+		return "localhost"
+	}
+	addr := remote.String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return addr
+}
+
 func (c *Client) String() string {
-	return *c.nickname + "!" + *c.username + "@" + c.Host()
+	return *c.nickname + "!" + c.Username() + "@" + c.Host()
+}
+
+func (c *Client) Username() string {
+	c.hostM.RLock()
+	defer c.hostM.RUnlock()
+	return *c.username
+}
+
+// Change client's visible username and host.
+func (c *Client) SetHost(username, host string) {
+	c.hostM.Lock()
+	c.username = &username
+	c.vhost = &host
+	c.hostM.Unlock()
 }
 
 func (c *Client) Match(other string) bool {
-	return strings.ToLower(*c.nickname) == strings.ToLower(other)
+	return Fold(*c.nickname) == Fold(other)
+}
+
+// Match client against either nick!user@host wildcard mask, if it
+// contains "!" or "@", or identified account name otherwise.
+func (c *Client) MatchMask(mask string) bool {
+	if strings.ContainsAny(mask, "!@") {
+		return WildcardMatch(Fold(mask), Fold(c.String()))
+	}
+	return c.account != nil && Fold(*c.account) == Fold(mask)
+}
+
+// Match client against the ban mask: either nick!user@host wildcard or
+// extban: $a:account or $r:realname wildcards.
+func (c *Client) MatchBan(mask string) bool {
+	if strings.HasPrefix(mask, "$") && len(mask) > 3 {
+		pattern := strings.ToLower(mask[3:])
+		switch mask[1] {
+		case 'a':
+			return c.account != nil && WildcardMatch(pattern, Fold(*c.account))
+		case 'r':
+			return WildcardMatch(pattern, strings.ToLower(*c.realname))
+		}
+		return false
+	}
+	return WildcardMatch(Fold(mask), Fold(c.String()))
+}
+
+// Match text against the pattern, where "*" matches any sequence of
+// characters and "?" matches any single one.
+func WildcardMatch(pattern, text string) bool {
+	var p, t int
+	star, mark := -1, 0
+	for t < len(text) {
+		if p < len(pattern) && (pattern[p] == '?' || pattern[p] == text[t]) {
+			p++
+			t++
+		} else if p < len(pattern) && pattern[p] == '*' {
+			star, mark = p, t
+			p++
+		} else if star != -1 {
+			p = star + 1
+			mark++
+			t = mark
+		} else {
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// Is the given user mode flag set on the client.
+func (c *Client) HasMode(mode byte) bool {
+	c.modesM.RLock()
+	_, set := c.modes[mode]
+	c.modesM.RUnlock()
+	return set
+}
+
+// Set or unset user mode flag.
+func (c *Client) SetMode(mode byte, set bool) {
+	c.modesM.Lock()
+	if set {
+		c.modes[mode] = struct{}{}
+	} else {
+		delete(c.modes, mode)
+	}
+	c.modesM.Unlock()
+}
+
+// Apply user mode changes, like "+iw-D", requested by the client itself.
+// Changes actually made are returned in the same form, while unknown
+// mode letters are reported back.
+func (c *Client) ChangeModes(changes string) (applied string, unknown bool) {
+	set := true
+	sign := byte(0)
+	for i := 0; i < len(changes); i++ {
+		mode := changes[i]
+		switch {
+		case mode == '+' || mode == '-':
+			set = mode == '+'
+			continue
+		case strings.IndexByte(UserModes, mode) == -1:
+			unknown = true
+			continue
+		case mode == 'o' && set:
+			continue
+		case c.HasMode(mode) == set:
+			continue
+		}
+		c.SetMode(mode, set)
+		change := byte('-')
+		if set {
+			change = '+'
+		}
+		if change != sign {
+			applied = applied + string(change)
+			sign = change
+		}
+		applied = applied + string(mode)
+	}
+	return
+}
+
+// User mode string, like "+R".
+func (c *Client) ModeString() string {
+	c.modesM.RLock()
+	flags := make([]string, 0, len(c.modes))
+	for m := range c.modes {
+		flags = append(flags, string(m))
+	}
+	c.modesM.RUnlock()
+	sort.Strings(flags)
+	return "+" + strings.Join(flags, "")
 }
 
 func NewClient(conn net.Conn) *Client {
+	return NewClassClient(conn, DefaultClass)
+}
+
+// Client limited by the connection class.
+func NewClassClient(conn net.Conn, class *Class) *Client {
 	nickname := "*"
 	username := ""
 	realname := ""
@@ -83,7 +297,10 @@ func NewClient(conn net.Conn) *Client {
 		recvTimestamp: time.Now(),
 		sendTimestamp: time.Now(),
 		alive:         true,
-		outBuf:        make(chan *string, MaxOutBuf),
+		modes:         make(map[byte]struct{}),
+		caps:          make(map[string]struct{}),
+		outBuf:        make(chan []byte, class.sendq),
+		class:         class,
 	}
 	go c.MsgSender()
 	return &c
@@ -94,6 +311,13 @@ func (c *Client) SetDead() {
 	c.alive = false
 }
 
+// Is the client not closed yet.
+func (c *Client) Alive() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.alive
+}
+
 func (c *Client) Close(text string) {
 	c.Lock()
 	if c.alive {
@@ -109,6 +333,9 @@ func (c *Client) Close(text string) {
 func (c *Client) Processor(sink chan ClientEvent) {
 	sink <- ClientEvent{c, EventNew, ""}
 	log.Println(c, "New client")
+	if *dnsbl != "" {
+		go CheckDNSBL(c, sink)
+	}
 	buf := make([]byte, BufSize*2)
 	var n int
 	var prev int
@@ -116,7 +343,7 @@ func (c *Client) Processor(sink chan ClientEvent) {
 	var err error
 	for {
 		if prev == BufSize {
-			log.Println(c, "input buffer size exceeded, kicking him")
+			LogFailure(c, "flood", "input buffer size exceeded, kicking him")
 			break
 		}
 		n, err = c.conn.Read(buf[prev:])
@@ -129,7 +356,14 @@ func (c *Client) Processor(sink chan ClientEvent) {
 		if i == -1 {
 			continue
 		}
-		sink <- ClientEvent{c, EventMsg, string(buf[:i])}
+		line := string(buf[:i])
+		if cs := c.Charset(); cs != nil {
+			line = cs.Decode(buf[:i])
+		}
+		if !c.HandleLocal(line) {
+			atomic.AddInt32(&c.pending, 1)
+			sink <- ClientEvent{c, EventMsg, line}
+		}
 		copy(buf, buf[i+2:prev])
 		prev -= (i + 2)
 		goto CheckMore
@@ -138,31 +372,348 @@ func (c *Client) Processor(sink chan ClientEvent) {
 	sink <- ClientEvent{c, EventDel, *c.quitMsg}
 }
 
+// Register nickname change attempt at the given time, if the client
+// has not exceeded NickChangesLimit during the last NickChangesPeriod.
+func (c *Client) NickChangeAllowed(now time.Time) bool {
+	recent := c.nickChanges[:0]
+	for _, stamp := range c.nickChanges {
+		if stamp.Add(NickChangesPeriod).After(now) {
+			recent = append(recent, stamp)
+		}
+	}
+	c.nickChanges = recent
+	if len(recent) >= NickChangesLimit {
+		return false
+	}
+	c.nickChanges = append(c.nickChanges, now)
+	return true
+}
+
+// Change client's nickname. The Daemon does that under the mutex, as
+// HandleLocal reads it in client's goroutine.
+func (c *Client) SetNickname(nickname string) {
+	c.Lock()
+	c.nickname = &nickname
+	c.Unlock()
+}
+
+// Mark the client as registered, under the mutex as SetNickname does.
+func (c *Client) SetRegistered() {
+	c.Lock()
+	c.registered = true
+	c.Unlock()
+}
+
+// Remember the time client has sent something to us.
+func (c *Client) Touch(now time.Time) {
+	c.Lock()
+	c.recvTimestamp = now
+	c.Unlock()
+}
+
+// Argument of PING the client has to echo in PONG: random nonce, or
+// the server's hostname if -pingtoken says so.
+func NewPingToken() string {
+	if *pingToken == "hostname" {
+		return *hostname
+	}
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		log.Println("Can not generate PING nonce", err)
+		return *hostname
+	}
+	return hex.EncodeToString(nonce)
+}
+
+// Send PING, remembering when and with what token, to check PONG and
+// measure the lag.
+func (c *Client) Ping(now time.Time) {
+	token := NewPingToken()
+	c.Lock()
+	c.pingSent = now
+	c.pingToken = token
+	c.Unlock()
+	c.Msg("PING :" + token)
+}
+
+// Remember the time client has answered PING, if one of PONG params is
+// the token of the unanswered PING. Unsolicited PONGs or ones with
+// wrong tokens are ignored and do not keep the client alive.
+func (c *Client) Pong(now time.Time, params []string) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.pingToken == "" {
+		return false
+	}
+	for _, param := range params {
+		if param == c.pingToken {
+			c.recvTimestamp = now
+			c.lag = now.Sub(c.pingSent)
+			c.pingSent = time.Time{}
+			c.pingToken = ""
+			return true
+		}
+	}
+	return false
+}
+
+// Round trip time of the last answered PING, zero if none is answered.
+func (c *Client) Lag() time.Duration {
+	c.Lock()
+	defer c.Unlock()
+	return c.lag
+}
+
+// When did client send something to us the last time.
+func (c *Client) LastRecv() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.recvTimestamp
+}
+
+// Handle commands touching nothing but client's own state right in its
+// goroutine, leaving only cross-client ones to the Daemon. That is done
+// only when no other client's messages are in Daemon's queue, so replies
+// order is kept. Tagged messages always go to the Daemon, as it handles
+// labeled responses. Returns false if the message was not handled.
+func (c *Client) HandleLocal(line string) bool {
+	c.Lock()
+	nickname, registered := *c.nickname, c.registered
+	c.Unlock()
+	if atomic.LoadInt32(&c.pending) != 0 || !registered || strings.HasPrefix(line, "@") {
+		return false
+	}
+	msg := ParseMessage(line)
+	if CommandDisabled(c, msg.command) {
+		return false
+	}
+	switch msg.command {
+	case "PING":
+		if len(msg.params) == 0 {
+			return false
+		}
+		c.Touch(time.Now())
+		c.Reply(fmt.Sprintf("PONG %s :%s", *hostname, strings.TrimPrefix(msg.Params(), ":")))
+	case "PONG":
+		c.Pong(time.Now(), msg.params)
+	case "MODE":
+		if len(msg.params) != 1 || Fold(nickname) != Fold(msg.params[0]) {
+			return false
+		}
+		c.Touch(time.Now())
+		c.Msg("221 " + nickname + " " + c.ModeString())
+	default:
+		return false
+	}
+	return true
+}
+
+// Write queued lines to the connection until nil, queued by SetDead, is
+// met. The first write error is logged and closes the connection.
 func (c *Client) MsgSender() {
-	for msg := range c.outBuf {
-		if msg == nil {
-			c.conn.Close()
+	var failed bool
+	for line := range c.outBuf {
+		if line == nil {
+			if !failed {
+				c.conn.Close()
+			}
 			break
 		}
-		c.conn.Write(append([]byte(*msg), CRLF...))
+		// After write error lines are just drained, until Processor
+		// notices closed connection and the client is deleted
+		if failed {
+			continue
+		}
+		if cs := c.Charset(); cs != nil {
+			line = cs.Encode(line)
+		}
+		if _, err := c.conn.Write(line); err != nil {
+			log.Println(c, "write error:", err)
+			failed = true
+			c.conn.Close()
+		}
 	}
 }
 
-// Send message as is with CRLF appended.
+func (c *Client) Charset() *Charset {
+	c.Lock()
+	defer c.Unlock()
+	return c.charset
+}
+
+// Transcode further client's input and output, UTF-8 if charset is nil.
+func (c *Client) SetCharset(cs *Charset) {
+	c.Lock()
+	c.charset = cs
+	c.Unlock()
+}
+
+// Message with CRLF appended, ready to be written to the connection.
+// The same line can be queued for many clients: it is never modified.
+func Line(text string) []byte {
+	line := make([]byte, len(text)+len(CRLF))
+	copy(line, text)
+	copy(line[len(text):], CRLF)
+	return line
+}
+
+// Send message as is with CRLF appended. While labeled command is
+// processed, message is considered its reply and collected instead.
 func (c *Client) Msg(text string) {
 	c.Lock()
 	defer c.Unlock()
+	if c.label != nil {
+		if c.alive {
+			c.labeled = append(c.labeled, text)
+		}
+		return
+	}
+	c.send(text)
+}
+
+// Send message caused by someone else's actions, like channel traffic.
+// It is never considered a reply to the client's labeled command.
+func (c *Client) Relay(text string) {
+	c.Lock()
+	c.send(text)
+	c.Unlock()
+}
+
+// Send line formatted once for many clients, like channel traffic.
+// It is never considered a reply, just like Relay.
+func (c *Client) RelayLine(line []byte) {
+	c.Lock()
+	c.enqueue(line)
+	c.Unlock()
+}
+
+// Queue messages for sending. Client must be locked by the caller.
+func (c *Client) send(texts ...string) {
+	lines := make([][]byte, 0, len(texts))
+	for _, text := range texts {
+		lines = append(lines, Line(text))
+	}
+	c.enqueue(lines...)
+}
+
+// Queue lines for sending. Client must be locked by the caller.
+func (c *Client) enqueue(lines ...[]byte) {
 	if !c.alive {
 		return
 	}
-	if len(c.outBuf) == MaxOutBuf {
+	if len(c.outBuf)+len(lines) > c.class.sendq {
 		log.Println(c, "output buffer size exceeded, kicking him")
+		c.SetDead()
+		return
+	}
+	for _, line := range lines {
+		c.outBuf <- line
+	}
+}
+
+// Send long reply, like LIST, without filling more than half of output
+// queue. Lines not fitting at once are relayed in the background, as
+// the queue is drained. Replies to labeled command are collected whole.
+// Returns false if the previous long reply is still being streamed.
+func (c *Client) Stream(texts []string) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.streaming {
+		return false
+	}
+	if c.label != nil {
 		if c.alive {
-			c.SetDead()
+			c.labeled = append(c.labeled, texts...)
 		}
-		return
+		return true
+	}
+	n := c.streamable(len(texts))
+	c.send(texts[:n]...)
+	if n < len(texts) {
+		c.streaming = true
+		go c.streamRest(texts[n:])
+	}
+	return true
+}
+
+// How many of lines can be queued now. Client must be locked.
+func (c *Client) streamable(lines int) int {
+	limit := c.class.sendq / 2
+	if limit < 1 {
+		limit = 1
+	}
+	free := limit - len(c.outBuf)
+	if free < 0 {
+		free = 0
+	}
+	if free > lines {
+		free = lines
+	}
+	return free
+}
+
+func (c *Client) streamRest(texts []string) {
+	for {
+		time.Sleep(StreamPause)
+		c.Lock()
+		if !c.alive {
+			c.streaming = false
+			c.Unlock()
+			return
+		}
+		n := c.streamable(len(texts))
+		c.send(texts[:n]...)
+		texts = texts[n:]
+		if len(texts) == 0 {
+			c.streaming = false
+			c.Unlock()
+			return
+		}
+		c.Unlock()
+	}
+}
+
+// Start collecting replies to the command tagged with the label.
+func (c *Client) StartLabeled(label string) {
+	c.Lock()
+	c.label = &label
+	c.labeled = nil
+	c.Unlock()
+}
+
+// Send replies collected since StartLabeled, tagged with the label:
+// ACK if there are none, as is if there is single one, wrapped in the
+// labeled-response BATCH otherwise.
+func (c *Client) FinishLabeled() {
+	c.Lock()
+	defer c.Unlock()
+	tag := "label=" + EscapeTag(*c.label)
+	replies := c.labeled
+	c.label = nil
+	c.labeled = nil
+	switch len(replies) {
+	case 0:
+		c.send(AddTag(":"+*hostname+" ACK", tag))
+	case 1:
+		c.send(AddTag(replies[0], tag))
+	default:
+		ref := NewBatchRef()
+		batch := []string{AddTag(":"+*hostname+" BATCH +"+ref+" labeled-response", tag)}
+		for _, reply := range replies {
+			batch = append(batch, AddTag(reply, "batch="+ref))
+		}
+		c.send(append(batch, ":"+*hostname+" BATCH -"+ref)...)
+	}
+}
+
+// Keep private message received while away, dropping the oldest ones
+// over -awayqueue limit.
+func (c *Client) QueueAway(from, text string, now time.Time) {
+	msg := fmt.Sprintf("[%s] <%s> %s", now.UTC().Format("15:04"), from, strings.TrimPrefix(text, ":"))
+	c.awayMsgs = append(c.awayMsgs, msg)
+	if over := len(c.awayMsgs) - int(*awayQueue); over > 0 {
+		c.awayMsgs = c.awayMsgs[over:]
 	}
-	c.outBuf <- &text
 }
 
 // Send message from server. It has ": servername" prefix.
@@ -173,12 +724,16 @@ func (c *Client) Reply(text string) {
 // Send server message, concatenating all provided text parts and
 // prefix the last one with ":".
 func (c *Client) ReplyParts(code string, text ...string) {
+	c.Reply(joinParts(code, text...))
+}
+
+func joinParts(code string, text ...string) string {
 	parts := []string{code}
 	for _, t := range text {
 		parts = append(parts, t)
 	}
 	parts[len(parts)-1] = ":" + parts[len(parts)-1]
-	c.Reply(strings.Join(parts, " "))
+	return strings.Join(parts, " ")
 }
 
 // Send nicknamed server message. After servername it always has target
@@ -187,6 +742,11 @@ func (c *Client) ReplyNicknamed(code string, text ...string) {
 	c.ReplyParts(code, append([]string{*c.nickname}, text...)...)
 }
 
+// Relay nicknamed server message, not being a reply to client's command.
+func (c *Client) RelayNicknamed(code string, text ...string) {
+	c.Relay(":" + *hostname + " " + joinParts(code, append([]string{*c.nickname}, text...)...))
+}
+
 // Reply "461 not enough parameters" error for given command.
 func (c *Client) ReplyNotEnoughParameters(command string) {
 	c.ReplyNicknamed("461", command, "Not enough parameters")
@@ -200,3 +760,38 @@ func (c *Client) ReplyNoChannel(channel string) {
 func (c *Client) ReplyNoNickChan(channel string) {
 	c.ReplyNicknamed("401", channel, "No such nick/channel")
 }
+
+// Send IRCv3 standard reply of the given kind (FAIL, WARN or NOTE):
+// command, machine readable code, optional context parameters and the
+// human readable description as the last text part. Clients without
+// standard-replies capability receive just the description as NOTICE.
+func (c *Client) replyStandard(kind, command, code string, text ...string) {
+	if !c.HasCap("standard-replies") {
+		c.Notice(command + ": " + text[len(text)-1])
+		return
+	}
+	c.ReplyParts(kind, append([]string{command, code}, text...)...)
+}
+
+func (c *Client) ReplyFail(command, code string, text ...string) {
+	c.replyStandard("FAIL", command, code, text...)
+}
+
+func (c *Client) ReplyWarn(command, code string, text ...string) {
+	c.replyStandard("WARN", command, code, text...)
+}
+
+func (c *Client) ReplyNote(command, code string, text ...string) {
+	c.replyStandard("NOTE", command, code, text...)
+}
+
+// Send NOTICE from the server to the client.
+func (c *Client) Notice(text string) {
+	c.Reply("NOTICE " + *c.nickname + " :" + text)
+}
+
+// Notice to the client still not registered, like "*** Looking up your
+// hostname".
+func (c *Client) AuthNotice(text string) {
+	c.Reply("NOTICE AUTH :" + text)
+}
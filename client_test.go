@@ -19,7 +19,11 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
+	"bufio"
+	"net"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 // New client creation test. It must send an event about new client,
@@ -53,6 +57,32 @@ func TestNewClient(t *testing.T) {
 	}
 }
 
+// Client works over any net.Conn, like in-memory net.Pipe one
+func TestPipeClient(t *testing.T) {
+	host := "foohost"
+	hostname = &host
+	conn, remote := net.Pipe()
+	sink := make(chan ClientEvent)
+	client := NewClient(conn)
+	go client.Processor(sink)
+	if event := <-sink; event.eventType != EventNew {
+		t.Fatal("no NEW event", event)
+	}
+	go remote.Write([]byte("NICK nick1\r\n"))
+	if event := <-sink; event.eventType != EventMsg || event.text != "NICK nick1" {
+		t.Fatal("no MSG", event)
+	}
+	client.Reply("hello")
+	r, err := bufio.NewReader(remote).ReadString('\n')
+	if err != nil || r != ":foohost hello\r\n" {
+		t.Fatal("did not recieve hello message", r, err)
+	}
+	remote.Close()
+	if event := <-sink; event.eventType != EventDel {
+		t.Fatal("no client termination", event)
+	}
+}
+
 // Test replies formatting
 func TestClientReplies(t *testing.T) {
 	conn := NewTestingConn()
@@ -81,4 +111,104 @@ func TestClientReplies(t *testing.T) {
 	if r := <-conn.outbound; r != ":foohost 461 мойник CMD :Not enough parameters\r\n" {
 		t.Fatal("did not recieve 461 message", r)
 	}
+
+	client.ReplyFail("CMD", "SOME_CODE", "ctx", "Some description")
+	if r := <-conn.outbound; r != ":foohost NOTICE мойник :CMD: Some description\r\n" {
+		t.Fatal("did not recieve FAIL fallback notice", r)
+	}
+	client.caps["standard-replies"] = struct{}{}
+	client.ReplyFail("CMD", "SOME_CODE", "ctx", "Some description")
+	if r := <-conn.outbound; r != ":foohost FAIL CMD SOME_CODE ctx :Some description\r\n" {
+		t.Fatal("did not recieve FAIL message", r)
+	}
+	client.ReplyNote("CMD", "SOME_CODE", "Some description")
+	if r := <-conn.outbound; r != ":foohost NOTE CMD SOME_CODE :Some description\r\n" {
+		t.Fatal("did not recieve NOTE message", r)
+	}
+}
+
+// Connection every write to which fails
+type BrokenConn struct {
+	*TestingConn
+}
+
+func (conn *BrokenConn) Write(b []byte) (n int, err error) {
+	return 0, conn.TestingConn
+}
+
+func TestWriteError(t *testing.T) {
+	conn := &BrokenConn{NewTestingConn()}
+	sink := make(chan ClientEvent)
+	client := NewClient(conn)
+	go client.Processor(sink)
+	<-sink
+	client.Msg("foo")
+	if _, ok := <-conn.outbound; ok {
+		t.Fatal("connection is not closed after write error")
+	}
+	client.Msg("bar")
+	conn.inbound <- ""
+	if event := <-sink; event.eventType != EventDel {
+		t.Fatal("no client termination", event)
+	}
+}
+
+func TestNickChangeAllowed(t *testing.T) {
+	client := NewClient(NewTestingConn())
+	now := time.Now()
+	for i := 0; i < NickChangesLimit; i++ {
+		if !client.NickChangeAllowed(now) {
+			t.Fatal("nick change denied", i)
+		}
+	}
+	if client.NickChangeAllowed(now) {
+		t.Fatal("nick change over limit allowed")
+	}
+	if !client.NickChangeAllowed(now.Add(NickChangesPeriod)) {
+		t.Fatal("nick change denied after period")
+	}
+}
+
+func TestChangeModes(t *testing.T) {
+	client := NewClient(NewTestingConn())
+	if applied, unknown := client.ChangeModes("+iwo"); applied != "+iw" || unknown {
+		t.Fatal("setting modes", applied, unknown)
+	}
+	if applied, unknown := client.ChangeModes("+i-wx+R"); applied != "-w+R" || !unknown {
+		t.Fatal("changing modes", applied, unknown)
+	}
+	if mode := client.ModeString(); mode != "+Ri" {
+		t.Fatal("modes after changes", mode)
+	}
+	client.SetMode('o', true)
+	if applied, _ := client.ChangeModes("-o"); applied != "-o" || client.HasMode('o') {
+		t.Fatal("dropping operator status", applied)
+	}
+}
+
+// Clients connected through Unix domain socket are local ones
+func TestUnixSocketHost(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "goircd.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	dialed, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialed.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(conn)
+	defer client.Close("")
+	if addr := client.Addr(); addr != "localhost" {
+		t.Fatal("unix socket address", addr)
+	}
+	if host := client.Host(); host != "localhost" {
+		t.Fatal("unix socket host", host)
+	}
 }
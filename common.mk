@@ -1,4 +1,4 @@
-LDFLAGS = -X main.version=$(VERSION)
+LDFLAGS = -X main.version=$(VERSION) -X main.buildDate=$(BUILD_DATE)
 
 goircd: *.go
 	go build -ldflags "$(LDFLAGS)"
@@ -72,22 +72,22 @@ func (conn *TestingConn) Close() error {
 	return nil
 }
 
-func (conn TestingConn) LocalAddr() net.Addr {
+func (conn *TestingConn) LocalAddr() net.Addr {
 	return nil
 }
 
-func (conn TestingConn) RemoteAddr() net.Addr {
+func (conn *TestingConn) RemoteAddr() net.Addr {
 	return MyAddr{}
 }
 
-func (conn TestingConn) SetDeadline(t time.Time) error {
+func (conn *TestingConn) SetDeadline(t time.Time) error {
 	return nil
 }
 
-func (conn TestingConn) SetReadDeadline(t time.Time) error {
+func (conn *TestingConn) SetReadDeadline(t time.Time) error {
 	return nil
 }
 
-func (conn TestingConn) SetWriteDeadline(t time.Time) error {
+func (conn *TestingConn) SetWriteDeadline(t time.Time) error {
 	return nil
 }
@@ -22,25 +22,47 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"net"
+	"os"
 	"regexp"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 const (
-	// Max deadline time of client's unresponsiveness
-	PingTimeout = time.Second * 180
-	// Max idle client's time before PING are sent
+	// Default max idle client's time before PING are sent. Clients
+	// silent for twice as long are disconnected
 	PingThreshold = time.Second * 90
+	// How many disconnected clients are remembered for WHOWAS
+	WhowasSize = 128
+	// How many nickname changes are allowed per NickChangesPeriod
+	NickChangesLimit  = 5
+	NickChangesPeriod = time.Minute
+	// How often unknown commands of the single client are logged
+	UnknownLogPeriod = time.Minute
+	// How many comma-separated targets PRIVMSG and NOTICE accept
+	MaxTargets = 4
+	// How many different commands are counted separately, others are
+	// counted together as "*"
+	MaxCountedCommands = 64
+	// Max length of AWAY message and channel topic, longer are truncated
+	AwayLen  = 200
+	TopicLen = 300
 )
 
 var (
 	RENickname = regexp.MustCompile("^[^\\x00\\x0D\\x0A\\x20\\x3A]{1,64}$") // any octet except NUL, CR, LF, " " and ":"
+	REUsername = regexp.MustCompile("^[a-zA-Z0-9_.~-]{1,32}$")
+	REHost     = regexp.MustCompile("^[a-zA-Z0-9]([a-zA-Z0-9.:/-]{0,62}[a-zA-Z0-9])?$")
 
 	clients    map[*Client]struct{} = make(map[*Client]struct{})
 	clientsM   sync.RWMutex
@@ -48,21 +70,108 @@ var (
 	roomsM     sync.RWMutex
 	roomsGroup sync.WaitGroup
 	roomSinks  map[*Room]chan ClientEvent = make(map[*Room]chan ClientEvent)
+	// Tokens advertised in ISUPPORT (005) reply
+	ISupport = []string{
+		"CHANTYPES=#",
+		"PREFIX=(ov)@+",
+		"CHANMODES=bq,k,f,crs",
+		"EXTBAN=$," + ExtbanTypes,
+		fmt.Sprintf("TARGMAX=PRIVMSG:%d,NOTICE:%d", MaxTargets, MaxTargets),
+		fmt.Sprintf("CHANNELLEN=%d", ChannelLen),
+		fmt.Sprintf("AWAYLEN=%d", AwayLen),
+		fmt.Sprintf("TOPICLEN=%d", TopicLen),
+		"BOT=B",
+		"ELIST=CMNTU",
+		"SAFELIST",
+		"STATUSMSG=@+",
+	}
+	// Recently disconnected clients, the latest are the last ones
+	whowas []WhowasEntry
+	// Registered clients identified to the account, folded, guarded by
+	// clientsM. Several connections of the account are its sessions
+	accounts = make(map[string]map[*Client]struct{})
+	// All-time highest numbers of registered clients and formed channels
+	maxUsers    int
+	maxChannels int
+	peaksM      sync.Mutex
+	// Server's start time, reported by STATS u
+	started = time.Now()
+	// Times each command was used, accessed by Daemon only
+	commandsUsed = make(map[string]uint64)
+	// -motd file lines, nil if there is none, reloaded on REHASH
+	motdLines []string
+	// Commands disabled by -disable, set once during startup
+	disabledCommands = make(map[string]struct{})
+	// Commands needed to register, stay alive and leave, which can not
+	// be disabled
+	essentialCommands = []string{"CAP", "NICK", "PASS", "PING", "PONG", "QUIT", "USER"}
 )
 
+// Registered client's details kept after its disconnection
+type WhowasEntry struct {
+	nickname string
+	username string
+	host     string
+	realname string
+	signon   time.Time
+}
+
+// Cut the text to at most n bytes, not splitting UTF-8 sequences.
+func Truncate(text string, n int) string {
+	if len(text) <= n {
+		return text
+	}
+	for n > 0 && !utf8.RuneStart(text[n]) {
+		n--
+	}
+	return text[:n]
+}
+
+// Fold nickname or channel name case according to -casemapping: only
+// ASCII letters are folded, rfc1459 also folds []\~ to {}|^.
+func Fold(s string) string {
+	rfc1459 := *casemapping == "rfc1459"
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'A' <= r && r <= 'Z':
+			return r + 'a' - 'A'
+		case rfc1459 && r == '[':
+			return '{'
+		case rfc1459 && r == ']':
+			return '}'
+		case rfc1459 && r == '\\':
+			return '|'
+		case rfc1459 && r == '~':
+			return '^'
+		}
+		return r
+	}, s)
+}
+
 func GetRoom(name string) (r *Room, found bool) {
 	var room string
 	if strings.HasPrefix(name, "#") {
-		room = strings.ToLower(name)
+		room = Fold(name)
 	} else {
-		room = "#" + strings.ToLower(name)
+		room = "#" + Fold(name)
 	}
 	r, found = rooms[room]
 
 	return r, found
 }
 
-func GetNumberOfRegisteredUsers(client *Client) (nusers float64){
+// Connected sessions of the account.
+func AccountSessions(account string) []*Client {
+	clientsM.RLock()
+	defer clientsM.RUnlock()
+	sessions := make([]*Client, 0, len(accounts[Fold(account)]))
+	for c := range accounts[Fold(account)] {
+		sessions = append(sessions, c)
+	}
+	return sessions
+}
+
+func GetNumberOfRegisteredUsers(client *Client) (nusers float64) {
 	nusers = 0
 	clientsM.RLock()
 	for client := range clients {
@@ -75,23 +184,483 @@ func GetNumberOfRegisteredUsers(client *Client) (nusers float64){
 }
 
 func SendLusers(client *Client) {
-	lusers := int(GetNumberOfRegisteredUsers(client))
-	client.ReplyNicknamed("251", fmt.Sprintf("There are %d users and 0 invisible on 1 servers", lusers))
+	var users, operators, unknown int
+	clientsM.RLock()
+	for c := range clients {
+		if !c.registered {
+			unknown++
+			continue
+		}
+		users++
+		if c.HasMode('o') {
+			operators++
+		}
+	}
+	clientsM.RUnlock()
+	peaksM.Lock()
+	max := maxUsers
+	peaksM.Unlock()
+	roomsM.RLock()
+	channels := len(rooms)
+	roomsM.RUnlock()
+	client.ReplyNicknamed("251", fmt.Sprintf("There are %d users and 0 invisible on 1 servers", users))
+	client.ReplyNicknamed("252", strconv.Itoa(operators), "operator(s) online")
+	client.ReplyNicknamed("253", strconv.Itoa(unknown), "unknown connection(s)")
+	client.ReplyNicknamed("254", strconv.Itoa(channels), "channels formed")
+	client.ReplyNicknamed("255", fmt.Sprintf("I have %d clients and 0 servers", users))
+	client.ReplyNicknamed("265", strconv.Itoa(users), strconv.Itoa(max), fmt.Sprintf("Current local users %d, max %d", users, max))
+	client.ReplyNicknamed("266", strconv.Itoa(users), strconv.Itoa(max), fmt.Sprintf("Current global users %d, max %d", users, max))
 }
 
-func SendMotd(client *Client) {
-	if motd == nil {
-		client.ReplyNicknamed("422", "MOTD File is missing")
+// Remember current numbers of registered clients and formed channels if
+// they are the highest ones. New peaks are saved to -peaks file.
+func UpdatePeaks() {
+	users := int(GetNumberOfRegisteredUsers(nil))
+	roomsM.RLock()
+	channels := len(rooms)
+	roomsM.RUnlock()
+	peaksM.Lock()
+	defer peaksM.Unlock()
+	if users <= maxUsers && channels <= maxChannels {
+		return
+	}
+	if users > maxUsers {
+		maxUsers = users
+	}
+	if channels > maxChannels {
+		maxChannels = channels
+	}
+	if *peaks == "" {
+		return
+	}
+	data := fmt.Sprintf("%d %d\n", maxUsers, maxChannels)
+	if err := WriteFileAtomic(*peaks, []byte(data), os.FileMode(0660)); err != nil {
+		log.Printf("Can not write peaks file %s: %v", *peaks, err)
+	}
+}
+
+// Load all-time peaks saved by UpdatePeaks.
+func LoadPeaks(fn string) {
+	buf, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Can not read peaks file %s: %v", fn, err)
+		}
+		return
+	}
+	peaksM.Lock()
+	defer peaksM.Unlock()
+	if _, err = fmt.Sscanf(string(buf), "%d %d", &maxUsers, &maxChannels); err != nil {
+		log.Printf("Peaks file %s corrupted: %v", fn, err)
+	}
+}
+
+// Count the command usage. Clients can send arbitrary commands, so the
+// table is limited by MaxCountedCommands.
+func CountCommand(cmd string) {
+	if _, counted := commandsUsed[cmd]; !counted && len(commandsUsed) >= MaxCountedCommands {
+		cmd = "*"
+	}
+	commandsUsed[cmd]++
+}
+
+// Parse comma-separated list of commands to disable, like "LIST,WHO".
+func ParseDisabled(list string) (map[string]struct{}, error) {
+	disabled := make(map[string]struct{})
+	for _, cmd := range strings.Split(list, ",") {
+		cmd = strings.ToUpper(strings.TrimSpace(cmd))
+		if cmd == "" {
+			continue
+		}
+		for _, essential := range essentialCommands {
+			if cmd == essential {
+				return nil, fmt.Errorf("%s command can not be disabled", cmd)
+			}
+		}
+		disabled[cmd] = struct{}{}
+	}
+	return disabled, nil
+}
+
+// Is the command disabled for the client. Operators can use all of them.
+func CommandDisabled(client *Client, cmd string) bool {
+	_, disabled := disabledCommands[cmd]
+	return disabled && !client.HasMode('o')
+}
+
+// Commands sorted by name, with their usage counts.
+func CommandsUsage() [][2]string {
+	cmds := make([]string, 0, len(commandsUsed))
+	for cmd := range commandsUsed {
+		cmds = append(cmds, cmd)
+	}
+	sort.Strings(cmds)
+	usage := make([][2]string, 0, len(cmds))
+	for _, cmd := range cmds {
+		usage = append(usage, [2]string{cmd, strconv.FormatUint(commandsUsed[cmd], 10)})
+	}
+	return usage
+}
+
+// Registered clients counts per listener, sorted by listener kind and
+// address: kind, address and count. Listeners having only unregistered
+// clients are included with zero count.
+func ListenersUsage() [][3]string {
+	counts := make(map[[2]string]int)
+	clientsM.RLock()
+	for c := range clients {
+		key := [2]string{c.kind, c.listener}
+		n := counts[key]
+		if c.registered {
+			n++
+		}
+		counts[key] = n
+	}
+	clientsM.RUnlock()
+	keys := make([][2]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	usage := make([][3]string, 0, len(keys))
+	for _, key := range keys {
+		usage = append(usage, [3]string{key[0], key[1], strconv.Itoa(counts[key])})
+	}
+	return usage
+}
+
+// Listeners ever exported to metrics, to zero those left without clients
+var listenersExported = make(map[[2]string]struct{})
+
+// Update connected clients metrics, total and per listener.
+func UpdateConnected(client *Client) {
+	clients_connected.Set(GetNumberOfRegisteredUsers(client))
+	gone := make(map[[2]string]struct{}, len(listenersExported))
+	for key := range listenersExported {
+		gone[key] = struct{}{}
+	}
+	for _, usage := range ListenersUsage() {
+		key := [2]string{usage[0], usage[1]}
+		n, _ := strconv.Atoi(usage[2])
+		clients_listener_connected.With(prometheus.Labels{"kind": key[0], "listener": key[1]}).Set(float64(n))
+		listenersExported[key] = struct{}{}
+		delete(gone, key)
+	}
+	for key := range gone {
+		clients_listener_connected.With(prometheus.Labels{"kind": key[0], "listener": key[1]}).Set(0)
+	}
+}
+
+// Log clients, rooms and goroutines numbers and commands usage. It is
+// done on SIGUSR1.
+func DumpStats() {
+	clientsM.RLock()
+	all := len(clients)
+	clientsM.RUnlock()
+	roomsM.RLock()
+	channels := len(rooms)
+	roomsM.RUnlock()
+	log.Printf(
+		"Stats: %d clients, %.0f registered, %d channels, %d goroutines",
+		all, GetNumberOfRegisteredUsers(nil), channels, runtime.NumGoroutine(),
+	)
+	usage := make([]string, 0, len(commandsUsed))
+	for _, cmdCount := range CommandsUsage() {
+		usage = append(usage, cmdCount[0]+"="+cmdCount[1])
+	}
+	log.Println("Stats: commands", strings.Join(usage, " "))
+	usage = usage[:0]
+	for _, listenerCount := range ListenersUsage() {
+		usage = append(usage, listenerCount[0]+"/"+listenerCount[1]+"="+listenerCount[2])
+	}
+	log.Println("Stats: listeners", strings.Join(usage, " "))
+	var lag time.Duration
+	var lagging *Client
+	clientsM.RLock()
+	for c := range clients {
+		if l := c.Lag(); l > lag {
+			lag, lagging = l, c
+		}
+	}
+	clientsM.RUnlock()
+	if lagging != nil {
+		log.Println("Stats: max lag", lag, "of", lagging)
+	}
+}
+
+// Send STATS reply: u query shows uptime and peaks, m one shows commands
+// usage, l one shows connections sendq and lag: all to operators, only
+// own one to others.
+func SendStats(client *Client, query string) {
+	if query == "l" {
+		clientsM.RLock()
+		for c := range clients {
+			if !c.registered || (c != client && !client.HasMode('o')) {
+				continue
+			}
+			client.ReplyNicknamed(
+				"211",
+				c.String(),
+				strconv.Itoa(len(c.outBuf)),
+				strconv.FormatInt(c.Lag().Milliseconds(), 10),
+				strconv.Itoa(int(time.Since(c.signon).Seconds())),
+				"sendq, lag ms, seconds connected",
+			)
+		}
+		clientsM.RUnlock()
+	}
+	if query == "P" {
+		for _, usage := range ListenersUsage() {
+			client.ReplyNicknamed("249", usage[0], usage[1], usage[2], "registered clients")
+		}
+	}
+	if query == "m" {
+		for _, cmdCount := range CommandsUsage() {
+			client.ReplyNicknamed("212", cmdCount[0], cmdCount[1])
+		}
+	}
+	if query == "u" {
+		uptime := time.Since(started)
+		client.ReplyNicknamed("242", fmt.Sprintf(
+			"Server Up %d days %d:%02d:%02d",
+			int(uptime.Hours())/24,
+			int(uptime.Hours())%24,
+			int(uptime.Minutes())%60,
+			int(uptime.Seconds())%60,
+		))
+		peaksM.Lock()
+		client.ReplyNicknamed("250", fmt.Sprintf(
+			"Highest user count: %d, highest channel count: %d",
+			maxUsers, maxChannels,
+		))
+		peaksM.Unlock()
+	}
+	client.ReplyNicknamed("219", query, "End of STATS report")
+}
+
+// Check IRC operator's credentials against the -opers file, having the
+// same format as passwords one.
+func OperValid(name, password string) bool {
+	return CredentialsValid(*opers, name, password)
+}
+
+// Check login and password against the file of login:password lines.
+func CredentialsValid(fn, name, password string) bool {
+	contents, err := ioutil.ReadFile(fn)
+	if err != nil {
+		log.Printf("Can not read credentials file %s: %s", fn, err)
+		return false
+	}
+	for _, entry := range strings.Split(string(contents), "\n") {
+		lp := strings.SplitN(entry, ":", 2)
+		if len(lp) == 2 && lp[0] == name && lp[1] == password {
+			return true
+		}
+	}
+	return false
+}
+
+// Has the client's class more than maxPerIP connections from its
+// address, including the client itself.
+func ClassFull(client *Client) bool {
+	if client.class.maxPerIP == 0 {
+		return false
+	}
+	addr := client.Addr()
+	connections := 0
+	clientsM.RLock()
+	for c := range clients {
+		if c.class == client.class && c.Addr() == addr {
+			connections++
+		}
+	}
+	clientsM.RUnlock()
+	return connections > client.class.maxPerIP
+}
+
+// Are there -maxclones registered clients from the client's address
+// already, regardless of their classes.
+func ClonesExceeded(client *Client) bool {
+	if *maxClones == 0 {
+		return false
+	}
+	addr := client.Addr()
+	clones := 0
+	clientsM.RLock()
+	for c := range clients {
+		if c != client && c.registered && c.Addr() == addr {
+			clones++
+		}
+	}
+	clientsM.RUnlock()
+	return clones >= int(*maxClones)
+}
+
+// Is the client, connected less than -newuserdelay seconds ago, not
+// allowed to message the target yet. Operators and identified clients
+// are not restricted. New ones can message only members of channels
+// they have joined and those channels, so spam-and-run bots can not
+// reach everyone at once. Unknown targets are left to the usual
+// replies.
+func NewUserRestricted(client *Client, target string, now time.Time) bool {
+	if *newUserDelay == 0 || client.HasMode('o') || client.account != nil {
+		return false
+	}
+	if client.signon.Add(time.Duration(*newUserDelay) * time.Second).Before(now) {
+		return false
+	}
+	if strings.HasPrefix(target, "#") {
+		roomsM.RLock()
+		defer roomsM.RUnlock()
+		r, found := GetRoom(target)
+		if !found {
+			return false
+		}
+		r.RLock()
+		defer r.RUnlock()
+		_, member := r.members[client]
+		return !member
+	}
+	c := FindClient(target)
+	if c == nil || c == client {
+		return false
+	}
+	_, shared := SharedClients(client)[c]
+	return !shared
+}
+
+// Send server NOTICE to all registered clients, or only to IRC
+// operators among them.
+func SendServerNotice(text string, opersOnly bool) {
+	clientsM.RLock()
+	for c := range clients {
+		if c.registered && (!opersOnly || c.HasMode('o')) {
+			c.Reply(fmt.Sprintf("NOTICE %s :%s", *c.nickname, text))
+		}
+	}
+	clientsM.RUnlock()
+}
+
+// Find registered client by nickname.
+func FindClient(nickname string) *Client {
+	clientsM.RLock()
+	defer clientsM.RUnlock()
+	for c := range clients {
+		if c.registered && c.Match(nickname) {
+			return c
+		}
+	}
+	return nil
+}
+
+// Log notable failure caused by the client and count it in metrics by
+// the reason, like "nickname" or "password".
+func LogFailure(client *Client, reason string, v ...interface{}) {
+	clients_failures_total.With(prometheus.Labels{"reason": reason}).Inc()
+	log.Println(append([]interface{}{client, reason + ":"}, v...)...)
+}
+
+// Disconnect the client by IRC operator.
+func Kill(oper, client *Client, reason string) {
+	if reason == "" {
+		reason = *oper.nickname
+	}
+	client.Msg(fmt.Sprintf(":%s KILL %s :%s", oper, *client.nickname, reason))
+	client.Close("Killed (" + *oper.nickname + " (" + reason + "))")
+	log.Println(oper, "killed", client, "with reason", reason)
+}
+
+// Text of 001 welcome reply: either -welcome one, or mentioning -network.
+func WelcomeText(client *Client) string {
+	switch {
+	case *welcome != "":
+		return *welcome
+	case *network != "":
+		return "Welcome to the " + *network + " Network, " + *client.nickname
+	}
+	return "Hi, welcome to IRC"
+}
+
+// Human readable server description, hostname if -serverinfo is not set.
+func ServerInfo() string {
+	if *serverInfo != "" {
+		return *serverInfo
+	}
+	return *hostname
+}
+
+// Reply with the only server, if it matches the mask.
+func SendLinks(client *Client, mask string) {
+	if WildcardMatch(Fold(mask), Fold(*hostname)) {
+		client.ReplyNicknamed("364", *hostname, *hostname, "0 "+ServerInfo())
+	}
+	client.ReplyNicknamed("365", mask, "End of /LINKS list")
+}
+
+func SendInfo(client *Client) {
+	client.ReplyNicknamed("371", "goircd "+version+" -- minimalistic simple Internet Relay Chat (IRC) server")
+	if *serverInfo != "" {
+		client.ReplyNicknamed("371", *serverInfo)
+	}
+	if buildDate != "" {
+		client.ReplyNicknamed("371", "Built "+buildDate+" with "+runtime.Version())
+	}
+	client.ReplyNicknamed("371", "On-line since "+started.Format(time.RFC1123))
+	client.ReplyNicknamed("374", "End of /INFO list")
+}
+
+func SendISupport(client *Client) {
+	tokens := append([]string{}, ISupport...)
+	tokens = append(tokens, "CASEMAPPING="+*casemapping)
+	if *network != "" {
+		tokens = append(tokens, "NETWORK="+*network)
+	}
+	client.ReplyNicknamed("005", append(tokens, "are supported by this server")...)
+}
+
+// Send -banner file contents to just connected client.
+func SendBanner(client *Client) {
+	if *banner == "" {
+		return
+	}
+	bannerText, err := ioutil.ReadFile(*banner)
+	if err != nil {
+		log.Printf("Can not read banner file %s: %v", *banner, err)
 		return
 	}
+	for _, s := range strings.Split(strings.TrimSuffix(string(bannerText), "\n"), "\n") {
+		client.AuthNotice(s)
+	}
+}
+
+// Read -motd file, with either LF or CRLF line endings, so it is not
+// read on every MOTD request.
+func LoadMotd() error {
+	motdLines = nil
+	if *motd == "" {
+		return nil
+	}
 	motdText, err := ioutil.ReadFile(*motd)
 	if err != nil {
-		log.Printf("Can not read motd file %s: %v", *motd, err)
-		client.ReplyNicknamed("422", "Error reading MOTD File")
+		return err
+	}
+	text := strings.ReplaceAll(string(motdText), "\r\n", "\n")
+	motdLines = strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	return nil
+}
+
+func SendMotd(client *Client) {
+	if motdLines == nil {
+		client.ReplyNicknamed("422", "MOTD File is missing")
 		return
 	}
 	client.ReplyNicknamed("375", "- "+*hostname+" Message of the day -")
-	for _, s := range strings.Split(strings.TrimSuffix(string(motdText), "\n"), "\n") {
+	for _, s := range motdLines {
 		client.ReplyNicknamed("372", "- "+s)
 	}
 	client.ReplyNicknamed("376", "End of /MOTD command")
@@ -99,15 +668,13 @@ func SendMotd(client *Client) {
 
 func SendWhois(client *Client, nicknames []string) {
 	var c *Client
-	var hostPort string
-	var err error
 	var subscriptions []string
 	var room *Room
 	var subscriber *Client
 	for _, nickname := range nicknames {
 		clientsM.RLock()
 		for c = range clients {
-			if c.Match(nickname) {
+			if c.registered && c.Match(nickname) {
 				goto Found
 			}
 		}
@@ -115,24 +682,48 @@ func SendWhois(client *Client, nicknames []string) {
 		client.ReplyNoNickChan(nickname)
 		continue
 	Found:
-		hostPort, _, err = net.SplitHostPort(c.conn.RemoteAddr().String())
-		if err != nil {
-			log.Printf("Can't parse RemoteAddr %q: %v", hostPort, err)
-			hostPort = "Unknown"
+		client.ReplyNicknamed("311", *c.nickname, c.Username(), c.Host(), "*", *c.realname)
+		client.ReplyNicknamed("312", *c.nickname, *hostname, ServerInfo())
+		if c.HasMode('o') {
+			client.ReplyNicknamed("313", *c.nickname, "is an IRC operator")
+		}
+		if c.account != nil {
+			client.ReplyNicknamed("330", *c.nickname, *c.account, "is logged in as")
+		}
+		if c.HasMode('B') {
+			client.ReplyNicknamed("335", *c.nickname, "is a bot")
 		}
-		client.ReplyNicknamed("311", *c.nickname, *c.username, hostPort, "*", *c.realname)
-		client.ReplyNicknamed("312", *c.nickname, *hostname, *hostname)
 		if c.away != nil {
 			client.ReplyNicknamed("301", *c.nickname, *c.away)
 		}
+		// Real address and modes are only for the client itself and operators
+		if c == client || client.HasMode('o') {
+			addr := c.Addr()
+			client.ReplyNicknamed("378", *c.nickname, "is connecting from *@"+addr)
+			client.ReplyNicknamed("379", *c.nickname, "is using modes "+c.ModeString())
+		}
+		client.ReplyNicknamed(
+			"317",
+			*c.nickname,
+			fmt.Sprintf("%d", int(time.Since(c.LastRecv()).Seconds())),
+			fmt.Sprintf("%d", c.signon.Unix()),
+			"seconds idle, signon time",
+		)
 		subscriptions = make([]string, 0)
 		roomsM.RLock()
 		for _, room = range rooms {
+			// Secret channels are shown only to their members and
+			// operators, and to the client itself
+			if c != client && room.Hidden(client) {
+				continue
+			}
+			room.RLock()
 			for subscriber = range room.members {
 				if subscriber.Match(nickname) {
-					subscriptions = append(subscriptions, *room.name)
+					subscriptions = append(subscriptions, room.prefix(subscriber)+*room.name)
 				}
 			}
+			room.RUnlock()
 		}
 		roomsM.RUnlock()
 		sort.Strings(subscriptions)
@@ -142,99 +733,467 @@ func SendWhois(client *Client, nicknames []string) {
 	}
 }
 
-func SendList(client *Client, cols []string) {
-	var rs []string
-	var r string
-	if (len(cols) > 1) && (cols[1] != "") {
-		rs = strings.Split(strings.Split(cols[1], " ")[0], ",")
-	} else {
-		rs = make([]string, 0)
-		roomsM.RLock()
-		for r = range rooms {
-			rs = append(rs, r)
+// Send TRACE reply to IRC operator: either about the single client,
+// or about all connections if no target or the server itself is given.
+// Others receive only the end of trace.
+func SendTrace(client *Client, target string) {
+	all := target == "" || strings.ToLower(target) == strings.ToLower(*hostname)
+	if client.HasMode('o') {
+		found := false
+		lines := make([][]string, 0)
+		clientsM.RLock()
+		for c := range clients {
+			if !all && !(c.registered && c.Match(target)) {
+				continue
+			}
+			found = true
+			addr := c.Addr()
+			switch {
+			case !c.registered:
+				lines = append(lines, []string{"203", "????", "unknown", "[" + addr + "]"})
+			case c.HasMode('o'):
+				lines = append(lines, []string{"204", "Oper", "opers", *c.nickname + "[" + addr + "]"})
+			default:
+				lines = append(lines, []string{"205", "User", "users", *c.nickname + "[" + addr + "]"})
+			}
 		}
-		roomsM.RUnlock()
-	}
-	sort.Strings(rs)
-	var room *Room
-	var found bool
-	for _, r = range rs {
-		roomsM.RLock()
-		if room, found = rooms[r]; found {
-			client.ReplyNicknamed(
-				"322",
-				*room.name,
-				fmt.Sprintf("%d", len(room.members)),
-				*room.topic,
-			)
+		clientsM.RUnlock()
+		if !all && !found {
+			client.ReplyNicknamed("402", target, "No such server")
+			return
+		}
+		sort.Slice(lines, func(i, j int) bool {
+			return strings.Join(lines[i], " ") < strings.Join(lines[j], " ")
+		})
+		for _, line := range lines {
+			client.ReplyNicknamed(line[0], line[1:]...)
 		}
-		roomsM.RUnlock()
 	}
-	client.ReplyNicknamed("323", "End of /LIST")
+	client.ReplyNicknamed("262", *hostname, version, "End of TRACE")
 }
 
-func ClientNick(client *Client, cols []string) {
-	if len(cols) == 1 || len(cols[1]) < 1 {
-		client.ReplyParts("431", "No nickname given")
+// Deliver private messages received while the client was away.
+func SendAwayMessages(client *Client) {
+	if len(client.awayMsgs) == 0 {
 		return
 	}
-	nickname := cols[1]
-	// Compatibility with some clients prepending colons to nickname
-	nickname = strings.TrimPrefix(nickname, ":")
-	rename := false
+	client.Reply(fmt.Sprintf("NOTICE %s :%d messages while you were away:", *client.nickname, len(client.awayMsgs)))
+	for _, msg := range client.awayMsgs {
+		client.Reply(fmt.Sprintf("NOTICE %s :%s", *client.nickname, msg))
+	}
+	client.awayMsgs = nil
+}
+
+// Deliver operator's message to all clients either on the server matching
+// $$servermask, or having host matching $#hostmask.
+func SendMaskMessage(client *Client, cmd, target, text string) {
+	if !client.HasMode('o') {
+		client.ReplyNicknamed("481", "Permission Denied- You're not an IRC operator")
+		return
+	}
+	if cmd == "TAGMSG" {
+		return
+	}
+	mask := strings.ToLower(target[2:])
+	byHost := target[1] == '#'
+	if !byHost && !WildcardMatch(mask, strings.ToLower(*hostname)) {
+		client.ReplyNicknamed("402", target[2:], "No such server")
+		return
+	}
+	msg := fmt.Sprintf(":%s %s %s %s", client, cmd, target, text)
 	clientsM.RLock()
-	for existingClient := range clients {
-		if existingClient == client {
-			rename = true
-		} else if existingClient.Match(nickname) {
-			clientsM.RUnlock()
-			client.ReplyParts("433", "*", nickname, "Nickname is already in use")
-			return
+	for c := range clients {
+		if !c.registered || c == client {
+			continue
+		}
+		if byHost && !WildcardMatch(mask, strings.ToLower(c.Host())) {
+			continue
 		}
+		c.Msg(msg)
 	}
 	clientsM.RUnlock()
-	if !RENickname.MatchString(nickname) {
-		client.ReplyParts("432", "*", cols[1], "Erroneous nickname")
+}
+
+// Deliver PRIVMSG, NOTICE text or TAGMSG with client-only tags to the
+// single target: either ChanServ, client or room. TAGMSG is delivered
+// only to clients supporting message-tags.
+func SendMessage(client *Client, cmd, target, text, tags string) {
+	if Fold(target) == Fold(ChanServ) {
+		if cmd == "PRIVMSG" {
+			HandlerChanServ(client, text)
+		}
 		return
 	}
-	if rename {
-		// find all rooms the client has subscribed,
-		// then gather all clients in those rooms
-		cs := make(map[*Client]struct{})
-		clientsM.RLock() // first clients, then rooms,
-		roomsM.RLock() // to avoid deadlock with SendWhois
-		for _, r := range rooms {
-			if _, subscribed := r.members[client]; subscribed {
-				for c := range r.members {
-					cs[c] = struct{}{}
+	if strings.HasPrefix(target, "$$") || strings.HasPrefix(target, "$#") {
+		SendMaskMessage(client, cmd, target, text)
+		return
+	}
+	// @#room and +#room reach only its operators or voiced members
+	status := ""
+	if len(target) > 1 && strings.IndexByte("@+", target[0]) != -1 && target[1] == '#' {
+		status, target = target[:1], target[1:]
+	}
+	if cmd != "TAGMSG" && NewUserRestricted(client, target, time.Now()) {
+		client.ReplyFail(cmd, "CANNOT_SEND", status+target, fmt.Sprintf(
+			"You can message only those sharing channels with you during %d seconds after connection",
+			*newUserDelay,
+		))
+		return
+	}
+	msg := ""
+	clientsM.RLock()
+	for c := range clients {
+		if status == "" && c.Match(target) {
+			if cmd == "TAGMSG" {
+				msg = fmt.Sprintf(":%s %s %s", client, cmd, *c.nickname)
+				if c.HasCap("message-tags") && !(c.HasMode('R') && client.account == nil) {
+					c.Msg(TaggedFor(c, tags, msg))
+				}
+				break
+			}
+			msg = fmt.Sprintf(":%s %s %s %s", client, cmd, *c.nickname, text)
+			if c.HasMode('R') && client.account == nil {
+				if cmd == "PRIVMSG" {
+					client.ReplyNicknamed("716", *c.nickname, "is in +R mode (only identified users may message)")
+					client.ReplyNicknamed("717", *c.nickname, "has been informed that you messaged them")
+					c.ReplyNicknamed("718", *client.nickname, client.Username()+"@"+client.Host(), "is messaging you, but you are in +R mode")
 				}
+				break
 			}
+			c.Msg(TaggedFor(c, tags, msg))
+			if c.away != nil {
+				client.ReplyNicknamed("301", *c.nickname, *c.away)
+				if cmd == "PRIVMSG" && *awayQueue > 0 {
+					c.QueueAway(*client.nickname, text, time.Now())
+				}
+			}
+			break
 		}
-		// then notify those clients of the nick change
-		message := ":" + client.String() + " NICK " + nickname
-		for c := range cs {
-			c.Msg(message)
+	}
+	clientsM.RUnlock()
+	if msg != "" {
+		return
+	}
+	roomsM.RLock()
+	if r, found := rooms[Fold(target)]; found {
+		if tags != "" {
+			cmd = "@" + tags + " " + cmd
 		}
-		roomsM.RUnlock()
-		clientsM.RUnlock()
+		roomSinks[r] <- ClientEvent{
+			client,
+			EventMsg,
+			cmd + status + " " + strings.TrimLeft(text, ":"),
+		}
+	} else {
+		client.ReplyNoNickChan(status + target)
 	}
-	client.nickname = &nickname
+	roomsM.RUnlock()
 }
 
-// Unregistered client workflow processor. Unregistered client:
-// * is not PINGed
-// * only QUIT, NICK and USER commands are processed
-// * other commands are quietly ignored
-// When client finishes NICK/USER workflow, then MOTD and LUSERS are send to him.
-func ClientRegister(client *Client, cmd string, cols []string) {
-	switch cmd {
-	case "PASS":
-		if len(cols) == 1 || len(cols[1]) < 1 {
-			client.ReplyNotEnoughParameters("PASS")
-			return
+func SendWhowas(client *Client, nickname string) {
+	found := false
+	for i := len(whowas) - 1; i >= 0; i-- {
+		entry := whowas[i]
+		if Fold(entry.nickname) != Fold(nickname) {
+			continue
+		}
+		found = true
+		client.ReplyNicknamed("314", entry.nickname, entry.username, entry.host, "*", entry.realname)
+		client.ReplyNicknamed("312", entry.nickname, *hostname, "Signed on "+entry.signon.Format(time.RFC1123))
+	}
+	if !found {
+		client.ReplyNicknamed("406", nickname, "There was no such nickname")
+	}
+	client.ReplyNicknamed("369", nickname, "End of WHOWAS")
+}
+
+// LIST conditions advertised as ELIST=CMNTU: channel name masks and
+// negated masks, bounds of members count and of time passed since room
+// creation and topic change. Bounds are exclusive lower and upper ones,
+// negative if not set.
+type ListFilter struct {
+	masks    []string
+	notMasks []string
+	users    [2]int
+	created  [2]time.Duration
+	topic    [2]time.Duration
+}
+
+// Split LIST parameters into channel names and conditions: "*mask*",
+// "!*mask*", ">users", "<users", "C>minutes", "C<minutes", "T>minutes"
+// and "T<minutes". Malformed conditions are ignored.
+func ParseListFilter(params []string) (names []string, filter ListFilter) {
+	filter.users = [2]int{-1, -1}
+	filter.created = [2]time.Duration{-1, -1}
+	filter.topic = [2]time.Duration{-1, -1}
+	for _, param := range params {
+		for _, item := range strings.Split(param, ",") {
+			switch {
+			case item == "":
+			case item[0] == '>' || item[0] == '<':
+				n, err := strconv.Atoi(item[1:])
+				if err != nil || n < 0 {
+					continue
+				}
+				if item[0] == '>' {
+					filter.users[0] = n
+				} else {
+					filter.users[1] = n
+				}
+			case len(item) > 2 && (item[0] == 'C' || item[0] == 'T') && (item[1] == '>' || item[1] == '<'):
+				n, err := strconv.Atoi(item[2:])
+				if err != nil || n < 0 {
+					continue
+				}
+				bounds := &filter.created
+				if item[0] == 'T' {
+					bounds = &filter.topic
+				}
+				if item[1] == '>' {
+					bounds[0] = time.Duration(n) * time.Minute
+				} else {
+					bounds[1] = time.Duration(n) * time.Minute
+				}
+			case item[0] == '!':
+				filter.notMasks = append(filter.notMasks, Fold(item[1:]))
+			case strings.ContainsAny(item, "*?"):
+				filter.masks = append(filter.masks, Fold(item))
+			default:
+				names = append(names, item)
+			}
+		}
+	}
+	return
+}
+
+// Is value above and below the bounds, unset when negative.
+func inBounds(value, above, below int64) bool {
+	return (above < 0 || value > above) && (below < 0 || value < below)
+}
+
+// Does the room satisfy all conditions at the given time. Room never
+// having a topic set is considered to have infinitely old one.
+func (filter ListFilter) Match(room *Room, now time.Time) bool {
+	room.RLock()
+	defer room.RUnlock()
+	name := Fold(*room.name)
+	matched := len(filter.masks) == 0
+	for _, mask := range filter.masks {
+		matched = matched || WildcardMatch(mask, name)
+	}
+	for _, mask := range filter.notMasks {
+		matched = matched && !WildcardMatch(mask, name)
+	}
+	topicAge := time.Duration(math.MaxInt64)
+	if !room.topicSet.IsZero() {
+		topicAge = now.Sub(room.topicSet)
+	}
+	return matched &&
+		inBounds(int64(len(room.members)), int64(filter.users[0]), int64(filter.users[1])) &&
+		inBounds(int64(now.Sub(room.created)), int64(filter.created[0]), int64(filter.created[1])) &&
+		inBounds(int64(topicAge), int64(filter.topic[0]), int64(filter.topic[1]))
+}
+
+// Reply with 322 for every visible room, either of given names or of
+// all ones, satisfying ELIST conditions. Topics of rooms registered via
+// ChanServ are prefixed with "[registered]". Replies are streamed, so
+// LIST of many rooms does not overflow client's output queue.
+func SendList(client *Client, cols []string) {
+	var params []string
+	if len(cols) > 1 {
+		params = strings.Fields(cols[1])
+	}
+	rs, filter := ParseListFilter(params)
+	if len(rs) == 0 {
+		roomsM.RLock()
+		for r := range rooms {
+			rs = append(rs, r)
+		}
+		roomsM.RUnlock()
+	}
+	sort.Strings(rs)
+	now := time.Now()
+	prefix := ":" + *hostname + " "
+	var lines []string
+	for _, r := range rs {
+		roomsM.RLock()
+		if room, found := rooms[r]; found && !room.Hidden(client) && filter.Match(room, now) {
+			room.RLock()
+			topic := *room.topic
+			if room.founder != nil {
+				topic = strings.TrimSuffix("[registered] "+topic, " ")
+			}
+			lines = append(lines, prefix+joinParts(
+				"322",
+				*client.nickname,
+				*room.name,
+				fmt.Sprintf("%d", len(room.members)),
+				topic,
+			))
+			room.RUnlock()
+		}
+		roomsM.RUnlock()
+	}
+	lines = append(lines, prefix+joinParts("323", *client.nickname, "End of /LIST"))
+	if !client.Stream(lines) {
+		client.ReplyNicknamed("263", "LIST", "Server load is temporarily too heavy. Please wait a while and try again.")
+	}
+}
+
+func ClientNick(client *Client, cols []string) {
+	if len(cols) == 1 || len(cols[1]) < 1 {
+		client.ReplyParts("431", "No nickname given")
+		LogFailure(client, "nickname", "no nickname given")
+		return
+	}
+	nickname := cols[1]
+	// Compatibility with some clients prepending colons to nickname
+	nickname = strings.TrimPrefix(nickname, ":")
+	if Fold(nickname) == Fold(ChanServ) {
+		client.ReplyParts("433", "*", nickname, "Nickname is already in use")
+		LogFailure(client, "nickname", nickname, "is reserved")
+		return
+	}
+	if NicknameTaken(client, nickname) {
+		client.ReplyParts("433", "*", nickname, "Nickname is already in use")
+		LogFailure(client, "nickname", nickname, "is already in use")
+		return
+	}
+	clientsM.RLock()
+	_, rename := clients[client]
+	clientsM.RUnlock()
+	if !RENickname.MatchString(nickname) {
+		client.ReplyParts("432", "*", cols[1], "Erroneous nickname")
+		LogFailure(client, "nickname", cols[1], "is erroneous")
+		return
+	}
+	if client.registered && !client.NickChangeAllowed(time.Now()) {
+		client.ReplyNicknamed("438", nickname, "Nick change too fast. Please wait a while")
+		return
+	}
+	if rename {
+		// notify clients in all rooms the client has subscribed
+		message := ":" + client.String() + " NICK " + nickname
+		for c := range SharedClients(client) {
+			c.Msg(message)
+		}
+	}
+	client.SetNickname(nickname)
+	InvalidateNames(client)
+}
+
+// Is the nickname used by another connected client.
+func NicknameTaken(client *Client, nickname string) bool {
+	clientsM.RLock()
+	defer clientsM.RUnlock()
+	for c := range clients {
+		if c != client && c.Match(nickname) && c.Alive() {
+			return true
+		}
+	}
+	return false
+}
+
+// Gather all clients sharing at least one room with the given one,
+// including itself if it has joined any.
+func SharedClients(client *Client) map[*Client]struct{} {
+	cs := make(map[*Client]struct{})
+	roomsM.RLock()
+	for _, r := range rooms {
+		r.RLock()
+		if _, subscribed := r.members[client]; subscribed {
+			for c := range r.members {
+				cs[c] = struct{}{}
+			}
+		}
+		r.RUnlock()
+	}
+	roomsM.RUnlock()
+	return cs
+}
+
+// Change client's visible username and host. Clients sharing rooms
+// with it are told about that with CHGHOST if they have negotiated
+// chghost capability, or see it quitting and joining back otherwise.
+func ChangeHost(client *Client, username, host string) {
+	old := client.String()
+	client.SetHost(username, host)
+	chghost := ":" + old + " CHGHOST " + username + " " + host
+	if client.HasCap("chghost") {
+		client.Msg(chghost)
+	} else {
+		client.ReplyNicknamed("396", host, "is now your displayed host")
+	}
+	cs := SharedClients(client)
+	delete(cs, client)
+	for c := range cs {
+		if c.HasCap("chghost") {
+			c.Msg(chghost)
+			continue
+		}
+		c.Msg(":" + old + " QUIT :Changing host")
+		roomsM.RLock()
+		for _, r := range rooms {
+			r.RLock()
+			_, subscribed := r.members[client]
+			_, shared := r.members[c]
+			if subscribed && shared {
+				c.Msg(":" + client.String() + " JOIN " + *r.name)
+				if prefix := r.prefix(client); prefix != "" {
+					mode := map[string]string{"@": "+o", "+": "+v"}[prefix]
+					c.Msg(":" + *hostname + " MODE " + *r.name + " " + mode + " " + *client.nickname)
+				}
+			}
+			r.RUnlock()
+		}
+		roomsM.RUnlock()
+	}
+}
+
+// Unregistered client workflow processor. Unregistered client:
+// * is not PINGed, its PONGs are ignored and do not keep it alive
+// * only QUIT, NICK and USER commands are processed
+// * other commands are quietly ignored
+// When client finishes NICK/USER workflow, then MOTD and LUSERS are send to him.
+func ClientRegister(client *Client, cmd string, cols []string) {
+	switch cmd {
+	case "CAP":
+		HandlerCap(client, cols)
+	case "PASS":
+		if len(cols) == 1 || len(cols[1]) < 1 {
+			client.ReplyNotEnoughParameters("PASS")
+			return
 		}
 		password := strings.TrimPrefix(cols[1], ":")
 		client.password = &password
+	case "WEBIRC":
+		if len(cols) == 1 || len(strings.Fields(cols[1])) < 4 {
+			client.ReplyNotEnoughParameters("WEBIRC")
+			return
+		}
+		args := strings.Fields(cols[1])
+		if *webirc == "" || !CredentialsValid(*webirc, args[1], args[0]) {
+			client.ReplyNicknamed("464", "Password incorrect")
+			LogFailure(client, "webirc", "gateway", args[1], "is not trusted")
+			client.Close("464")
+			return
+		}
+		ip := net.ParseIP(args[3])
+		if ip == nil {
+			client.ReplyNicknamed("461", "WEBIRC", "Invalid IP address")
+			LogFailure(client, "webirc", "gateway", args[1], "sent invalid IP", args[3])
+			client.Close("461")
+			return
+		}
+		host := args[2]
+		if !REHost.MatchString(host) {
+			host = ip.String()
+			if strings.HasPrefix(host, ":") {
+				host = "0" + host
+			}
+		}
+		log.Println(client, "is", host, "behind WEBIRC gateway", args[1])
+		client.SetHost(client.Username(), host)
 	case "NICK":
 		ClientNick(client, cols)
 	case "USER":
@@ -251,10 +1210,11 @@ func ClientRegister(client *Client, cmd string, cols []string) {
 		realname := strings.TrimLeft(args[3], ":")
 		client.realname = &realname
 	}
-	if *client.nickname != "*" && *client.username != "" {
+	if *client.nickname != "*" && *client.username != "" && !client.capNegotiating {
 		if passwords != nil && *passwords != "" {
 			if client.password == nil {
 				client.ReplyParts("462", "You may not register")
+				LogFailure(client, "password", "not given")
 				client.Close("462")
 				return
 			}
@@ -267,23 +1227,59 @@ func ClientRegister(client *Client, cmd string, cols []string) {
 				if entry == "" {
 					continue
 				}
-				if lp := strings.Split(entry, ":"); lp[0] == *client.nickname && lp[1] != *client.password {
+				lp := strings.Split(entry, ":")
+				if Fold(lp[0]) != Fold(*client.nickname) {
+					continue
+				}
+				if lp[1] != *client.password {
 					client.ReplyParts("462", "You may not register")
+					LogFailure(client, "password", "incorrect")
 					client.Close("462")
 					return
 				}
+				account := lp[0]
+				client.account = &account
+			}
+		}
+		if ClonesExceeded(client) {
+			client.Notice("Too many clients from your address are already registered")
+			LogFailure(client, "clones", "too many registered clients from", client.Addr())
+			client.Close("too many clones")
+			return
+		}
+		client.SetRegistered()
+		if client.account != nil {
+			clientsM.Lock()
+			sessions, found := accounts[Fold(*client.account)]
+			if !found {
+				sessions = make(map[*Client]struct{})
+				accounts[Fold(*client.account)] = sessions
 			}
+			sessions[client] = struct{}{}
+			clientsM.Unlock()
 		}
-		client.registered = true
+		UpdatePeaks()
 		clients_irc_total.Inc()
-		clients_connected.Set(GetNumberOfRegisteredUsers(client))
-		client.ReplyNicknamed("001", "Hi, welcome to IRC")
-		client.ReplyNicknamed("002", "Your host is "+*hostname+", running goircd "+version)
-		client.ReplyNicknamed("003", "This server was created sometime")
-		client.ReplyNicknamed("004", *hostname+" goircd o o")
+		UpdateConnected(client)
+		// Burst goes in canonical order: welcome 001-004, ISUPPORT,
+		// LUSERS and MOTD, as clients expect ISUPPORT before the rest.
+		// All of it is sent from the Daemon, so nothing is interleaved
+		client.ReplyNicknamed("001", WelcomeText(client))
+		client.ReplyNicknamed("002", "Your host is "+*hostname+", running goircd "+version+" built with "+runtime.Version())
+		if buildDate == "" {
+			client.ReplyNicknamed("003", "This server was created sometime")
+		} else {
+			client.ReplyNicknamed("003", "This server was created "+buildDate)
+		}
+		client.ReplyNicknamed("004", *hostname+" goircd "+UserModes+" o")
+		SendISupport(client)
 		SendLusers(client)
 		SendMotd(client)
 		log.Println(client, "logged in")
+		if *autojoin != "" {
+			// The same as ordinary JOIN, so channel modes are respected
+			HandlerJoin(client, *autojoin)
+		}
 	}
 }
 
@@ -293,15 +1289,34 @@ func RoomRegister(name string) (*Room, chan ClientEvent) {
 	roomNew := NewRoom(name)
 	roomSink := make(chan ClientEvent)
 	roomsM.Lock()
-	rooms[strings.ToLower(name)] = roomNew
+	rooms[Fold(name)] = roomNew
 	roomSinks[roomNew] = roomSink
 	roomsM.Unlock()
-	go roomNew.Processor(roomSink)
 	roomsGroup.Add(1)
+	go roomNew.Processor(roomSink)
+	UpdatePeaks()
 	return roomNew, roomSink
 }
 
+// Can the client create new channels according to -chancreate policy.
+func CreationAllowed(client *Client) bool {
+	switch *chanCreate {
+	case "identified":
+		return client.account != nil || client.HasMode('o')
+	case "opers":
+		return client.HasMode('o')
+	}
+	return true
+}
+
 func HandlerJoin(client *Client, cmd string) {
+	JoinRooms(client, cmd, false)
+}
+
+// Join the client to comma-separated rooms with optional keys. Forced
+// join, made by operator's SAJOIN, bypasses keys, +r, bans and channel
+// creation restrictions.
+func JoinRooms(client *Client, cmd string, force bool) {
 	args := strings.Split(cmd, " ")
 	rs := strings.Split(args[0], ",")
 	var keys []string
@@ -328,27 +1343,57 @@ func HandlerJoin(client *Client, cmd string) {
 		for roomExisting, roomSink = range roomSinks {
 			if roomExisting.Match(room) {
 				roomsM.RUnlock()
+				if force {
+					roomSink <- ClientEvent{client, EventNew, ""}
+					goto Joined
+				}
 				if (*roomExisting.key != "") && (*roomExisting.key != key) {
 					goto Denied
 				}
+				if roomExisting.HasMode('r') && client.account == nil {
+					goto Unidentified
+				}
+				if roomExisting.Banned(client) {
+					goto Banned
+				}
 				roomSink <- ClientEvent{client, EventNew, ""}
 				goto Joined
 			}
 		}
 		roomsM.RUnlock()
+		if key != "" && !KeyValid(key) {
+			client.ReplyNicknamed("525", room, "Key is not well-formed")
+			continue
+		}
+		if !force && !CreationAllowed(client) {
+			client.ReplyNicknamed("520", room, "Cannot join channel - creating channels is restricted to "+*chanCreate)
+			continue
+		}
 		roomNew, roomSink = RoomRegister(room)
 		log.Println("Room", roomNew, "created")
+		roomNew.SetDefaultModes()
 		if key != "" {
 			roomNew.key = &key
+			roomNew.keyWho, roomNew.keySet = client.String(), time.Now()
+		}
+		if key != "" || *defChanModes != "" {
 			roomNew.StateSave()
 		}
 		roomSink <- ClientEvent{client, EventNew, ""}
 		continue
 	Denied:
 		client.ReplyNicknamed("475", room, "Cannot join channel (+k) - bad key")
+		continue
+	Unidentified:
+		client.ReplyNicknamed("477", room, "Cannot join channel (+r) - you need to be identified")
+		continue
+	Banned:
+		client.ReplyNicknamed("474", room, "Cannot join channel (+b)")
+		LogFailure(client, "banned", "can not join", room)
+		continue
 	Joined:
-		clients_irc_rooms_total.With(prometheus.Labels{"room":"all"}).Inc()
-		clients_irc_rooms_total.With(prometheus.Labels{"room":room}).Inc()
+		clients_irc_rooms_total.With(prometheus.Labels{"room": "all"}).Inc()
+		clients_irc_rooms_total.With(prometheus.Labels{"room": room}).Inc()
 	}
 }
 
@@ -362,7 +1407,6 @@ func Processor(events chan ClientEvent, finished chan struct{}) {
 		}
 	}()
 
-
 	for event := range events {
 		now = time.Now()
 		client := event.client
@@ -370,25 +1414,29 @@ func Processor(events chan ClientEvent, finished chan struct{}) {
 		case EventTick:
 			clientsM.RLock()
 			for c := range clients {
-				if c.recvTimestamp.Add(PingTimeout).Before(now) {
+				if c.LastRecv().Add(2 * c.class.pingFreq).Before(now) {
 					log.Println(c, "ping timeout")
 					c.Close("ping timeout")
 					continue
 				}
-				if c.sendTimestamp.Add(PingThreshold).Before(now) {
-					if c.registered {
-						c.Msg("PING :" + *hostname)
-						c.sendTimestamp = time.Now()
-					} else {
-						log.Println(c, "ping timeout")
-						c.Close("ping timeout")
+				if !c.registered {
+					// Unregistered clients are not PINGed: they just
+					// have to complete NICK/USER in time
+					if c.signon.Add(time.Duration(*regTimeout) * time.Second).Before(now) {
+						log.Println(c, "registration timeout")
+						c.Close("registration timeout")
 					}
+					continue
+				}
+				if c.sendTimestamp.Add(c.class.pingFreq).Before(now) {
+					c.Ping(now)
+					c.sendTimestamp = time.Now()
 				}
 			}
 			clientsM.RUnlock()
 			roomsM.Lock()
 			for rn, r := range rooms {
-				if *statedir == "" && len(r.members) == 0 {
+				if *statedir == "" && len(r.members) == 0 && r.founder == nil {
 					log.Println(rn, "emptied room")
 					delete(rooms, rn)
 					close(roomSinks[r])
@@ -405,234 +1453,783 @@ func Processor(events chan ClientEvent, finished chan struct{}) {
 			roomsGroup.Wait()
 			close(finished)
 			return
+		case EventStats:
+			DumpStats()
 		case EventNew:
+			client.signon = now
 			clientsM.Lock()
 			clients[client] = struct{}{}
 			clientsM.Unlock()
+			if ClassFull(client) {
+				client.Msg("ERROR :Too many connections from your address")
+				LogFailure(client, "clones", "too many connections in class", client.class.name)
+				client.Close("too many connections")
+				continue
+			}
+			SendBanner(client)
 		case EventDel:
 			clientsM.Lock()
 			delete(clients, client)
+			if client.account != nil {
+				delete(accounts[Fold(*client.account)], client)
+				if len(accounts[Fold(*client.account)]) == 0 {
+					delete(accounts, Fold(*client.account))
+				}
+			}
 			clientsM.Unlock()
+			if client.registered {
+				whowas = append(whowas, WhowasEntry{
+					*client.nickname,
+					client.Username(),
+					client.Host(),
+					*client.realname,
+					client.signon,
+				})
+				if len(whowas) > WhowasSize {
+					whowas = whowas[1:]
+				}
+			}
 			roomsM.RLock()
 			for _, roomSink := range roomSinks {
 				roomSink <- event
 			}
 			roomsM.RUnlock()
+		case EventDNSBL:
+			clientsM.RLock()
+			_, connected := clients[client]
+			clientsM.RUnlock()
+			if !connected {
+				continue
+			}
+			if *dnsblAction == "mark" {
+				log.Println(client, "is listed in", event.text)
+				SendServerNotice(fmt.Sprintf("Client %s is listed in %s", client, event.text), true)
+				continue
+			}
+			client.ReplyNicknamed("465", "You are banned from this server (listed in "+event.text+")")
+			LogFailure(client, "dnsbl", "listed in", event.text)
+			client.Close("dnsbl")
 		case EventMsg:
-			cols := strings.SplitN(event.text, " ", 2)
-			cmd := strings.ToUpper(cols[0])
+			tags, text := ParseTags(event.text)
+			msg := ParseMessage(text)
+			if msg.command == "" {
+				// Empty messages are silently ignored
+				atomic.AddInt32(&client.pending, -1)
+				continue
+			}
+			// Handlers get command and its parameters in canonical form
+			cmd := msg.command
+			cols := []string{cmd}
+			if len(msg.params) > 0 {
+				cols = append(cols, msg.Params())
+			}
 			if *verbose {
 				log.Println(client, "command", cmd)
 			}
-			if cmd == "QUIT" {
-				log.Println(client, "quit")
-				var quitMsg string
-				if len(cols) >= 2 {
-					quitMsg = strings.TrimPrefix(cols[1], ":")
-				} else {
-					quitMsg = *client.nickname
+			CountCommand(cmd)
+			label, labeled := tags["label"]
+			labeled = labeled && client.HasCap("labeled-response")
+			if labeled {
+				// earlier events still processed by rooms must not
+				// be taken as replies
+				SyncRooms()
+				client.StartLabeled(label)
+			}
+			if CommandDisabled(client, cmd) {
+				client.ReplyNicknamed("421", cmd, "Command is disabled")
+			} else {
+				ClientCommand(client, cmd, cols, ClientTags(tags), now)
+			}
+			if labeled {
+				// replies to commands handled by rooms must be
+				// collected too
+				SyncRooms()
+				client.FinishLabeled()
+			}
+			UpdateConnected(client)
+			atomic.AddInt32(&client.pending, -1)
+		}
+	}
+}
+
+// Wait until all rooms have processed events sent to them so far. Rooms
+// handle events one by one and ignore ticks.
+func SyncRooms() {
+	roomsM.RLock()
+	for _, sink := range roomSinks {
+		sink <- ClientEvent{eventType: EventTick}
+	}
+	roomsM.RUnlock()
+}
+
+// Handle a single command sent by the client. Its client-only tags are
+// relayed with messages.
+func ClientCommand(client *Client, cmd string, cols []string, tags string, now time.Time) {
+	if cmd == "QUIT" {
+		log.Println(client, "quit")
+		var quitMsg string
+		if len(cols) >= 2 {
+			quitMsg = strings.TrimPrefix(cols[1], ":")
+		} else {
+			quitMsg = *client.nickname
+		}
+		client.Close(quitMsg)
+		return
+	}
+	if !client.registered {
+		ClientRegister(client, cmd, cols)
+		return
+	}
+	if client != nil && cmd != "PONG" {
+		// PONG keeps the client alive only if it answers PING
+		client.Touch(now)
+	}
+	cmd, cols = ExpandAlias(cmd, cols)
+	switch cmd {
+	case "ACCESS":
+		if len(cols) == 1 || len(cols[1]) < 1 {
+			client.ReplyNotEnoughParameters("ACCESS")
+			return
+		}
+		cols = strings.SplitN(cols[1], " ", 2)
+		roomsM.RLock()
+		r, found := GetRoom(cols[0])
+		if !found {
+			client.ReplyNoChannel(cols[0])
+			roomsM.RUnlock()
+			return
+		}
+		var request string
+		if len(cols) > 1 {
+			request = cols[1]
+		}
+		roomSinks[r] <- ClientEvent{client, EventAccess, request}
+		roomsM.RUnlock()
+	case "CAP":
+		HandlerCap(client, cols)
+	case "AWAY":
+		if len(cols) == 1 || strings.TrimPrefix(cols[1], ":") == "" {
+			client.away = nil
+			client.ReplyNicknamed("305", "You are no longer marked as being away")
+			SendAwayMessages(client)
+			return
+		}
+		msg := Truncate(strings.TrimPrefix(cols[1], ":"), AwayLen)
+		client.away = &msg
+		client.ReplyNicknamed("306", "You have been marked as being away")
+	case "JOIN":
+		if len(cols) == 1 || len(cols[1]) < 1 {
+			client.ReplyNotEnoughParameters("JOIN")
+			return
+		}
+		HandlerJoin(client, cols[1])
+	case "NICK":
+		ClientNick(client, cols)
+	case "PASS", "USER", "WEBIRC":
+		client.ReplyNicknamed("462", "You may not reregister")
+	case "LIST":
+		SendList(client, cols)
+	case "LUSERS":
+		SendLusers(client)
+	case "LINKS":
+		mask := "*"
+		if len(cols) > 1 && len(strings.Fields(cols[1])) > 0 {
+			fields := strings.Fields(cols[1])
+			mask = fields[len(fields)-1]
+		}
+		SendLinks(client, mask)
+	case "INFO":
+		SendInfo(client)
+	case "TRACE":
+		target := ""
+		if len(cols) > 1 && len(strings.Fields(cols[1])) > 0 {
+			target = strings.Fields(cols[1])[0]
+		}
+		SendTrace(client, target)
+	case "STATS":
+		if len(cols) == 1 || len(strings.Fields(cols[1])) == 0 {
+			client.ReplyNotEnoughParameters("STATS")
+			return
+		}
+		SendStats(client, strings.Fields(cols[1])[0])
+	case "MODE":
+		if len(cols) == 1 || len(cols[1]) < 1 {
+			client.ReplyNotEnoughParameters("MODE")
+			return
+		}
+		cols = strings.SplitN(cols[1], " ", 2)
+		if client.Match(cols[0]) {
+			if len(cols) == 1 || len(strings.Fields(cols[1])) == 0 {
+				client.Msg("221 " + *client.nickname + " " + client.ModeString())
+			} else {
+				applied, unknown := client.ChangeModes(strings.Fields(cols[1])[0])
+				if unknown {
+					client.ReplyNicknamed("501", "Unknown MODE flag")
+				}
+				if applied != "" {
+					client.Msg(fmt.Sprintf(":%s MODE %s :%s", *client.nickname, *client.nickname, applied))
 				}
-				client.Close(quitMsg)
+			}
+			return
+		}
+		room := cols[0]
+		roomsM.RLock()
+		r, found := GetRoom(room)
+		if !found {
+			client.ReplyNoChannel(room)
+			roomsM.RUnlock()
+			return
+		}
+		if len(cols) == 1 {
+			roomSinks[r] <- ClientEvent{client, EventMode, ""}
+		} else {
+			roomSinks[r] <- ClientEvent{client, EventMode, cols[1]}
+		}
+		roomsM.RUnlock()
+	case "MOTD":
+		SendMotd(client)
+	case "CHARSET":
+		if len(cols) == 1 || len(strings.Fields(cols[1])) == 0 {
+			name := "UTF-8"
+			if cs := client.Charset(); cs != nil {
+				name = cs.name
+			}
+			client.Notice("Your charset is " + name)
+			return
+		}
+		name := strings.Fields(cols[1])[0]
+		var cs *Charset
+		if strings.ToUpper(name) != "UTF-8" {
+			if cs = LookupCharset(name); cs == nil {
+				client.ReplyFail("CHARSET", "UNKNOWN_CHARSET", name, "Unknown charset")
+				return
+			}
+			name = cs.name
+		}
+		client.SetCharset(cs)
+		client.Notice("Your charset is " + strings.ToUpper(name))
+	case "REHASH":
+		if !client.HasMode('o') {
+			client.ReplyNicknamed("481", "Permission Denied- You're not an IRC operator")
+			return
+		}
+		client.ReplyNicknamed("382", *motd, "Rehashing")
+		log.Println(client, "rehashing")
+		if err := LoadMotd(); err != nil {
+			log.Printf("Can not read motd file %s: %v", *motd, err)
+			client.Reply(fmt.Sprintf("NOTICE %s :REHASH: Can not read MOTD file", *client.nickname))
+		}
+		if *aliasesFile != "" {
+			if err := LoadAliases(*aliasesFile); err != nil {
+				log.Printf("Can not load aliases file %s: %v", *aliasesFile, err)
+				client.Reply(fmt.Sprintf("NOTICE %s :REHASH: Can not load aliases file", *client.nickname))
+			}
+		}
+	case "OPER":
+		if len(cols) == 1 || len(strings.Fields(cols[1])) < 2 {
+			client.ReplyNotEnoughParameters("OPER")
+			return
+		}
+		args := strings.Fields(cols[1])
+		if *opers == "" {
+			client.ReplyNicknamed("491", "No O-lines for your host")
+			return
+		}
+		if !OperValid(args[0], args[1]) {
+			client.ReplyNicknamed("464", "Password incorrect")
+			LogFailure(client, "password", "incorrect for operator", args[0])
+			return
+		}
+		client.SetMode('o', true)
+		client.ReplyNicknamed("381", "You are now an IRC operator")
+		client.Msg(fmt.Sprintf(":%s MODE %s :+o", *client.nickname, *client.nickname))
+		log.Println(client, "became an operator as", args[0])
+	case "CHGHOST", "SETHOST":
+		// SETHOST nick host keeps the username
+		need := 3
+		if cmd == "SETHOST" {
+			need = 2
+		}
+		if len(cols) == 1 || len(strings.Fields(cols[1])) < need {
+			client.ReplyNotEnoughParameters(cmd)
+			return
+		}
+		args := strings.Fields(cols[1])
+		if !client.HasMode('o') {
+			client.ReplyNicknamed("481", "Permission Denied- You're not an IRC operator")
+			return
+		}
+		var target *Client
+		clientsM.RLock()
+		for c := range clients {
+			if c.registered && c.Match(args[0]) {
+				target = c
+				break
+			}
+		}
+		clientsM.RUnlock()
+		if target == nil {
+			client.ReplyNoNickChan(args[0])
+			return
+		}
+		if cmd == "SETHOST" {
+			args = []string{args[0], target.Username(), args[1]}
+		}
+		if !REUsername.MatchString(args[1]) {
+			client.ReplyFail(cmd, "INVALID_USERNAME", args[1], "Invalid username")
+			return
+		}
+		if !REHost.MatchString(args[2]) {
+			client.ReplyFail(cmd, "INVALID_HOSTNAME", args[2], "Invalid hostname")
+			return
+		}
+		ChangeHost(target, args[1], args[2])
+		client.Notice("Changed host of " + *target.nickname + " to " + args[1] + "@" + args[2])
+		log.Println(client, "changed host of", *target.nickname, "to", args[1]+"@"+args[2])
+	case "KILL":
+		if len(cols) == 1 || len(strings.Fields(cols[1])) == 0 {
+			client.ReplyNotEnoughParameters("KILL")
+			return
+		}
+		args := strings.SplitN(cols[1], " ", 2)
+		if !client.HasMode('o') {
+			client.ReplyNicknamed("481", "Permission Denied- You're not an IRC operator")
+			return
+		}
+		target := FindClient(args[0])
+		if target == nil {
+			client.ReplyNoNickChan(args[0])
+			return
+		}
+		reason := ""
+		if len(args) > 1 {
+			reason = strings.TrimPrefix(args[1], ":")
+		}
+		Kill(client, target, reason)
+	case "RESTART":
+		if !client.HasMode('o') {
+			client.ReplyNicknamed("481", "Permission Denied- You're not an IRC operator")
+			return
+		}
+		log.Println(client, "requested restart")
+		SendServerNotice("*** Restart requested by "+*client.nickname, true)
+		select {
+		case restartSink <- struct{}{}:
+		default:
+		}
+	case "SAMODE":
+		// SAMODE #chan modes
+		if len(cols) == 1 || len(strings.Fields(cols[1])) < 2 {
+			client.ReplyNotEnoughParameters("SAMODE")
+			return
+		}
+		args := strings.SplitN(cols[1], " ", 2)
+		if !client.HasMode('o') {
+			client.ReplyNicknamed("481", "Permission Denied- You're not an IRC operator")
+			return
+		}
+		roomsM.RLock()
+		r, found := GetRoom(args[0])
+		if !found {
+			roomsM.RUnlock()
+			client.ReplyNoChannel(args[0])
+			return
+		}
+		log.Println(client, "used SAMODE on", r, args[1])
+		SendServerNotice(fmt.Sprintf("%s used SAMODE on %s %s", *client.nickname, r, args[1]), true)
+		roomSinks[r] <- ClientEvent{client, EventSamode, args[1]}
+		roomsM.RUnlock()
+	case "SANICK":
+		// SANICK nick newnick
+		if len(cols) == 1 || len(strings.Fields(cols[1])) < 2 {
+			client.ReplyNotEnoughParameters("SANICK")
+			return
+		}
+		args := strings.Fields(cols[1])
+		if !client.HasMode('o') {
+			client.ReplyNicknamed("481", "Permission Denied- You're not an IRC operator")
+			return
+		}
+		target := FindClient(args[0])
+		if target == nil {
+			client.ReplyNoNickChan(args[0])
+			return
+		}
+		nickname := strings.TrimPrefix(args[1], ":")
+		if !RENickname.MatchString(nickname) {
+			client.ReplyNicknamed("432", nickname, "Erroneous nickname")
+			return
+		}
+		if Fold(nickname) == Fold(ChanServ) || NicknameTaken(target, nickname) {
+			client.ReplyNicknamed("433", nickname, "Nickname is already in use")
+			return
+		}
+		log.Println(client, "used SANICK on", target, "for", nickname)
+		SendServerNotice(fmt.Sprintf("%s used SANICK on %s for %s", *client.nickname, *target.nickname, nickname), true)
+		// The target is told even if it has joined no rooms
+		message := ":" + target.String() + " NICK " + nickname
+		shared := SharedClients(target)
+		shared[target] = struct{}{}
+		for c := range shared {
+			c.Msg(message)
+		}
+		target.SetNickname(nickname)
+		InvalidateNames(target)
+	case "SAJOIN", "SAPART":
+		// SAJOIN nick #chan[,#chan...], SAPART nick #chan[,#chan...] [:reason]
+		if len(cols) == 1 || len(strings.Fields(cols[1])) < 2 {
+			client.ReplyNotEnoughParameters(cmd)
+			return
+		}
+		args := strings.SplitN(cols[1], " ", 3)
+		if !client.HasMode('o') {
+			client.ReplyNicknamed("481", "Permission Denied- You're not an IRC operator")
+			return
+		}
+		target := FindClient(args[0])
+		if target == nil {
+			client.ReplyNoNickChan(args[0])
+			return
+		}
+		log.Println(client, "used", cmd, "on", target, "for", args[1])
+		SendServerNotice(fmt.Sprintf("%s used %s on %s for %s", *client.nickname, cmd, *target.nickname, args[1]), true)
+		if cmd == "SAJOIN" {
+			JoinRooms(target, args[1], true)
+			return
+		}
+		partMsg := *target.nickname
+		if len(args) > 2 {
+			partMsg = strings.TrimPrefix(args[2], ":")
+		}
+		roomsM.RLock()
+		for _, room := range strings.Split(args[1], ",") {
+			r, found := GetRoom(room)
+			if !found {
+				client.ReplyNoChannel(room)
 				continue
 			}
-			if !client.registered {
-				ClientRegister(client, cmd, cols)
+			if r.member(*target.nickname) != target {
+				client.ReplyNicknamed("441", *target.nickname, room, "They aren't on that channel")
 				continue
 			}
-			if client != nil {
-				client.recvTimestamp = now
+			roomSinks[r] <- ClientEvent{target, EventDel, partMsg}
+		}
+		roomsM.RUnlock()
+	case "CLIENTS":
+		// CLIENTS mask [KILL [:reason]] lists or kills matching clients
+		if len(cols) == 1 || len(strings.Fields(cols[1])) == 0 {
+			client.ReplyNotEnoughParameters("CLIENTS")
+			return
+		}
+		args := strings.SplitN(cols[1], " ", 3)
+		if !client.HasMode('o') {
+			client.ReplyNicknamed("481", "Permission Denied- You're not an IRC operator")
+			return
+		}
+		kill := len(args) > 1 && strings.ToUpper(args[1]) == "KILL"
+		reason := ""
+		if len(args) > 2 {
+			reason = strings.TrimPrefix(args[2], ":")
+		}
+		mask, valid := BanMask(args[0])
+		if !valid {
+			client.Notice("Invalid mask " + args[0])
+			return
+		}
+		matched := make([]*Client, 0)
+		clientsM.RLock()
+		for c := range clients {
+			if c != client && c.MatchBan(mask) {
+				matched = append(matched, c)
 			}
-			switch cmd {
-			case "AWAY":
-				if len(cols) == 1 {
-					client.away = nil
-					client.ReplyNicknamed("305", "You are no longer marked as being away")
-					continue
-				}
-				msg := cols[1]
-				client.away = &msg
-				client.ReplyNicknamed("306", "You have been marked as being away")
-			case "JOIN":
-				if len(cols) == 1 || len(cols[1]) < 1 {
-					client.ReplyNotEnoughParameters("JOIN")
-					continue
-				}
-				HandlerJoin(client, cols[1])
-			case "NICK":
-				ClientNick(client, cols)
-			case "LIST":
-				SendList(client, cols)
-			case "LUSERS":
-				SendLusers(client)
-			case "MODE":
-				if len(cols) == 1 || len(cols[1]) < 1 {
-					client.ReplyNotEnoughParameters("MODE")
-					continue
-				}
-				cols = strings.SplitN(cols[1], " ", 2)
-				if strings.ToLower(cols[0]) == strings.ToLower(*client.username) {
-					if len(cols) == 1 {
-						client.Msg("221 " + *client.nickname + " +")
-					} else {
-						client.ReplyNicknamed("501", "Unknown MODE flag")
-					}
-					continue
-				}
-				room := cols[0]
-				roomsM.RLock()
-				r, found := GetRoom(room)
-				if !found {
-					client.ReplyNoChannel(room)
-					roomsM.RUnlock()
-					continue
-				}
-				if len(cols) == 1 {
-					roomSinks[r] <- ClientEvent{client, EventMode, ""}
+		}
+		clientsM.RUnlock()
+		sort.Slice(matched, func(i, j int) bool {
+			return *matched[i].nickname < *matched[j].nickname
+		})
+		for _, c := range matched {
+			if kill {
+				Kill(client, c, reason)
+			} else {
+				client.Notice(c.String())
+			}
+		}
+		if kill {
+			client.Notice(fmt.Sprintf("%d clients matching %s killed", len(matched), mask))
+		} else {
+			client.Notice(fmt.Sprintf("%d clients match %s", len(matched), mask))
+		}
+	case "MARKREAD":
+		HandlerMarkRead(client, cols)
+	case "METADATA":
+		HandlerMetadata(client, cols)
+	case "GHOST":
+		if len(cols) == 1 || len(strings.Fields(cols[1])) < 1 {
+			client.ReplyNotEnoughParameters("GHOST")
+			return
+		}
+		args := strings.Fields(cols[1])
+		var ghost *Client
+		clientsM.RLock()
+		for c := range clients {
+			if c != client && c.registered && c.Match(args[0]) {
+				ghost = c
+				break
+			}
+		}
+		clientsM.RUnlock()
+		if ghost == nil {
+			client.ReplyNoNickChan(args[0])
+			return
+		}
+		// Either already identified to the account named after the
+		// nickname, or knowing its password
+		owner := client.account != nil && Fold(*client.account) == Fold(*ghost.nickname)
+		if !owner && len(args) > 1 && *passwords != "" {
+			owner = CredentialsValid(*passwords, *ghost.nickname, args[1])
+		}
+		if !owner {
+			client.ReplyNicknamed("464", "Password incorrect")
+			LogFailure(client, "password", "incorrect for ghost", *ghost.nickname)
+			return
+		}
+		ghost.Close("Ghost killed by " + *client.nickname)
+		client.Notice("Ghost with nickname " + *ghost.nickname + " has been killed")
+		log.Println(client, "killed ghost", ghost)
+	case "GLOBOPS", "BROADCAST":
+		if len(cols) == 1 || len(cols[1]) < 1 {
+			client.ReplyNotEnoughParameters(cmd)
+			return
+		}
+		if !client.HasMode('o') {
+			client.ReplyNicknamed("481", "Permission Denied- You're not an IRC operator")
+			return
+		}
+		text := strings.TrimPrefix(cols[1], ":")
+		if cmd == "GLOBOPS" {
+			SendServerNotice("*** Global -- from "+*client.nickname+": "+text, true)
+		} else {
+			SendServerNotice("*** Announcement from "+*client.nickname+": "+text, false)
+		}
+	case "PART":
+		if len(cols) == 1 || len(cols[1]) < 1 {
+			client.ReplyNotEnoughParameters("PART")
+			return
+		}
+		rs := strings.SplitN(cols[1], " ", 2)
+		roomsM.RLock()
+		for _, room := range strings.Split(rs[0], ",") {
+			if r, found := GetRoom(room); found {
+				var partMsg string
+				if len(rs) >= 2 {
+					partMsg = strings.TrimPrefix(rs[1], ":")
 				} else {
-					roomSinks[r] <- ClientEvent{client, EventMode, cols[1]}
-				}
-				roomsM.RUnlock()
-			case "MOTD":
-				SendMotd(client)
-			case "PART":
-				if len(cols) == 1 || len(cols[1]) < 1 {
-					client.ReplyNotEnoughParameters("PART")
-					continue
-				}
-				rs := strings.SplitN(cols[1], " ", 2)
-				roomsM.RLock()
-				for _, room := range strings.Split(rs[0], ",") {
-					if r, found := GetRoom(room); found {
-						var partMsg string
-						if len(rs) >= 2 {
-							partMsg = strings.TrimPrefix(rs[1], ":")
-						} else {
-							partMsg = *client.nickname
-						}
-						roomSinks[r] <- ClientEvent{client, EventDel, partMsg}
-					} else {
-						client.ReplyNoChannel(room)
-						continue
-					}
-				}
-				roomsM.RUnlock()
-			case "PING":
-				if len(cols) == 1 {
-					client.ReplyNicknamed("409", "No origin specified")
-					continue
+					partMsg = *client.nickname
 				}
-				client.Reply(fmt.Sprintf("PONG %s :%s", *hostname, cols[1]))
-			case "PONG":
+				roomSinks[r] <- ClientEvent{client, EventDel, partMsg}
+			} else {
+				client.ReplyNoChannel(room)
 				continue
-			case "NOTICE", "PRIVMSG":
-				if len(cols) == 1 {
-					client.ReplyNicknamed("411", "No recipient given ("+cmd+")")
-					continue
-				}
-				cols = strings.SplitN(cols[1], " ", 2)
-				if len(cols) == 1 {
-					client.ReplyNicknamed("412", "No text to send")
-					continue
-				}
-				msg := ""
-				target := cols[0]
-				clientsM.RLock()
-				for c := range clients {
-					if c.Match(target) {
-						msg = fmt.Sprintf(":%s %s %s %s", client, cmd, *c.nickname, cols[1])
-						c.Msg(msg)
-						if c.away != nil {
-							client.ReplyNicknamed("301", *c.nickname, *c.away)
-						}
-						break
-					}
-				}
-				clientsM.RUnlock()
-				if msg != "" {
-					continue
-				}
-				roomsM.RLock()
-				if r, found := rooms[strings.ToLower(target)]; found {
-					roomSinks[r] <- ClientEvent{
-						client,
-						EventMsg,
-						cmd + " " + strings.TrimLeft(cols[1], ":"),
-					}
-				} else {
-					client.ReplyNoNickChan(target)
-				}
-				roomsM.RUnlock()
-			case "TOPIC":
-				if len(cols) == 1 {
-					client.ReplyNotEnoughParameters("TOPIC")
-					continue
-				}
-				cols = strings.SplitN(cols[1], " ", 2)
-				roomsM.RLock()
-				r, found := GetRoom(cols[0])
-				roomsM.RUnlock()
-				if !found {
-					client.ReplyNoChannel(cols[0])
-					continue
-				}
-				var change string
-				if len(cols) > 1 {
-					change = cols[1]
-				} else {
-					change = ""
-				}
-				roomsM.RLock()
-				roomSinks[r] <- ClientEvent{client, EventTopic, change}
-				roomsM.RUnlock()
-			case "WHO":
-				if len(cols) == 1 || len(cols[1]) < 1 {
-					client.ReplyNotEnoughParameters("WHO")
-					continue
-				}
-				room := strings.Split(cols[1], " ")[0]
- 				roomsM.RLock()
-				if r, found := GetRoom(room); found {
-					roomSinks[r] <- ClientEvent{client, EventWho, ""}
-				} else {
-					client.ReplyNoChannel(room)
-				}
-				roomsM.RUnlock()
-			case "WHOIS":
-				if len(cols) == 1 || len(cols[1]) < 1 {
-					client.ReplyNotEnoughParameters("WHOIS")
-					continue
-				}
-				cols := strings.Split(cols[1], " ")
-				nicknames := strings.Split(cols[len(cols)-1], ",")
-				SendWhois(client, nicknames)
-			case "ISON":
-				if len(cols) == 1 || len(cols[1]) < 1 {
-					client.ReplyNotEnoughParameters("ISON")
-					continue
-				}
-				clientsM.RLock()
-				var nicksExists []string
-				for _, nickname := range strings.Split(cols[1], " ") {
-					for c := range clients {
-						if c.Match(nickname) {
-							nicksExists = append(nicksExists, nickname)
-						}
-					}
-				}
-				clientsM.RUnlock()
-				client.ReplyNicknamed("303", strings.Join(nicksExists, " "))
-			case "VERSION":
-				var debug string
-				if *verbose {
-					debug = "debug"
-				} else {
-					debug = ""
+			}
+		}
+		roomsM.RUnlock()
+	case "PING":
+		if len(cols) == 1 {
+			client.ReplyNicknamed("409", "No origin specified")
+			return
+		}
+		client.Reply(fmt.Sprintf("PONG %s :%s", *hostname, strings.TrimPrefix(cols[1], ":")))
+	case "PONG":
+		var params []string
+		if len(cols) > 1 {
+			params = ParseMessage("PONG " + cols[1]).params
+		}
+		client.Pong(now, params)
+	case "NOTICE", "PRIVMSG":
+		if len(cols) == 1 {
+			client.ReplyNicknamed("411", "No recipient given ("+cmd+")")
+			return
+		}
+		cols = strings.SplitN(cols[1], " ", 2)
+		if len(cols) == 1 {
+			client.ReplyNicknamed("412", "No text to send")
+			return
+		}
+		targets := strings.Split(cols[0], ",")
+		if len(targets) > MaxTargets {
+			client.ReplyNicknamed("407", cols[0], "Too many recipients")
+			return
+		}
+		for _, target := range targets {
+			SendMessage(client, cmd, target, cols[1], tags)
+		}
+	case "WALLCHOPS":
+		// WALLCHOPS #room text is NOTICE to @#room
+		if len(cols) == 1 || len(strings.Fields(cols[1])) < 2 {
+			client.ReplyNotEnoughParameters("WALLCHOPS")
+			return
+		}
+		cols = strings.SplitN(cols[1], " ", 2)
+		SendMessage(client, "NOTICE", "@"+cols[0], cols[1], tags)
+	case "TAGMSG":
+		if len(cols) == 1 || len(cols[1]) < 1 {
+			client.ReplyNicknamed("411", "No recipient given (TAGMSG)")
+			return
+		}
+		target := strings.Fields(cols[1])[0]
+		targets := strings.Split(target, ",")
+		if len(targets) > MaxTargets {
+			client.ReplyNicknamed("407", target, "Too many recipients")
+			return
+		}
+		for _, target := range targets {
+			SendMessage(client, cmd, target, "", tags)
+		}
+	case "RENAME":
+		if len(cols) == 1 {
+			client.ReplyNotEnoughParameters("RENAME")
+			return
+		}
+		args := strings.SplitN(cols[1], " ", 3)
+		if len(args) < 2 {
+			client.ReplyNotEnoughParameters("RENAME")
+			return
+		}
+		reason := ""
+		if len(args) == 3 {
+			reason = strings.TrimPrefix(args[2], ":")
+		}
+		roomsM.RLock()
+		r, found := GetRoom(args[0])
+		_, exists := rooms[Fold(args[1])]
+		roomsM.RUnlock()
+		if !found {
+			client.ReplyNoChannel(args[0])
+			return
+		}
+		if !r.IsOp(client) {
+			client.ReplyNicknamed("482", r.String(), "You're not channel operator")
+			return
+		}
+		if !RoomNameValid(args[1]) {
+			client.ReplyFail("RENAME", "CANNOT_RENAME", r.String(), args[1], "Invalid channel name")
+			return
+		}
+		if exists && Fold(args[1]) != Fold(r.String()) {
+			client.ReplyFail("RENAME", "CHANNEL_NAME_IN_USE", r.String(), args[1], "Channel already exists")
+			return
+		}
+		// Name is changed together with the rooms key, so JOIN to the new
+		// name finds this room even before it handles the event
+		old := r.String()
+		name := args[1]
+		roomsM.Lock()
+		delete(rooms, Fold(old))
+		rooms[Fold(name)] = r
+		r.Lock()
+		r.name = &name
+		r.Unlock()
+		roomsM.Unlock()
+		roomsM.RLock()
+		roomSinks[r] <- ClientEvent{client, EventRename, old + " " + name + " " + reason}
+		roomsM.RUnlock()
+	case "SETNAME":
+		if len(cols) == 1 || len(strings.TrimPrefix(cols[1], ":")) < 1 {
+			client.ReplyFail("SETNAME", "INVALID_REALNAME", "Realname is not valid")
+			return
+		}
+		realname := strings.TrimPrefix(cols[1], ":")
+		client.realname = &realname
+		message := ":" + client.String() + " SETNAME :" + realname
+		cs := SharedClients(client)
+		cs[client] = struct{}{}
+		for c := range cs {
+			if c.HasCap("setname") {
+				c.Msg(message)
+			}
+		}
+	case "TOPIC":
+		if len(cols) == 1 {
+			client.ReplyNotEnoughParameters("TOPIC")
+			return
+		}
+		cols = strings.SplitN(cols[1], " ", 2)
+		roomsM.RLock()
+		r, found := GetRoom(cols[0])
+		roomsM.RUnlock()
+		if !found {
+			client.ReplyNoChannel(cols[0])
+			return
+		}
+		var change string
+		if len(cols) > 1 {
+			change = cols[1]
+		} else {
+			change = ""
+		}
+		roomsM.RLock()
+		roomSinks[r] <- ClientEvent{client, EventTopic, change}
+		roomsM.RUnlock()
+	case "WHO":
+		if len(cols) == 1 || len(cols[1]) < 1 {
+			client.ReplyNotEnoughParameters("WHO")
+			return
+		}
+		room := strings.Split(cols[1], " ")[0]
+		roomsM.RLock()
+		if r, found := GetRoom(room); found {
+			roomSinks[r] <- ClientEvent{client, EventWho, ""}
+		} else {
+			client.ReplyNoChannel(room)
+		}
+		roomsM.RUnlock()
+	case "WHOIS":
+		if len(cols) == 1 || len(cols[1]) < 1 {
+			client.ReplyNotEnoughParameters("WHOIS")
+			return
+		}
+		cols := strings.Split(cols[1], " ")
+		nicknames := strings.Split(cols[len(cols)-1], ",")
+		SendWhois(client, nicknames)
+	case "WHOWAS":
+		if len(cols) == 1 || len(cols[1]) < 1 {
+			client.ReplyNicknamed("431", "No nickname given")
+			return
+		}
+		SendWhowas(client, strings.Split(cols[1], " ")[0])
+	case "ISON":
+		if len(cols) == 1 || len(cols[1]) < 1 {
+			client.ReplyNotEnoughParameters("ISON")
+			return
+		}
+		clientsM.RLock()
+		var nicksExists []string
+		for _, nickname := range strings.Split(cols[1], " ") {
+			for c := range clients {
+				if c.registered && c.Match(nickname) {
+					nicksExists = append(nicksExists, *c.nickname)
 				}
-				client.ReplyNicknamed("351", fmt.Sprintf("%s.%s %s :", version, debug, *hostname))
-			default:
-				client.ReplyNicknamed("421", cmd, "Unknown command")
 			}
-			clients_connected.Set(GetNumberOfRegisteredUsers(client))
+		}
+		clientsM.RUnlock()
+		client.ReplyNicknamed("303", strings.Join(nicksExists, " "))
+	case "VERSION":
+		var debug string
+		if *verbose {
+			debug = "debug"
+		} else {
+			debug = ""
+		}
+		client.ReplyNicknamed("351", fmt.Sprintf("%s.%s %s :", version, debug, *hostname))
+	default:
+		client.ReplyNicknamed("421", cmd, "Unknown command")
+		// Misbehaving client may send lots of them
+		if now.Sub(client.unknownLogged) >= UnknownLogPeriod {
+			client.unknownLogged = now
+			LogFailure(client, "unknown", "command", cmd)
+		} else {
+			clients_failures_total.With(prometheus.Labels{"reason": "unknown"}).Inc()
 		}
 	}
+	UpdateConnected(client)
 }
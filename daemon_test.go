@@ -19,16 +19,35 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"log"
+	"net"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestRegistrationWorkflow(t *testing.T) {
 	host := "foohost"
 	hostname = &host
 	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	maxUsers, maxChannels = 0, 0
 	defer func() {
 		events <- ClientEvent{eventType: EventTerm}
 	}()
@@ -44,7 +63,7 @@ func TestRegistrationWorkflow(t *testing.T) {
 		t.Fatal("431 for NICK", r)
 	}
 
-	for _, n := range []string{"привет", " foo", "#foo", "mein nick", "foo_bar"} {
+	for _, n := range []string{"mein nick", "foo:bar", strings.Repeat("x", 65)} {
 		conn.inbound <- "NICK " + n
 		if r := <-conn.outbound; r != ":foohost 432 * "+n+" :Erroneous nickname\r\n" {
 			t.Fatal("nickname validation", r)
@@ -68,23 +87,40 @@ func TestRegistrationWorkflow(t *testing.T) {
 	if r := <-conn.outbound; !strings.Contains(r, "There are 0 users") {
 		t.Fatal("LUSERS", r)
 	}
+	if r := <-conn.outbound; r != ":foohost 252 meinick 0 :operator(s) online\r\n" {
+		t.Fatal("LUSERS 252", r)
+	}
+	if r := <-conn.outbound; r != ":foohost 253 meinick 1 :unknown connection(s)\r\n" {
+		t.Fatal("LUSERS 253", r)
+	}
+	for i := 0; i < 4; i++ {
+		<-conn.outbound
+	}
 
 	conn.inbound <- "USER 1 2 3 :4 5"
 	if r := <-conn.outbound; !strings.Contains(r, ":foohost 001") {
 		t.Fatal("001 after registration", r)
 	}
-	if r := <-conn.outbound; !strings.Contains(r, ":foohost 002") {
+	if r := <-conn.outbound; !strings.Contains(r, ":foohost 002") || !strings.HasSuffix(r, " built with "+runtime.Version()+"\r\n") {
 		t.Fatal("002 after registration", r)
 	}
-	if r := <-conn.outbound; !strings.Contains(r, ":foohost 003") {
+	if r := <-conn.outbound; r != ":foohost 003 meinick :This server was created sometime\r\n" {
 		t.Fatal("003 after registration", r)
 	}
 	if r := <-conn.outbound; !strings.Contains(r, ":foohost 004") {
 		t.Fatal("004 after registration", r)
 	}
+	if r := <-conn.outbound; !strings.Contains(r, ":foohost 005 meinick CHANTYPES=# ") || !strings.Contains(r, " EXTBAN=$,ar ") || !strings.Contains(r, " TARGMAX=PRIVMSG:4,NOTICE:4 ") || !strings.Contains(r, " CHANNELLEN=50 ") || !strings.Contains(r, " AWAYLEN=200 TOPICLEN=300 BOT=B ") || !strings.Contains(r, " CASEMAPPING=ascii ") {
+		t.Fatal("005 after registration", r)
+	}
 	if r := <-conn.outbound; !strings.Contains(r, ":foohost 251") {
 		t.Fatal("251 after registration", r)
 	}
+	for _, numeric := range []string{"252", "253", "254", "255", "265", "266"} {
+		if r := <-conn.outbound; !strings.Contains(r, ":foohost "+numeric) {
+			t.Fatal(numeric+" after registration", r)
+		}
+	}
 	if r := <-conn.outbound; !strings.Contains(r, ":foohost 422") {
 		t.Fatal("422 after registration", r)
 	}
@@ -103,11 +139,33 @@ func TestRegistrationWorkflow(t *testing.T) {
 	if r := <-conn.outbound; !strings.Contains(r, "There are 1 users") {
 		t.Fatal("1 users logged in", r)
 	}
+	for i := 0; i < 4; i++ {
+		<-conn.outbound
+	}
+	if r := <-conn.outbound; r != ":foohost 265 meinick 1 1 :Current local users 1, max 1\r\n" {
+		t.Fatal("LUSERS 265", r)
+	}
+	if r := <-conn.outbound; r != ":foohost 266 meinick 1 1 :Current global users 1, max 1\r\n" {
+		t.Fatal("LUSERS 266", r)
+	}
 
 	conn.inbound <- "PING thishost"
 	if r := <-conn.outbound; r != ":foohost PONG foohost :thishost\r\n" {
 		t.Fatal("PONG", r)
 	}
+	// Source prefix sent by client is ignored
+	conn.inbound <- ":meinick PING :thishost"
+	if r := <-conn.outbound; r != ":foohost PONG foohost :thishost\r\n" {
+		t.Fatal("PONG to prefixed PING", r)
+	}
+	conn.inbound <- ":meinick MODE meinick"
+	if r := <-conn.outbound; r != "221 meinick +\r\n" {
+		t.Fatal("prefixed MODE", r)
+	}
+	conn.inbound <- "@foo=bar :meinick PING :thishost"
+	if r := <-conn.outbound; r != ":foohost PONG foohost :thishost\r\n" {
+		t.Fatal("PONG to tagged prefixed PING", r)
+	}
 
 	conn.inbound <- "QUIT\r\nUNEXISTENT CMD"
 }
@@ -118,7 +176,7 @@ func TestMotd(t *testing.T) {
 		t.Fatalf("can not create temporary file: %v", err)
 	}
 	defer os.Remove(fd.Name())
-	fd.WriteString("catched\n")
+	fd.WriteString("catched\r\nsecond\r\n")
 
 	conn := NewTestingConn()
 	host := "foohost"
@@ -126,6 +184,15 @@ func TestMotd(t *testing.T) {
 	client := NewClient(conn)
 	motdName := fd.Name()
 	motd = &motdName
+	defer func() {
+		motdName = ""
+		LoadMotd()
+	}()
+	if err = LoadMotd(); err != nil {
+		t.Fatal("MOTD loading", err)
+	}
+	fd.WriteString("not reread\n")
+	fd.Close()
 
 	SendMotd(client)
 	if r := <-conn.outbound; !strings.HasPrefix(r, ":foohost 375") {
@@ -134,7 +201,2233 @@ func TestMotd(t *testing.T) {
 	if r := <-conn.outbound; !strings.Contains(r, "372 * :- catched\r\n") {
 		t.Fatal("MOTD contents", r)
 	}
+	if r := <-conn.outbound; !strings.Contains(r, "372 * :- second\r\n") {
+		t.Fatal("MOTD CRLF contents", r)
+	}
 	if got, want := <-conn.outbound, ":foohost 376"; !strings.HasPrefix(got, want) {
 		t.Fatalf("MOTD end: got %q, want prefix %q", got, want)
 	}
+
+	motdName = ""
+	LoadMotd()
+	SendMotd(client)
+	if r := <-conn.outbound; r != ":foohost 422 * :MOTD File is missing\r\n" {
+		t.Fatal("missing MOTD", r)
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tags, rest := ParseTags("PRIVMSG #foo :bar")
+	if tags != nil || rest != "PRIVMSG #foo :bar" {
+		t.Fatal("no tags", tags, rest)
+	}
+	tags, rest = ParseTags("@label=a\\:b\\sc;+typing=active;flag PRIVMSG #foo :bar")
+	if rest != "PRIVMSG #foo :bar" {
+		t.Fatal("rest after tags", rest)
+	}
+	if tags["label"] != "a;b c" || tags["+typing"] != "active" {
+		t.Fatal("tags values", tags)
+	}
+	if value, found := tags["flag"]; !found || value != "" {
+		t.Fatal("valueless tag", tags)
+	}
+	if line := AddTag(AddTag("PING", "a=b"), "c"); line != "@c;a=b PING" {
+		t.Fatal("AddTag", line)
+	}
+	if escaped := EscapeTag("a;b c\\"); escaped != "a\\:b\\sc\\\\" {
+		t.Fatal("EscapeTag", escaped)
+	}
+	msgid := NextMsgID(time.Now())
+	if relayed := ClientTags(map[string]string{"+draft/reply": msgid, "label": "x"}); relayed != "+draft/reply="+msgid {
+		t.Fatal("reply to known message", relayed)
+	}
+	for _, unknown := range []string{"foo", "0", strconv.FormatInt(atomic.LoadInt64(&lastMsgID)+1, 36)} {
+		if relayed := ClientTags(map[string]string{"+draft/reply": unknown, "+typing": "active"}); relayed != "+typing=active" {
+			t.Fatal("reply to unknown message", unknown, relayed)
+		}
+	}
+}
+
+// Throughput of PINGs sent concurrently by several clients through the
+// events queue of the given capacity
+func benchmarkEvents(b *testing.B, capacity int) {
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent, capacity)
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	const parallel = 8
+	var wg sync.WaitGroup
+	cs := make([]*Client, parallel)
+	for i := range cs {
+		conn := NewTestingConn()
+		cs[i] = NewClient(conn)
+		cs[i].registered = true
+		go func() {
+			for range conn.outbound {
+			}
+		}()
+	}
+	b.ResetTimer()
+	for _, client := range cs {
+		wg.Add(1)
+		go func(client *Client) {
+			for n := 0; n < b.N/parallel; n++ {
+				events <- ClientEvent{client, EventMsg, "PING foo"}
+			}
+			wg.Done()
+		}(client)
+	}
+	wg.Wait()
+	events <- ClientEvent{eventType: EventTerm}
+	<-finished
+	b.StopTimer()
+	for _, client := range cs {
+		client.Close("done")
+	}
+}
+
+func BenchmarkEvents(b *testing.B) {
+	for _, capacity := range []int{0, 64, 1024} {
+		b.Run(fmt.Sprintf("buffer%d", capacity), func(b *testing.B) {
+			benchmarkEvents(b, capacity)
+		})
+	}
+}
+
+// Throughput of PINGs sent by thousands of clients. Tagged ones are
+// always passed to the Daemon, untagged are answered by clients
+// goroutines themselves.
+func benchmarkPings(b *testing.B, line string) {
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent, EVENTS_BUFFER)
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	const parallel = 2000
+	var wg sync.WaitGroup
+	conns := make([]*TestingConn, parallel)
+	for i := range conns {
+		conns[i] = NewTestingConn()
+		client := NewClient(conns[i])
+		client.registered = true
+		go client.Processor(events)
+	}
+	b.ResetTimer()
+	for _, conn := range conns {
+		wg.Add(2)
+		go func(conn *TestingConn) {
+			for n := 0; n < b.N/parallel; n++ {
+				conn.inbound <- line
+			}
+			wg.Done()
+		}(conn)
+		go func(conn *TestingConn) {
+			for n := 0; n < b.N/parallel; n++ {
+				<-conn.outbound
+			}
+			wg.Done()
+		}(conn)
+	}
+	wg.Wait()
+	b.StopTimer()
+	for _, conn := range conns {
+		conn.inbound <- ""
+	}
+	events <- ClientEvent{eventType: EventTerm}
+	<-finished
+}
+
+func BenchmarkPings(b *testing.B) {
+	b.Run("daemon", func(b *testing.B) { benchmarkPings(b, "@foo=bar PING foo") })
+	b.Run("local", func(b *testing.B) { benchmarkPings(b, "PING foo") })
+}
+
+type temporaryError struct{}
+
+func (e temporaryError) Error() string   { return "temporary" }
+func (e temporaryError) Timeout() bool   { return false }
+func (e temporaryError) Temporary() bool { return true }
+
+// Listener failing with temporary errors and then a permanent one
+type brokenListener struct {
+	temporaries int
+}
+
+func (l *brokenListener) Accept() (net.Conn, error) {
+	if l.temporaries == 0 {
+		return nil, errors.New("permanent")
+	}
+	l.temporaries--
+	return nil, temporaryError{}
+}
+
+func (l *brokenListener) Close() error   { return nil }
+func (l *brokenListener) Addr() net.Addr { return MyAddr{} }
+
+func TestListenerLoopErrors(t *testing.T) {
+	l := &brokenListener{temporaries: 3}
+	done := make(chan struct{})
+	go func() {
+		listenerLoop(l, "raw", nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("listener loop did not exit")
+	}
+	if l.temporaries != 0 {
+		t.Fatal("temporary errors were not retried")
+	}
+}
+
+func TestUpstreams(t *testing.T) {
+	if _, err := ParseUpstreams("10.0.0.0/8,foo"); err == nil {
+		t.Fatal("invalid upstream accepted")
+	}
+	upstreams, err := ParseUpstreams("10.0.0.0/8,192.0.2.1,fd00::/8")
+	if err != nil {
+		t.Fatal("upstreams parsing", err)
+	}
+	for addr, trusted := range map[string]bool{
+		"10.1.2.3":    true,
+		"192.0.2.1":   true,
+		"192.0.2.2":   false,
+		"fd00::1":     true,
+		"2001:db8::1": false,
+	} {
+		if UpstreamTrusted(&net.TCPAddr{IP: net.ParseIP(addr), Port: 1234}, upstreams) != trusted {
+			t.Fatal("upstream trust", addr)
+		}
+	}
+	if UpstreamTrusted(MyAddr{}, upstreams) {
+		t.Fatal("non-IP address trusted")
+	}
+
+	sock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("can not listen", err)
+	}
+	l := &upstreamListener{sock, upstreams}
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", sock.Addr().String())
+	if err != nil {
+		t.Fatal("can not connect", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err == nil || os.IsTimeout(err) {
+		t.Fatal("untrusted connection is not closed")
+	}
+	conn.Close()
+	l.Close()
+	if conn := <-accepted; conn != nil {
+		t.Fatal("untrusted connection accepted")
+	}
+}
+
+// Listening sockets passed to the restarted process keep accepting
+// connections after the original listeners are closed
+func TestInheritListeners(t *testing.T) {
+	sock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("can not listen", err)
+	}
+	if _, err = listenerFiles([]net.Listener{&upstreamListener{sock, nil}}); err == nil {
+		t.Fatal("wrapped listener passed")
+	}
+	files, err := listenerFiles([]net.Listener{sock})
+	if err != nil {
+		t.Fatal("listener files", err)
+	}
+	addr := sock.Addr().String()
+	sock.Close()
+	inherited = files
+	l, err := listen("tcp", "ignored")
+	if err != nil {
+		t.Fatal("inherited listener", err)
+	}
+	defer l.Close()
+	if len(inherited) != 0 {
+		t.Fatal("inherited socket is not taken")
+	}
+	if l.Addr().String() != addr {
+		t.Fatal("inherited listener address", l.Addr())
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("can not connect", err)
+	}
+	conn.Close()
+}
+
+func TestSdNotify(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	if err := SdNotify("READY=1"); err != nil {
+		t.Fatal("notification without systemd", err)
+	}
+	path := filepath.Join(t.TempDir(), "notify")
+	sock, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Skip("can not listen", err)
+	}
+	defer sock.Close()
+	os.Setenv("NOTIFY_SOCKET", path)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	if err = SdNotify("READY=1"); err != nil {
+		t.Fatal("notification", err)
+	}
+	buf := make([]byte, 64)
+	sock.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := sock.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "READY=1" {
+		t.Fatal("notification state", string(buf[:n]), err)
+	}
+
+	// Sockets activated for another process are not taken
+	os.Setenv("LISTEN_PID", "1")
+	os.Setenv("LISTEN_FDS", "1")
+	InheritListeners()
+	if len(inherited) != 0 || os.Getenv("LISTEN_FDS") != "" {
+		t.Fatal("foreign sockets inherited", inherited)
+	}
+}
+
+func TestDropPrivileges(t *testing.T) {
+	if err := DropPrivileges("no-such-goircd-user", "", ""); err == nil {
+		t.Fatal("unknown user accepted")
+	}
+	if err := DropPrivileges("", "no-such-goircd-group", ""); err == nil {
+		t.Fatal("unknown group accepted")
+	}
+	if err := DropPrivileges("", "", ""); err != nil {
+		t.Fatal("nothing to drop", err)
+	}
+}
+
+func TestBanner(t *testing.T) {
+	fd, err := ioutil.TempFile("", "banner")
+	if err != nil {
+		t.Fatalf("can not create temporary file: %v", err)
+	}
+	defer os.Remove(fd.Name())
+	fd.WriteString("*** Welcome\n*** Be nice\n")
+	fd.Close()
+	bannerName := fd.Name()
+	banner = &bannerName
+	defer func() {
+		empty := ""
+		banner = &empty
+	}()
+
+	conn := NewTestingConn()
+	host := "foohost"
+	hostname = &host
+	SendBanner(NewClient(conn))
+	if r := <-conn.outbound; r != ":foohost NOTICE AUTH :*** Welcome\r\n" {
+		t.Fatal("banner first line", r)
+	}
+	if r := <-conn.outbound; r != ":foohost NOTICE AUTH :*** Be nice\r\n" {
+		t.Fatal("banner second line", r)
+	}
+}
+
+func TestCapNegotiation(t *testing.T) {
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+	}()
+
+	for _, lines := range [][]string{
+		{"CAP LS 302", "NICK nick1", "USER foo1 bar1 baz1 :Long name1", "CAP REQ :batch", "CAP END"},
+		{"NICK nick2", "CAP LS", "USER foo2 bar2 baz2 :Long name2", "CAP END"},
+		{"USER foo3 bar3 baz3 :Long name3", "CAP REQ :batch", "NICK nick3", "CAP END"},
+	} {
+		conn := NewTestingConn()
+		go NewClient(conn).Processor(events)
+		conn.inbound <- strings.Join(lines, "\r\n")
+		for _, line := range lines[:len(lines)-1] {
+			if !strings.HasPrefix(line, "CAP") {
+				continue
+			}
+			if r := <-conn.outbound; !strings.Contains(r, " CAP ") {
+				t.Fatal("registration during CAP negotiation", lines, r)
+			}
+		}
+		if r := <-conn.outbound; !strings.Contains(r, ":foohost 001") {
+			t.Fatal("registration after CAP END", lines, r)
+		}
+		conn.inbound <- "QUIT"
+	}
+}
+
+func TestGhost(t *testing.T) {
+	fd, err := ioutil.TempFile("", "passwords")
+	if err != nil {
+		t.Fatalf("can not create temporary file: %v", err)
+	}
+	defer os.Remove(fd.Name())
+	fd.WriteString("nick1:secret\n")
+	fd.Close()
+	passwordsName := fd.Name()
+	passwords = &passwordsName
+	defer func() {
+		empty := ""
+		passwords = &empty
+	}()
+
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+	}()
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	go NewClient(conn1).Processor(events)
+	go NewClient(conn2).Processor(events)
+	conn1.inbound <- "PASS secret\r\nNICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	conn2.inbound <- "PASS secret\r\nNICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
+	for i := 0; i < 13; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+
+	conn2.inbound <- "GHOST nick3"
+	noNickchan(t, conn2)
+	conn2.inbound <- "GHOST nick1 wrong"
+	if r := <-conn2.outbound; r != ":foohost 464 nick2 :Password incorrect\r\n" {
+		t.Fatal("GHOST with wrong password", r)
+	}
+	conn2.inbound <- "GHOST nick1 secret"
+	if r := <-conn2.outbound; r != ":foohost NOTICE nick2 :Ghost with nickname nick1 has been killed\r\n" {
+		t.Fatal("GHOST", r)
+	}
+	if _, open := <-conn1.outbound; open {
+		t.Fatal("ghost connection is not closed")
+	}
+	conn2.inbound <- "NICK nick1\r\nMODE nick1"
+	if r := <-conn2.outbound; r != "221 nick1 +\r\n" {
+		t.Fatal("NICK of killed ghost", r)
+	}
+	conn1.inbound <- ""
+}
+
+func TestNicknameCase(t *testing.T) {
+	fd, err := ioutil.TempFile("", "passwords")
+	if err != nil {
+		t.Fatalf("can not create temporary file: %v", err)
+	}
+	defer os.Remove(fd.Name())
+	fd.WriteString("nick1:secret\n")
+	fd.Close()
+	passwordsName := fd.Name()
+	passwords = &passwordsName
+	defer func() {
+		empty := ""
+		passwords = &empty
+	}()
+
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	accounts = make(map[string]map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+	}()
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	client1 := NewClient(conn1)
+	go client1.Processor(events)
+	go NewClient(conn2).Processor(events)
+	conn1.inbound <- "PASS secret\r\nNICK Nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	for i := 0; i < 13; i++ {
+		<-conn1.outbound
+	}
+	if client1.account == nil || *client1.account != "nick1" {
+		t.Fatal("mixed-case nickname is not identified")
+	}
+
+	conn2.inbound <- "NICK NICK1"
+	if r := <-conn2.outbound; r != ":foohost 433 * NICK1 :Nickname is already in use\r\n" {
+		t.Fatal("mixed-case nickname collision", r)
+	}
+	conn2.inbound <- "PASS secret\r\nNICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
+	for i := 0; i < 13; i++ {
+		<-conn2.outbound
+	}
+	conn2.inbound <- "WHOIS nick1"
+	<-conn2.outbound
+	<-conn2.outbound
+	if r := <-conn2.outbound; r != ":foohost 330 nick2 Nick1 nick1 :is logged in as\r\n" {
+		t.Fatal("WHOIS of identified client", r)
+	}
+	for i := 0; i < 3; i++ {
+		<-conn2.outbound
+	}
+	conn2.inbound <- "ISON nick1 NICK2 nick3"
+	if r := <-conn2.outbound; r != ":foohost 303 nick2 :Nick1 nick2\r\n" {
+		t.Fatal("ISON", r)
+	}
+	conn2.inbound <- "PRIVMSG NICK1 :hello"
+	if r := <-conn1.outbound; r != ":nick2!foo2@someclient PRIVMSG Nick1 :hello\r\n" {
+		t.Fatal("PRIVMSG to mixed-case nickname", r)
+	}
+}
+
+func TestWebirc(t *testing.T) {
+	fd, err := ioutil.TempFile("", "webirc")
+	if err != nil {
+		t.Fatalf("can not create temporary file: %v", err)
+	}
+	defer os.Remove(fd.Name())
+	fd.WriteString("gateway:secret\n")
+	fd.Close()
+	webircName := fd.Name()
+	webirc = &webircName
+	defer func() {
+		empty := ""
+		webirc = &empty
+	}()
+
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+	}()
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	conn3 := NewTestingConn()
+	go NewClient(conn1).Processor(events)
+	go NewClient(conn2).Processor(events)
+	go NewClient(conn3).Processor(events)
+	conn1.inbound <- "WEBIRC secret gateway user.example 192.0.2.1\r\nNICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	conn2.inbound <- "WEBIRC secret gateway bad_host ::1\r\nNICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
+	for i := 0; i < 13; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+	conn1.inbound <- "PRIVMSG nick2 :hello"
+	if r := <-conn2.outbound; r != ":nick1!foo1@user.example PRIVMSG nick2 :hello\r\n" {
+		t.Fatal("WEBIRC hostname", r)
+	}
+	conn2.inbound <- "PRIVMSG nick1 :hello"
+	if r := <-conn1.outbound; r != ":nick2!foo2@0::1 PRIVMSG nick1 :hello\r\n" {
+		t.Fatal("WEBIRC IP instead of invalid hostname", r)
+	}
+	conn2.inbound <- "WHOIS nick1"
+	if r := <-conn2.outbound; r != ":foohost 311 nick2 nick1 foo1 user.example * :Long name1\r\n" {
+		t.Fatal("WHOIS of WEBIRC client", r)
+	}
+	for i := 0; i < 4; i++ {
+		<-conn2.outbound
+	}
+	conn1.inbound <- "WEBIRC secret gateway other.example 192.0.2.2"
+	if r := <-conn1.outbound; r != ":foohost 462 nick1 :You may not reregister\r\n" {
+		t.Fatal("WEBIRC after registration", r)
+	}
+
+	conn3.inbound <- "WEBIRC wrong gateway user.example 192.0.2.1"
+	if r := <-conn3.outbound; r != ":foohost 464 * :Password incorrect\r\n" {
+		t.Fatal("WEBIRC with wrong password", r)
+	}
+	if _, open := <-conn3.outbound; open {
+		t.Fatal("untrusted WEBIRC gateway is not disconnected")
+	}
+}
+
+func TestMarkRead(t *testing.T) {
+	fd, err := ioutil.TempFile("", "passwords")
+	if err != nil {
+		t.Fatalf("can not create temporary file: %v", err)
+	}
+	defer os.Remove(fd.Name())
+	fd.WriteString("nick1:secret\n")
+	fd.Close()
+	passwordsName := fd.Name()
+	passwords = &passwordsName
+	defer func() {
+		empty := ""
+		passwords = &empty
+	}()
+
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	accounts = make(map[string]map[*Client]struct{})
+	readMarkers = make(map[string]map[string]string)
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+	}()
+	register := func(nickname string) *TestingConn {
+		conn := NewTestingConn()
+		go NewClient(conn).Processor(events)
+		conn.inbound <- "CAP REQ :draft/read-marker standard-replies\r\nPASS secret\r\nNICK " + nickname + "\r\nUSER foo bar baz :Long name\r\nCAP END"
+		for i := 0; i < 14; i++ {
+			<-conn.outbound
+		}
+		return conn
+	}
+	conn1 := register("nick1")
+	conn1.inbound <- "NICK away1\r\nMODE away1"
+	<-conn1.outbound
+	conn2 := register("nick1")
+	conn3 := register("nick3")
+	if sessions := AccountSessions("NICK1"); len(sessions) != 2 {
+		t.Fatal("account sessions", sessions)
+	}
+
+	conn3.inbound <- "MARKREAD #foo"
+	if r := <-conn3.outbound; r != ":foohost FAIL MARKREAD ACCOUNT_REQUIRED :You need to be identified\r\n" {
+		t.Fatal("MARKREAD without account", r)
+	}
+	conn2.inbound <- "MARKREAD #foo"
+	if r := <-conn2.outbound; r != ":foohost MARKREAD #foo *\r\n" {
+		t.Fatal("MARKREAD query of unset marker", r)
+	}
+	conn2.inbound <- "MARKREAD #foo 2026-01-02T03:04:05.006Z"
+	if r := <-conn2.outbound; r != ":foohost FAIL MARKREAD INVALID_PARAMS #foo :Invalid timestamp\r\n" {
+		t.Fatal("MARKREAD with invalid timestamp", r)
+	}
+	conn2.inbound <- "MARKREAD #Foo timestamp=2026-01-02T03:04:05.006Z"
+	for _, conn := range []*TestingConn{conn1, conn2} {
+		if r := <-conn.outbound; r != ":foohost MARKREAD #Foo timestamp=2026-01-02T03:04:05.006Z\r\n" {
+			t.Fatal("MARKREAD update of account's sessions", r)
+		}
+	}
+	conn1.inbound <- "MARKREAD #foo timestamp=2025-01-02T03:04:05.006Z"
+	if r := <-conn1.outbound; r != ":foohost MARKREAD #foo timestamp=2026-01-02T03:04:05.006Z\r\n" {
+		t.Fatal("MARKREAD moving backwards", r)
+	}
+}
+
+func TestParseMessage(t *testing.T) {
+	for _, c := range []struct {
+		line, prefix, command, params string
+	}{
+		{"", "", "", ""},
+		{"   ", "", "", ""},
+		{":nick!user@host", "nick!user@host", "", ""},
+		{":nick :PRIVMSG #foo", "nick", "", ""},
+		{"privmsg #foo :hello  world ", "", "PRIVMSG", "#foo :hello  world "},
+		{":nick  PRIVMSG   #foo   hello  ", "nick", "PRIVMSG", "#foo hello"},
+		{"TOPIC #foo :", "", "TOPIC", "#foo :"},
+		{"AWAY   ", "", "AWAY", ""},
+		{"JOIN #foo :", "", "JOIN", "#foo :"},
+		{"MODE #foo +b :", "", "MODE", "#foo +b :"},
+		{"USER foo 0 * ::name", "", "USER", "foo 0 * ::name"},
+		{"FOO 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16", "", "FOO", "1 2 3 4 5 6 7 8 9 10 11 12 13 14 :15 16"},
+	} {
+		msg := ParseMessage(c.line)
+		if msg.prefix != c.prefix || msg.command != c.command || msg.Params() != c.params {
+			t.Fatal("message parsing", c.line, msg)
+		}
+	}
+}
+
+func FuzzParseMessage(f *testing.F) {
+	for _, line := range []string{
+		"PRIVMSG #foo :hello world",
+		":prefix NOTICE nick :text",
+		"JOIN #foo,#bar key",
+		"USER a b c :",
+		" :x ",
+	} {
+		f.Add(line)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		msg := ParseMessage(line)
+		if msg.command == "" {
+			if len(msg.params) != 0 {
+				t.Fatal("parameters without command", line, msg)
+			}
+			return
+		}
+		if strings.Contains(msg.command, " ") || len(msg.params) > MaxParams {
+			t.Fatal("malformed command", line, msg)
+		}
+		for i, param := range msg.params {
+			if msg.trailing && i == len(msg.params)-1 {
+				break
+			}
+			if param == "" || param[0] == ':' || strings.Contains(param, " ") {
+				t.Fatal("malformed middle parameter", line, msg)
+			}
+		}
+		again := ParseMessage(msg.command + " " + msg.Params())
+		if again.command != msg.command || again.Params() != msg.Params() {
+			t.Fatal("unstable parsing", line, msg, again)
+		}
+	})
+}
+
+func TestLogger(t *testing.T) {
+	logdir, err := ioutil.TempDir("", "logdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logdir)
+	events := make(chan LogEvent)
+	done := make(chan struct{})
+	go func() {
+		Logger(logdir, time.RFC3339, events)
+		close(done)
+	}()
+	events <- LogEvent{"#foo", "nick", "hello", false}
+	events <- LogEvent{"#foo", "nick", "joined", true}
+	close(events)
+	<-done
+	contents, err := ioutil.ReadFile(filepath.Join(logdir, "#foo.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stamp := `\[\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d(Z|[+-]\d\d:\d\d)\] `
+	if !regexp.MustCompile("^" + stamp + "<nick> hello\n" + stamp + "\\* nick joined\n$").Match(contents) {
+		t.Fatal("log lines", string(contents))
+	}
+}
+
+func TestStateKeeper(t *testing.T) {
+	statedir, err := ioutil.TempDir("", "statedir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(statedir)
+	events := make(chan StateEvent)
+	done := make(chan struct{})
+	go func() {
+		StateKeeper(statedir, events)
+		close(done)
+	}()
+	events <- StateEvent{where: "#foo", topic: "old"}
+	events <- StateEvent{where: "#foo", topic: "new", key: "secret"}
+	events <- StateEvent{where: "#bar", topic: "bar"}
+	events <- StateEvent{where: "#bar", removed: true}
+	events <- StateEvent{where: "#baz", topicSetter: "nick!user@host 1700000000", metadata: "avatar foo\nurl bar"}
+	events <- StateEvent{where: MetadataStateName("Nick/1"), metadata: "avatar foo"}
+	close(events)
+	<-done
+	entries, err := ioutil.ReadDir(statedir)
+	if err != nil || len(entries) != 3 || entries[1].Name() != "#foo" || entries[1].Mode() != 0660 {
+		t.Fatal("statedir files", entries, err)
+	}
+	contents, err := ioutil.ReadFile(filepath.Join(statedir, "#foo"))
+	if err != nil || string(contents) != "new\nsecret\n\n\n\n\n\n\n\n\n" {
+		t.Fatalf("state %q %v", contents, err)
+	}
+	contents, err = ioutil.ReadFile(filepath.Join(statedir, "#baz"))
+	if err != nil || string(contents) != "\n\n\n\n\n\n\n\nnick!user@host 1700000000\n\navatar foo\nurl bar\n" {
+		t.Fatalf("state with metadata %q %v", contents, err)
+	}
+	lines := strings.Split(string(contents), "\n")
+	if who, when := RestoreSetter(lines[8]); who != "nick!user@host" || when.Unix() != 1700000000 {
+		t.Fatal("restored topic setter", who, when)
+	}
+	if who, when := RestoreSetter(lines[9]); who != "" || !when.IsZero() {
+		t.Fatal("restored unknown key setter", who, when)
+	}
+	metadata := make(map[string]string)
+	RestoreMetadata(metadata, lines[10:])
+	if len(metadata) != 2 || metadata["url"] != "bar" {
+		t.Fatal("restored metadata", metadata)
+	}
+	account, ok := MetadataStateAccount(entries[2].Name())
+	if !ok || account != "nick/1" {
+		t.Fatal("metadata state name", entries[2].Name(), account)
+	}
+	contents, err = ioutil.ReadFile(filepath.Join(statedir, entries[2].Name()))
+	if err != nil || string(contents) != "avatar foo\n" {
+		t.Fatalf("account metadata state %q %v", contents, err)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	passwordsFn := filepath.Join(dir, "passwords")
+	ioutil.WriteFile(passwordsFn, []byte("login:password\n\nbroken\n"), 0600)
+	opersFn := filepath.Join(dir, "opers")
+	ioutil.WriteFile(opersFn, []byte("admin:secret\n"), 0600)
+	classesFn := filepath.Join(dir, "classes")
+	ioutil.WriteFile(classesFn, []byte("tls tls 8192\n"), 0600)
+
+	saved := []*string{floodAction, logdir, statedir, proxy, classesFile, passwords, opers, motd}
+	defer func() {
+		floodAction, logdir, statedir, proxy, classesFile, passwords, opers, motd =
+			saved[0], saved[1], saved[2], saved[3], saved[4], saved[5], saved[6], saved[7]
+	}()
+	values := []string{"drop", dir, "", "", "", passwordsFn, opersFn, ""}
+	floodAction, logdir, statedir, proxy, classesFile, passwords, opers, motd =
+		&values[0], &values[1], &values[2], &values[3], &values[4], &values[5], &values[6], &values[7]
+	if problems := CheckConfig(); len(problems) != 0 {
+		t.Fatal("valid configuration", problems)
+	}
+	if problems := CheckFiles(); len(problems) != 1 || !strings.Contains(problems[0].Error(), "passwords file") || !strings.Contains(problems[0].Error(), "line 3") {
+		t.Fatal("malformed passwords file", problems)
+	}
+
+	copy(values, []string{"explode", "relative", dir + "/nonexistent", "10.0.0.0/33", classesFn, "", opersFn, dir + "/motd"})
+	if problems := CheckConfig(); len(problems) != 4 {
+		t.Fatal("invalid configuration", problems)
+	}
+	if problems := CheckFiles(); len(problems) != 2 {
+		t.Fatal("missing files", problems)
+	}
+}
+
+func TestUnknownCommandLogging(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	host := "foohost"
+	hostname = &host
+	client := NewClient(NewTestingConn())
+	nickname := "nick"
+	client.nickname = &nickname
+	client.registered = true
+	now := time.Now()
+	ClientCommand(client, "FOO", []string{"FOO"}, "", now)
+	ClientCommand(client, "BAR", []string{"BAR"}, "", now.Add(time.Second))
+	if n := strings.Count(buf.String(), "unknown: command"); n != 1 {
+		t.Fatal("rate-limited unknown commands logging", buf.String())
+	}
+	ClientCommand(client, "BAZ", []string{"BAZ"}, "", now.Add(UnknownLogPeriod))
+	if !strings.Contains(buf.String(), "unknown: command BAZ") {
+		t.Fatal("unknown command logging after period", buf.String())
+	}
+}
+
+func TestServerInfo(t *testing.T) {
+	host := "foohost"
+	hostname = &host
+	info := ""
+	serverInfo = &info
+	defer func() {
+		info = ""
+	}()
+	conn := NewTestingConn()
+	client := NewClient(conn)
+	nickname := "nick"
+	client.nickname = &nickname
+	client.registered = true
+	now := time.Now()
+	ClientCommand(client, "LINKS", []string{"LINKS"}, "", now)
+	if r := <-conn.outbound; r != ":foohost 364 nick foohost foohost :0 foohost\r\n" {
+		t.Fatal("LINKS without serverinfo", r)
+	}
+	<-conn.outbound
+	info = "Foo IRC server"
+	ClientCommand(client, "LINKS", []string{"LINKS", "foo*"}, "", now)
+	if r := <-conn.outbound; r != ":foohost 364 nick foohost foohost :0 Foo IRC server\r\n" {
+		t.Fatal("LINKS", r)
+	}
+	if r := <-conn.outbound; r != ":foohost 365 nick foo* :End of /LINKS list\r\n" {
+		t.Fatal("LINKS end", r)
+	}
+	ClientCommand(client, "LINKS", []string{"LINKS", "bar*"}, "", now)
+	if r := <-conn.outbound; r != ":foohost 365 nick bar* :End of /LINKS list\r\n" {
+		t.Fatal("LINKS of unmatched mask", r)
+	}
+	ClientCommand(client, "INFO", []string{"INFO"}, "", now)
+	<-conn.outbound
+	if r := <-conn.outbound; r != ":foohost 371 nick :Foo IRC server\r\n" {
+		t.Fatal("INFO", r)
+	}
+	for r := <-conn.outbound; !strings.HasPrefix(r, ":foohost 374 nick "); r = <-conn.outbound {
+		if !strings.HasPrefix(r, ":foohost 371 nick ") {
+			t.Fatal("INFO", r)
+		}
+	}
+}
+
+// Registration burst numerics go in the canonical order
+func TestRegistrationBurst(t *testing.T) {
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+	}()
+	conn := NewTestingConn()
+	go NewClient(conn).Processor(events)
+	conn.inbound <- "CAP LS\r\nNICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	<-conn.outbound
+	conn.inbound <- "CAP END"
+	var numerics []string
+	for _, numeric := range []string{
+		"001", "002", "003", "004", "005",
+		"251", "252", "253", "254", "255", "265", "266",
+		"422",
+	} {
+		r := <-conn.outbound
+		numerics = append(numerics, strings.Fields(r)[1])
+		if !strings.HasPrefix(r, ":foohost "+numeric+" nick1 ") {
+			t.Fatal("registration burst order", numerics)
+		}
+	}
+}
+
+func TestRegistrationTimeout(t *testing.T) {
+	host := "foohost"
+	hostname = &host
+	timeout := uint(0)
+	regTimeout = &timeout
+	defer func() {
+		timeout := uint(REG_TIMEOUT)
+		regTimeout = &timeout
+	}()
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+	}()
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	go NewClient(conn1).Processor(events)
+	go NewClient(conn2).Processor(events)
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	conn2.inbound <- "NICK nick2"
+	for i := 0; i < 13; i++ {
+		<-conn1.outbound
+	}
+	time.Sleep(time.Millisecond)
+
+	events <- ClientEvent{eventType: EventTick}
+	if _, open := <-conn2.outbound; open {
+		t.Fatal("unregistered client is not disconnected")
+	}
+	conn1.inbound <- "MODE nick1"
+	if r := <-conn1.outbound; r != "221 nick1 +\r\n" {
+		t.Fatal("registered client is disconnected", r)
+	}
+	conn1.inbound <- "USER foo1 bar1 baz1 :Other name"
+	if r := <-conn1.outbound; r != ":foohost 462 nick1 :You may not reregister\r\n" {
+		t.Fatal("USER after registration", r)
+	}
+	conn1.inbound <- "PASS secret"
+	if r := <-conn1.outbound; r != ":foohost 462 nick1 :You may not reregister\r\n" {
+		t.Fatal("PASS after registration", r)
+	}
+}
+
+func TestClasses(t *testing.T) {
+	for _, text := range []string{
+		"tls tls 8192 90",
+		"net 10.0.0.0/33 8192 90 5",
+		"slow raw 0 90 5",
+	} {
+		if _, err := ParseClasses(text); err == nil {
+			t.Fatal("invalid class accepted", text)
+		}
+	}
+	parsed, err := ParseClasses("# name match sendq pingfreq maxperip\n\nlocal 127.0.0.0/8 16384 300 0\ntls tls 8192 60 1 # secure\n")
+	if err != nil {
+		t.Fatal("classes parsing", err)
+	}
+	classes = parsed
+	defer func() {
+		classes = nil
+	}()
+	if c := ClassFor("raw", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}); c.name != "local" || c.sendq != 16384 || c.pingFreq != 300*time.Second {
+		t.Fatal("class by network", c)
+	}
+	if c := ClassFor("tls", &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}); c.name != "tls" || c.maxPerIP != 1 {
+		t.Fatal("class by listener", c)
+	}
+	if c := ClassFor("raw", MyAddr{}); c != DefaultClass {
+		t.Fatal("default class", c)
+	}
+
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+	}()
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	conn3 := NewTestingConn()
+	go NewClassClient(conn1, parsed[1]).Processor(events)
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	for i := 0; i < 13; i++ {
+		<-conn1.outbound
+	}
+	go NewClassClient(conn2, parsed[1]).Processor(events)
+	if r := <-conn2.outbound; r != "ERROR :Too many connections from your address\r\n" {
+		t.Fatal("connection over class limit", r)
+	}
+	if _, ok := <-conn2.outbound; ok {
+		t.Fatal("connection over class limit is not closed")
+	}
+	go NewClassClient(conn3, parsed[0]).Processor(events)
+	conn3.inbound <- "NICK nick3\r\nUSER foo3 bar3 baz3 :Long name3"
+	if r := <-conn3.outbound; !strings.HasPrefix(r, ":foohost 001 nick3 ") {
+		t.Fatal("connection in another class", r)
+	}
+	for i := 1; i < 13; i++ {
+		<-conn3.outbound
+	}
+}
+
+func TestMaxClones(t *testing.T) {
+	limit := uint(1)
+	maxClones = &limit
+	defer func() {
+		limit = 0
+	}()
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+	}()
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	go NewClient(conn1).Processor(events)
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	for i := 0; i < 13; i++ {
+		<-conn1.outbound
+	}
+	go NewClient(conn2).Processor(events)
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
+	if r := <-conn2.outbound; r != ":foohost NOTICE nick2 :Too many clients from your address are already registered\r\n" {
+		t.Fatal("clone registration", r)
+	}
+	if _, ok := <-conn2.outbound; ok {
+		t.Fatal("clone is not closed")
+	}
+}
+
+func TestAliases(t *testing.T) {
+	for _, text := range []string{"NS", "NS NickServ extra", "BAD bad:nick"} {
+		if _, err := ParseAliases(text); err == nil {
+			t.Fatal("invalid alias accepted", text)
+		}
+	}
+	parsed, err := ParseAliases("# word nickname\n\nbot nick2 # helper\n")
+	if err != nil {
+		t.Fatal("aliases parsing", err)
+	}
+	if parsed["BOT"] != "nick2" || parsed["CS"] != ChanServ {
+		t.Fatal("parsed aliases", parsed)
+	}
+	aliases = parsed
+	defer func() {
+		aliases = DefaultAliases()
+	}()
+
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+	}()
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	go NewClient(conn1).Processor(events)
+	go NewClient(conn2).Processor(events)
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
+	for i := 0; i < 13; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+
+	conn1.inbound <- "bot :hello there"
+	if r := <-conn2.outbound; r != ":nick1!foo1@someclient PRIVMSG nick2 :hello there\r\n" {
+		t.Fatal("alias to client", r)
+	}
+	conn1.inbound <- "BOT"
+	if r := <-conn1.outbound; r != ":foohost 412 nick1 :No text to send\r\n" {
+		t.Fatal("alias without text", r)
+	}
+	conn1.inbound <- "CS REGISTER #foo"
+	if r := <-conn1.outbound; r != ":ChanServ!ChanServ@foohost NOTICE nick1 :You need to be identified to register channels\r\n" {
+		t.Fatal("alias to ChanServ", r)
+	}
+}
+
+func TestDisabledCommands(t *testing.T) {
+	if _, err := ParseDisabled("LIST,pong"); err == nil {
+		t.Fatal("essential command disabled")
+	}
+	parsed, err := ParseDisabled(" list, mode,,")
+	if err != nil || len(parsed) != 2 {
+		t.Fatal("disabled commands parsing", parsed, err)
+	}
+	disabledCommands = parsed
+	defer func() {
+		disabledCommands = make(map[string]struct{})
+	}()
+
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+	}()
+	conn := NewTestingConn()
+	client := NewClient(conn)
+	go client.Processor(events)
+	conn.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	for i := 0; i < 13; i++ {
+		<-conn.outbound
+	}
+
+	conn.inbound <- "LIST"
+	if r := <-conn.outbound; r != ":foohost 421 nick1 LIST :Command is disabled\r\n" {
+		t.Fatal("disabled LIST", r)
+	}
+	conn.inbound <- "MODE nick1"
+	if r := <-conn.outbound; r != ":foohost 421 nick1 MODE :Command is disabled\r\n" {
+		t.Fatal("disabled locally handled MODE", r)
+	}
+	client.SetMode('o', true)
+	conn.inbound <- "MODE nick1"
+	if r := <-conn.outbound; r != "221 nick1 +o\r\n" {
+		t.Fatal("disabled MODE of operator", r)
+	}
+}
+
+func TestDNSBL(t *testing.T) {
+	if q := DNSBLQuery(net.ParseIP("192.0.2.1"), "dnsbl.example"); q != "1.2.0.192.dnsbl.example" {
+		t.Fatal("IPv4 DNSBL query", q)
+	}
+	if q := DNSBLQuery(net.ParseIP("2001:db8::1"), "dnsbl.example"); q != "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.dnsbl.example" {
+		t.Fatal("IPv6 DNSBL query", q)
+	}
+	defer func(lookup func(context.Context, string) ([]string, error)) {
+		dnsblLookup = lookup
+	}(dnsblLookup)
+	dnsblLookup = func(ctx context.Context, host string) ([]string, error) {
+		switch host {
+		case "1.2.0.192.slow.example":
+			<-ctx.Done()
+			return nil, ctx.Err()
+		case "1.2.0.192.bad.example":
+			return []string{"127.0.0.2"}, nil
+		}
+		return nil, errors.New("not found")
+	}
+	ip := net.ParseIP("192.0.2.1")
+	if zone := DNSBLListed(ip, []string{"good.example", "slow.example"}, 10*time.Millisecond); zone != "" {
+		t.Fatal("listed in no zone", zone)
+	}
+	if zone := DNSBLListed(ip, []string{"slow.example", "bad.example"}, time.Second); zone != "bad.example" {
+		t.Fatal("listed in zone", zone)
+	}
+
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+		action := "reject"
+		dnsblAction = &action
+	}()
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	client1 := NewClient(conn1)
+	client2 := NewClient(conn2)
+	go client1.Processor(events)
+	go client2.Processor(events)
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	conn2.inbound <- "NICK nick2"
+	for i := 0; i < 13; i++ {
+		<-conn1.outbound
+	}
+	events <- ClientEvent{client2, EventDNSBL, "bad.example"}
+	if r := <-conn2.outbound; r != ":foohost 465 nick2 :You are banned from this server (listed in bad.example)\r\n" {
+		t.Fatal("DNSBL listed client rejection", r)
+	}
+	if _, open := <-conn2.outbound; open {
+		t.Fatal("DNSBL listed client is not disconnected")
+	}
+
+	action := "mark"
+	dnsblAction = &action
+	events <- ClientEvent{client1, EventDNSBL, "bad.example"}
+	conn1.inbound <- "MODE nick1"
+	if r := <-conn1.outbound; r != "221 nick1 +\r\n" {
+		t.Fatal("DNSBL marked client is disconnected", r)
+	}
+}
+
+func TestChanCreate(t *testing.T) {
+	defer func() {
+		policy := "all"
+		chanCreate = &policy
+	}()
+	host := "foohost"
+	hostname = &host
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	conn := NewTestingConn()
+	client := NewClient(conn)
+	nickname := "nick"
+	client.nickname = &nickname
+	for _, policy := range []string{"identified", "opers"} {
+		chanCreate = &policy
+		HandlerJoin(client, "#new")
+		if r := <-conn.outbound; r != ":foohost 520 nick #new :Cannot join channel - creating channels is restricted to "+policy+"\r\n" {
+			t.Fatal("channel creation restricted to", policy, r)
+		}
+	}
+	account := "nick"
+	client.account = &account
+	policy := "identified"
+	chanCreate = &policy
+	if !CreationAllowed(client) {
+		t.Fatal("identified client can not create channels")
+	}
+	policy = "opers"
+	if CreationAllowed(client) {
+		t.Fatal("identified client can create channels")
+	}
+	client.SetMode('o', true)
+	if !CreationAllowed(client) {
+		t.Fatal("operator can not create channels")
+	}
+}
+
+func TestDefChanModes(t *testing.T) {
+	if err := CheckChanModes("+nt"); err == nil {
+		t.Fatal("unknown default modes accepted")
+	}
+	if err := CheckChanModes("+cs"); err != nil {
+		t.Fatal("default modes", err)
+	}
+	modes := "+cs"
+	defChanModes = &modes
+	defer func() {
+		modes := ""
+		defChanModes = &modes
+	}()
+	logSink = make(chan LogEvent, 8)
+	stateSink = make(chan StateEvent, 8)
+	host := "foohost"
+	hostname = &host
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	conn := NewTestingConn()
+	client := NewClient(conn)
+	nickname := "nick"
+	client.nickname = &nickname
+	HandlerJoin(client, "#new")
+	if r := <-stateSink; r.where != "#new" || r.modes != "cs" {
+		t.Fatal("default modes state", r)
+	}
+	for i := 0; i < 4; i++ {
+		<-conn.outbound
+	}
+	roomsM.Lock()
+	r, _ := GetRoom("#new")
+	if mode := r.ModeString(); mode != "+cs" {
+		t.Fatal("default modes", mode)
+	}
+	delete(rooms, "#new")
+	close(roomSinks[r])
+	delete(roomSinks, r)
+	roomsM.Unlock()
+}
+
+func TestTruncate(t *testing.T) {
+	if text := Truncate("short", 10); text != "short" {
+		t.Fatal("short text truncated", text)
+	}
+	if text := Truncate("long text", 4); text != "long" {
+		t.Fatal("long text", text)
+	}
+	if text := Truncate("привет", 5); text != "пр" {
+		t.Fatal("UTF-8 sequence split", text)
+	}
+}
+
+func TestLag(t *testing.T) {
+	host := "foohost"
+	hostname = &host
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	client1 := NewClient(conn1)
+	client2 := NewClient(conn2)
+	nickname1 := "nick1"
+	nickname2 := "nick2"
+	client1.nickname = &nickname1
+	client2.nickname = &nickname2
+	client1.registered = true
+	client2.registered = true
+	clients = map[*Client]struct{}{client1: {}, client2: {}}
+	defer func() {
+		clients = make(map[*Client]struct{})
+	}()
+
+	now := time.Now()
+	if client1.Pong(now, []string{"foohost"}) || client1.Lag() != 0 {
+		t.Fatal("PONG without PING", client1.Lag())
+	}
+	client1.Ping(now)
+	r := <-conn1.outbound
+	token := strings.TrimSuffix(strings.TrimPrefix(r, "PING :"), "\r\n")
+	if len(token) != 16 || token == r {
+		t.Fatal("PING", r)
+	}
+	if client1.Pong(now.Add(time.Millisecond), []string{"foohost"}) {
+		t.Fatal("PONG with wrong token")
+	}
+	if !client1.Pong(now.Add(42*time.Millisecond), []string{"foohost", token}) {
+		t.Fatal("PONG")
+	}
+	if client1.Pong(now.Add(time.Second), []string{token}) {
+		t.Fatal("repeated PONG")
+	}
+	if lag := client1.Lag(); lag != 42*time.Millisecond {
+		t.Fatal("lag", lag)
+	}
+	if client1.LastRecv() != now.Add(42*time.Millisecond) {
+		t.Fatal("PONG liveness", client1.LastRecv())
+	}
+	client3 := NewClient(NewTestingConn())
+	since := client3.LastRecv()
+	ClientCommand(client3, "PONG", []string{"PONG", ":foohost"}, "", now.Add(time.Minute))
+	ClientCommand(client1, "PONG", []string{"PONG", ":" + token}, "", now.Add(time.Minute))
+	if client3.LastRecv() != since || client1.LastRecv() != now.Add(42*time.Millisecond) {
+		t.Fatal("unsolicited PONG liveness", client3.LastRecv(), client1.LastRecv())
+	}
+	mode := "hostname"
+	pingToken = &mode
+	defer func() {
+		mode := "nonce"
+		pingToken = &mode
+	}()
+	client1.Ping(now)
+	if r := <-conn1.outbound; r != "PING :foohost\r\n" {
+		t.Fatal("PING with hostname", r)
+	}
+	client1.Pong(now.Add(42*time.Millisecond), []string{"foohost"})
+
+	SendStats(client1, "l")
+	if r := <-conn1.outbound; !strings.HasPrefix(r, ":foohost 211 nick1 nick1!@someclient 0 42 ") {
+		t.Fatal("STATS l", r)
+	}
+	if r := <-conn1.outbound; r != ":foohost 219 nick1 l :End of STATS report\r\n" {
+		t.Fatal("STATS l of non-operator", r)
+	}
+	client2.SetMode('o', true)
+	SendStats(client2, "l")
+	for i := 0; i < 2; i++ {
+		if r := <-conn2.outbound; !strings.HasPrefix(r, ":foohost 211 nick2 ") {
+			t.Fatal("STATS l of operator", r)
+		}
+	}
+	<-conn2.outbound
+}
+
+func TestListenersUsage(t *testing.T) {
+	host := "foohost"
+	hostname = &host
+	conn1 := NewTestingConn()
+	client1 := NewClient(conn1)
+	nickname1 := "nick1"
+	client1.nickname = &nickname1
+	clients = make(map[*Client]struct{})
+	defer func() {
+		clients = make(map[*Client]struct{})
+	}()
+	for _, l := range []struct {
+		kind, listener string
+		registered     bool
+	}{
+		{"tls", "[::]:6697", true},
+		{"raw", "[::]:6667", true},
+		{"tls", "[::]:6697", true},
+		{"raw", "[::]:6667", false},
+		{"unix", "/run/goircd.sock", false},
+	} {
+		c := NewClient(NewTestingConn())
+		c.kind, c.listener, c.registered = l.kind, l.listener, l.registered
+		clients[c] = struct{}{}
+	}
+	SendStats(client1, "P")
+	for _, expected := range []string{
+		":foohost 249 nick1 raw [::]:6667 1 :registered clients\r\n",
+		":foohost 249 nick1 tls [::]:6697 2 :registered clients\r\n",
+		":foohost 249 nick1 unix /run/goircd.sock 0 :registered clients\r\n",
+		":foohost 219 nick1 P :End of STATS report\r\n",
+	} {
+		if r := <-conn1.outbound; r != expected {
+			t.Fatal("STATS P", r)
+		}
+	}
+}
+
+func TestCommandsUsage(t *testing.T) {
+	commandsUsed = make(map[string]uint64)
+	CountCommand("PRIVMSG")
+	CountCommand("JOIN")
+	CountCommand("PRIVMSG")
+	for i := 0; i < MaxCountedCommands; i++ {
+		CountCommand(fmt.Sprintf("FOO%d", i))
+	}
+	if len(commandsUsed) != MaxCountedCommands+1 || commandsUsed["*"] != 2 {
+		t.Fatal("commands over limit", len(commandsUsed), commandsUsed["*"])
+	}
+	usage := CommandsUsage()
+	if usage[0] != [2]string{"*", "2"} || usage[len(usage)-1] != [2]string{"PRIVMSG", "2"} {
+		t.Fatal("commands usage", usage)
+	}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	DumpStats()
+	if !strings.Contains(buf.String(), " goroutines\n") || !strings.Contains(buf.String(), " JOIN=1 PRIVMSG=2\n") {
+		t.Fatal("stats dump", buf.String())
+	}
+
+	host := "foohost"
+	hostname = &host
+	conn := NewTestingConn()
+	client := NewClient(conn)
+	nickname := "nick"
+	client.nickname = &nickname
+	SendStats(client, "m")
+	if r := <-conn.outbound; r != ":foohost 212 nick * :2\r\n" {
+		t.Fatal("STATS m", r)
+	}
+}
+
+func TestFold(t *testing.T) {
+	defer func() {
+		ascii := "ascii"
+		casemapping = &ascii
+	}()
+	if f := Fold("Nick[]\\~Ж"); f != "nick[]\\~Ж" {
+		t.Fatal("ascii casemapping", f)
+	}
+	rfc1459 := "rfc1459"
+	casemapping = &rfc1459
+	if f := Fold("Nick[]\\~Ж"); f != "nick{}|^Ж" {
+		t.Fatal("rfc1459 casemapping", f)
+	}
+}
+
+func TestWelcome(t *testing.T) {
+	empty := ""
+	defer func() {
+		network = &empty
+		welcome = &empty
+	}()
+	nickname := "nick"
+	client := NewClient(NewTestingConn())
+	client.nickname = &nickname
+	if text := WelcomeText(client); text != "Hi, welcome to IRC" {
+		t.Fatal("default welcome", text)
+	}
+	name := "Foo"
+	network = &name
+	if text := WelcomeText(client); text != "Welcome to the Foo Network, nick" {
+		t.Fatal("network welcome", text)
+	}
+	text := "Be nice"
+	welcome = &text
+	if text := WelcomeText(client); text != "Be nice" {
+		t.Fatal("custom welcome", text)
+	}
+}
+
+func TestPeaks(t *testing.T) {
+	fd, err := ioutil.TempFile("", "peaks")
+	if err != nil {
+		t.Fatalf("can not create temporary file: %v", err)
+	}
+	fd.Close()
+	defer os.Remove(fd.Name())
+	peaksName := fd.Name()
+	peaks = &peaksName
+	defer func() {
+		empty := ""
+		peaks = &empty
+	}()
+	roomsM.Lock()
+	rooms = map[string]*Room{"#foo": NewRoom("#foo"), "#bar": NewRoom("#bar")}
+	roomsM.Unlock()
+	defer func() {
+		roomsM.Lock()
+		rooms = make(map[string]*Room)
+		roomsM.Unlock()
+	}()
+	clientsM.Lock()
+	clientsOld := clients
+	clients = make(map[*Client]struct{})
+	clientsM.Unlock()
+	defer func() {
+		clientsM.Lock()
+		clients = clientsOld
+		clientsM.Unlock()
+	}()
+	maxUsers, maxChannels = 0, 0
+
+	UpdatePeaks()
+	if buf, _ := ioutil.ReadFile(peaksName); string(buf) != "0 2\n" {
+		t.Fatalf("saved peaks %q", buf)
+	}
+	roomsM.Lock()
+	delete(rooms, "#bar")
+	roomsM.Unlock()
+	UpdatePeaks()
+	maxUsers, maxChannels = 0, 0
+	LoadPeaks(peaksName)
+	if maxUsers != 0 || maxChannels != 2 {
+		t.Fatal("loaded peaks", maxUsers, maxChannels)
+	}
+
+	conn := NewTestingConn()
+	host := "foohost"
+	hostname = &host
+	client := NewClient(conn)
+	nickname := "nick"
+	client.nickname = &nickname
+	SendStats(client, "u")
+	if r := <-conn.outbound; !strings.HasPrefix(r, ":foohost 242 nick :Server Up 0 days 0:00:") {
+		t.Fatal("STATS uptime", r)
+	}
+	if r := <-conn.outbound; r != ":foohost 250 nick :Highest user count: 0, highest channel count: 2\r\n" {
+		t.Fatal("STATS peaks", r)
+	}
+	if r := <-conn.outbound; r != ":foohost 219 nick u :End of STATS report\r\n" {
+		t.Fatal("STATS end", r)
+	}
+	SendStats(client, "x")
+	if r := <-conn.outbound; r != ":foohost 219 nick x :End of STATS report\r\n" {
+		t.Fatal("unsupported STATS", r)
+	}
+}
+
+func TestAwayQueue(t *testing.T) {
+	limit := uint(2)
+	awayQueue = &limit
+	defer func() {
+		limit = 0
+	}()
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+	}()
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	go NewClient(conn1).Processor(events)
+	go NewClient(conn2).Processor(events)
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
+	for i := 0; i < 13; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+
+	conn2.inbound <- "AWAY :gone"
+	<-conn2.outbound
+	for _, text := range []string{"PRIVMSG nick2 :one", "NOTICE nick2 :notice", "PRIVMSG nick2 :two", "PRIVMSG nick2 three"} {
+		conn1.inbound <- text
+		<-conn2.outbound
+		<-conn1.outbound
+	}
+	conn2.inbound <- "AWAY"
+	if r := <-conn2.outbound; r != ":foohost 305 nick2 :You are no longer marked as being away\r\n" {
+		t.Fatal("AWAY return", r)
+	}
+	if r := <-conn2.outbound; r != ":foohost NOTICE nick2 :2 messages while you were away:\r\n" {
+		t.Fatal("away messages header", r)
+	}
+	for _, text := range []string{"two", "three"} {
+		if r := <-conn2.outbound; !strings.HasPrefix(r, ":foohost NOTICE nick2 :[") || !strings.HasSuffix(r, "] <nick1> "+text+"\r\n") {
+			t.Fatal("away message", r)
+		}
+	}
+	conn2.inbound <- "AWAY"
+	if r := <-conn2.outbound; r != ":foohost 305 nick2 :You are no longer marked as being away\r\n" {
+		t.Fatal("away messages are delivered again", r)
+	}
+}
+
+func TestCharset(t *testing.T) {
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+	}()
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	go NewClient(conn1).Processor(events)
+	go NewClient(conn2).Processor(events)
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
+	for i := 0; i < 13; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+
+	conn2.inbound <- "CHARSET"
+	if r := <-conn2.outbound; r != ":foohost NOTICE nick2 :Your charset is UTF-8\r\n" {
+		t.Fatal("CHARSET query", r)
+	}
+	conn2.inbound <- "CHARSET koi8-u"
+	if r := <-conn2.outbound; r != ":foohost NOTICE nick2 :CHARSET: Unknown charset\r\n" {
+		t.Fatal("unknown CHARSET", r)
+	}
+	conn2.inbound <- "CHARSET windows-1251"
+	if r := <-conn2.outbound; r != ":foohost NOTICE nick2 :Your charset is CP1251\r\n" {
+		t.Fatal("CHARSET", r)
+	}
+	conn1.inbound <- "PRIVMSG nick2 :Привет, €5 ♥"
+	if r := <-conn2.outbound; r != ":nick1!foo1@someclient PRIVMSG nick2 :\xcf\xf0\xe8\xe2\xe5\xf2, \x885 ?\r\n" {
+		t.Fatalf("message to legacy client %q", r)
+	}
+	conn2.inbound <- "PRIVMSG nick1 :\xcf\xf0\xe8\xe2\xe5\xf2"
+	if r := <-conn1.outbound; r != ":nick2!foo2@someclient PRIVMSG nick1 :Привет\r\n" {
+		t.Fatal("message from legacy client", r)
+	}
+	conn2.inbound <- "CHARSET utf-8"
+	if r := <-conn2.outbound; r != ":foohost NOTICE nick2 :Your charset is UTF-8\r\n" {
+		t.Fatal("CHARSET reset", r)
+	}
+	conn1.inbound <- "PRIVMSG nick2 :Привет"
+	if r := <-conn2.outbound; r != ":nick1!foo1@someclient PRIVMSG nick2 :Привет\r\n" {
+		t.Fatal("message after CHARSET reset", r)
+	}
+}
+
+func TestSajoin(t *testing.T) {
+	fd, err := ioutil.TempFile("", "opers")
+	if err != nil {
+		t.Fatalf("can not create temporary file: %v", err)
+	}
+	defer os.Remove(fd.Name())
+	fd.WriteString("admin:secret\n")
+	fd.Close()
+	operators := fd.Name()
+	opers = &operators
+	defer func() {
+		operators = ""
+	}()
+
+	logSink = make(chan LogEvent, 16)
+	stateSink = make(chan StateEvent, 8)
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+	}()
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	go NewClient(conn1).Processor(events)
+	go NewClient(conn2).Processor(events)
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
+	for i := 0; i < 13; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+
+	conn2.inbound <- "SAJOIN nick2 #foo"
+	if r := <-conn2.outbound; r != ":foohost 481 nick2 :Permission Denied- You're not an IRC operator\r\n" {
+		t.Fatal("SAJOIN by non-operator", r)
+	}
+	conn1.inbound <- "OPER admin secret"
+	<-conn1.outbound
+	<-conn1.outbound
+	conn1.inbound <- "JOIN #foo secret"
+	for i := 0; i < 4; i++ {
+		<-conn1.outbound
+	}
+	conn2.inbound <- "JOIN #foo"
+	if r := <-conn2.outbound; r != ":foohost 475 nick2 #foo :Cannot join channel (+k) - bad key\r\n" {
+		t.Fatal("JOIN without key", r)
+	}
+	conn1.inbound <- "SAJOIN nick3 #foo"
+	if r := <-conn1.outbound; r != ":foohost 401 nick1 nick3 :No such nick/channel\r\n" {
+		t.Fatal("SAJOIN of unknown client", r)
+	}
+	conn1.inbound <- "SAJOIN nick2 #foo"
+	if r := <-conn1.outbound; r != ":foohost NOTICE nick1 :nick1 used SAJOIN on nick2 for #foo\r\n" {
+		t.Fatal("SAJOIN notice", r)
+	}
+	<-conn2.outbound
+	if r := <-conn2.outbound; r != ":nick2!foo2@someclient JOIN #foo\r\n" {
+		t.Fatal("SAJOIN", r)
+	}
+	if r := <-conn1.outbound; r != ":nick2!foo2@someclient JOIN #foo\r\n" {
+		t.Fatal("SAJOIN broadcast", r)
+	}
+	<-conn2.outbound
+	<-conn2.outbound
+
+	conn1.inbound <- "SAPART nick2 #bar"
+	<-conn1.outbound
+	if r := <-conn1.outbound; r != ":foohost 403 nick1 #bar :No such channel\r\n" {
+		t.Fatal("SAPART of unknown channel", r)
+	}
+	conn1.inbound <- "SAPART nick2 #foo :go away"
+	<-conn1.outbound
+	for _, conn := range []*TestingConn{conn1, conn2} {
+		if r := <-conn.outbound; r != ":nick2!foo2@someclient PART #foo :go away\r\n" {
+			t.Fatal("SAPART", r)
+		}
+	}
+	conn1.inbound <- "SAPART nick2 #foo"
+	<-conn1.outbound
+	if r := <-conn1.outbound; r != ":foohost 441 nick1 nick2 #foo :They aren't on that channel\r\n" {
+		t.Fatal("SAPART of non-member", r)
+	}
+
+	conn2.inbound <- "JOIN #bar"
+	for i := 0; i < 4; i++ {
+		<-conn2.outbound
+	}
+	conn2.inbound <- "SAMODE #bar +k key"
+	if r := <-conn2.outbound; r != ":foohost 481 nick2 :Permission Denied- You're not an IRC operator\r\n" {
+		t.Fatal("SAMODE by non-operator", r)
+	}
+	conn1.inbound <- "MODE #bar +k key"
+	if r := <-conn1.outbound; r != ":foohost 442 #bar :You are not on that channel\r\n" {
+		t.Fatal("MODE by non-member", r)
+	}
+	conn1.inbound <- "SAMODE #bar +k key"
+	if r := <-conn1.outbound; r != ":foohost NOTICE nick1 :nick1 used SAMODE on #bar +k key\r\n" {
+		t.Fatal("SAMODE notice", r)
+	}
+	if r := <-conn2.outbound; r != ":nick1!foo1@someclient MODE #bar +k key\r\n" {
+		t.Fatal("SAMODE", r)
+	}
+
+	conn2.inbound <- "SANICK nick1 nick3"
+	if r := <-conn2.outbound; r != ":foohost 481 nick2 :Permission Denied- You're not an IRC operator\r\n" {
+		t.Fatal("SANICK by non-operator", r)
+	}
+	conn1.inbound <- "SANICK nick2 nick1"
+	if r := <-conn1.outbound; r != ":foohost 433 nick1 nick1 :Nickname is already in use\r\n" {
+		t.Fatal("SANICK to used nickname", r)
+	}
+	conn1.inbound <- "SANICK nick2 nick3"
+	<-conn1.outbound
+	if r := <-conn2.outbound; r != ":nick2!foo2@someclient NICK nick3\r\n" {
+		t.Fatal("SANICK", r)
+	}
+	conn1.inbound <- "ISON nick2 nick3"
+	if r := <-conn1.outbound; r != ":foohost 303 nick1 :nick3\r\n" {
+		t.Fatal("ISON after SANICK", r)
+	}
+}
+
+func TestOper(t *testing.T) {
+	fd, err := ioutil.TempFile("", "opers")
+	if err != nil {
+		t.Fatalf("can not create temporary file: %v", err)
+	}
+	defer os.Remove(fd.Name())
+	fd.WriteString("admin:secret\n")
+	fd.Close()
+	empty := ""
+	opers = &empty
+	defer func() {
+		opers = &empty
+	}()
+
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+	}()
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	go NewClient(conn1).Processor(events)
+	go NewClient(conn2).Processor(events)
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
+	for i := 0; i < 13; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+
+	conn1.inbound <- "OPER admin secret"
+	if r := <-conn1.outbound; r != ":foohost 491 nick1 :No O-lines for your host\r\n" {
+		t.Fatal("OPER without opers file", r)
+	}
+	operators := fd.Name()
+	opers = &operators
+	conn1.inbound <- "OPER admin wrong"
+	if r := <-conn1.outbound; r != ":foohost 464 nick1 :Password incorrect\r\n" {
+		t.Fatal("OPER with wrong password", r)
+	}
+	conn1.inbound <- "GLOBOPS :hello"
+	if r := <-conn1.outbound; r != ":foohost 481 nick1 :Permission Denied- You're not an IRC operator\r\n" {
+		t.Fatal("GLOBOPS by non-operator", r)
+	}
+	conn1.inbound <- "OPER admin secret"
+	if r := <-conn1.outbound; r != ":foohost 381 nick1 :You are now an IRC operator\r\n" {
+		t.Fatal("OPER", r)
+	}
+	if r := <-conn1.outbound; r != ":nick1 MODE nick1 :+o\r\n" {
+		t.Fatal("OPER mode", r)
+	}
+	conn1.inbound <- "GLOBOPS :hello opers"
+	if r := <-conn1.outbound; r != ":foohost NOTICE nick1 :*** Global -- from nick1: hello opers\r\n" {
+		t.Fatal("GLOBOPS", r)
+	}
+	conn1.inbound <- "BROADCAST :hello all"
+	for _, conn := range []*TestingConn{conn1, conn2} {
+		if r := <-conn.outbound; !strings.HasSuffix(r, " :*** Announcement from nick1: hello all\r\n") {
+			t.Fatal("BROADCAST", r)
+		}
+	}
+	conn2.inbound <- "WHOIS nick1"
+	<-conn2.outbound
+	<-conn2.outbound
+	if r := <-conn2.outbound; r != ":foohost 313 nick2 nick1 :is an IRC operator\r\n" {
+		t.Fatal("WHOIS of operator", r)
+	}
+	for i := 0; i < 3; i++ {
+		<-conn2.outbound
+	}
+
+	conn2.inbound <- "REHASH"
+	if r := <-conn2.outbound; r != ":foohost 481 nick2 :Permission Denied- You're not an IRC operator\r\n" {
+		t.Fatal("REHASH by non-operator", r)
+	}
+	conn1.inbound <- "REHASH"
+	if r := <-conn1.outbound; r != ":foohost 382 nick1  :Rehashing\r\n" {
+		t.Fatal("REHASH", r)
+	}
+
+	conn2.inbound <- "RESTART"
+	if r := <-conn2.outbound; r != ":foohost 481 nick2 :Permission Denied- You're not an IRC operator\r\n" {
+		t.Fatal("RESTART by non-operator", r)
+	}
+	conn1.inbound <- "RESTART"
+	if r := <-conn1.outbound; r != ":foohost NOTICE nick1 :*** Restart requested by nick1\r\n" {
+		t.Fatal("RESTART", r)
+	}
+	select {
+	case <-restartSink:
+	case <-time.After(time.Second):
+		t.Fatal("RESTART is not requested")
+	}
+
+	conn2.inbound <- "CHGHOST nick1 user vhost"
+	if r := <-conn2.outbound; r != ":foohost 481 nick2 :Permission Denied- You're not an IRC operator\r\n" {
+		t.Fatal("CHGHOST by non-operator", r)
+	}
+	conn1.inbound <- "CHGHOST nick2 user2 vhost2"
+	if r := <-conn2.outbound; r != ":foohost 396 nick2 vhost2 :is now your displayed host\r\n" {
+		t.Fatal("CHGHOST target notification", r)
+	}
+	if r := <-conn1.outbound; r != ":foohost NOTICE nick1 :Changed host of nick2 to user2@vhost2\r\n" {
+		t.Fatal("CHGHOST", r)
+	}
+	conn1.inbound <- "SETHOST nick2 bad@host"
+	if r := <-conn1.outbound; r != ":foohost NOTICE nick1 :SETHOST: Invalid hostname\r\n" {
+		t.Fatal("SETHOST with invalid host", r)
+	}
+	conn1.inbound <- "CHGHOST nick2 b@d host"
+	if r := <-conn1.outbound; r != ":foohost NOTICE nick1 :CHGHOST: Invalid username\r\n" {
+		t.Fatal("CHGHOST with invalid username", r)
+	}
+	conn1.inbound <- "SETHOST nick2 cloak.example"
+	if r := <-conn2.outbound; r != ":foohost 396 nick2 cloak.example :is now your displayed host\r\n" {
+		t.Fatal("SETHOST target notification", r)
+	}
+	if r := <-conn1.outbound; r != ":foohost NOTICE nick1 :Changed host of nick2 to user2@cloak.example\r\n" {
+		t.Fatal("SETHOST", r)
+	}
+
+	conn2.inbound <- "PRIVMSG $$* :hello"
+	if r := <-conn2.outbound; r != ":foohost 481 nick2 :Permission Denied- You're not an IRC operator\r\n" {
+		t.Fatal("server mask message by non-operator", r)
+	}
+	conn1.inbound <- "PRIVMSG $$other :hello"
+	if r := <-conn1.outbound; r != ":foohost 402 nick1 other :No such server\r\n" {
+		t.Fatal("message to other server mask", r)
+	}
+	conn1.inbound <- "PRIVMSG $$foo* :hello all"
+	if r := <-conn2.outbound; r != ":nick1!foo1@someclient PRIVMSG $$foo* :hello all\r\n" {
+		t.Fatal("server mask message", r)
+	}
+	conn1.inbound <- "NOTICE $#*.example :hello cloaked"
+	if r := <-conn2.outbound; r != ":nick1!foo1@someclient NOTICE $#*.example :hello cloaked\r\n" {
+		t.Fatal("host mask message", r)
+	}
+
+	conn2.inbound <- "TRACE"
+	if r := <-conn2.outbound; r != ":foohost 262 nick2 foohost  :End of TRACE\r\n" {
+		t.Fatal("TRACE by non-operator", r)
+	}
+	conn1.inbound <- "TRACE"
+	if r := <-conn1.outbound; r != ":foohost 204 nick1 Oper opers :nick1[someclient]\r\n" {
+		t.Fatal("TRACE operator", r)
+	}
+	if r := <-conn1.outbound; r != ":foohost 205 nick1 User users :nick2[someclient]\r\n" {
+		t.Fatal("TRACE user", r)
+	}
+	if r := <-conn1.outbound; r != ":foohost 262 nick1 foohost  :End of TRACE\r\n" {
+		t.Fatal("TRACE end", r)
+	}
+	conn1.inbound <- "TRACE nick2"
+	if r := <-conn1.outbound; r != ":foohost 205 nick1 User users :nick2[someclient]\r\n" {
+		t.Fatal("TRACE of client", r)
+	}
+	<-conn1.outbound
+	conn1.inbound <- "TRACE nick3"
+	if r := <-conn1.outbound; r != ":foohost 402 nick1 nick3 :No such server\r\n" {
+		t.Fatal("TRACE of unknown target", r)
+	}
+
+	conn2.inbound <- "CLIENTS *"
+	if r := <-conn2.outbound; r != ":foohost 481 nick2 :Permission Denied- You're not an IRC operator\r\n" {
+		t.Fatal("CLIENTS by non-operator", r)
+	}
+	conn1.inbound <- "CLIENTS *@cloak.example"
+	if r := <-conn1.outbound; r != ":foohost NOTICE nick1 :nick2!user2@cloak.example\r\n" {
+		t.Fatal("CLIENTS", r)
+	}
+	if r := <-conn1.outbound; r != ":foohost NOTICE nick1 :1 clients match *!*@cloak.example\r\n" {
+		t.Fatal("CLIENTS summary", r)
+	}
+	conn1.inbound <- "CLIENTS nick* KILL :spam wave"
+	if r := <-conn2.outbound; r != ":nick1!foo1@someclient KILL nick2 :spam wave\r\n" {
+		t.Fatal("CLIENTS KILL", r)
+	}
+	if _, open := <-conn2.outbound; open {
+		t.Fatal("killed client connection is not closed")
+	}
+	if r := <-conn1.outbound; r != ":foohost NOTICE nick1 :1 clients matching nick*!*@* killed\r\n" {
+		t.Fatal("CLIENTS KILL summary", r)
+	}
+}
+
+func TestAutojoin(t *testing.T) {
+	channels := "#lobby,#help"
+	autojoin = &channels
+	defer func() {
+		empty := ""
+		autojoin = &empty
+	}()
+	logSink = make(chan LogEvent, 8)
+	stateSink = make(chan StateEvent, 8)
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+	}()
+	conn := NewTestingConn()
+	go NewClient(conn).Processor(events)
+	conn.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	for i := 0; i < 13; i++ {
+		<-conn.outbound
+	}
+	for _, room := range []string{"#lobby", "#help"} {
+		<-conn.outbound
+		if r := <-conn.outbound; r != ":nick1!foo1@someclient JOIN "+room+"\r\n" {
+			t.Fatal("autojoin", r)
+		}
+		<-conn.outbound
+		<-conn.outbound
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	logSink = make(chan LogEvent, 16)
+	stateSink = make(chan StateEvent, 8)
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+	}()
+	register := func(nickname string) *TestingConn {
+		conn := NewTestingConn()
+		go NewClient(conn).Processor(events)
+		conn.inbound <- "CAP REQ :draft/metadata-2 standard-replies\r\nNICK " + nickname + "\r\nUSER foo bar baz :Long name\r\nCAP END"
+		for i := 0; i < 14; i++ {
+			<-conn.outbound
+		}
+		return conn
+	}
+	conn1 := register("nick1")
+	conn2 := register("nick2")
+	expect := func(conn *TestingConn, what string, replies ...string) {
+		for _, reply := range replies {
+			if r := <-conn.outbound; r != reply+"\r\n" {
+				t.Fatal(what, r)
+			}
+		}
+	}
+
+	conn1.inbound <- "METADATA * SET Avatar :http://example.com/a.png"
+	expect(conn1, "METADATA SET", ":foohost 761 nick1 nick1 avatar * :http://example.com/a.png")
+	conn1.inbound <- "METADATA * SET bad!key :foo"
+	expect(conn1, "METADATA SET of invalid key", ":foohost FAIL METADATA KEY_INVALID bad!key :Invalid key")
+	conn1.inbound <- "METADATA nick2 SET avatar :foo"
+	expect(conn1, "METADATA SET of others", ":foohost FAIL METADATA KEY_NO_PERMISSION nick2 avatar :You can not change metadata of others")
+	conn1.inbound <- "METADATA * SET avatar :" + strings.Repeat("x", MetadataMaxValueBytes+1)
+	expect(conn1, "METADATA SET of too long value", ":foohost FAIL METADATA VALUE_INVALID :Value is too long")
+	conn2.inbound <- "METADATA nick1 GET avatar display-name"
+	expect(conn2, "METADATA GET",
+		":foohost 761 nick2 nick1 avatar * :http://example.com/a.png",
+		":foohost 766 nick2 nick1 display-name :key not set",
+	)
+	conn2.inbound <- "METADATA nick3 LIST"
+	expect(conn2, "METADATA LIST of unknown", ":foohost FAIL METADATA INVALID_TARGET nick3 :Invalid target")
+	conn2.inbound <- "METADATA * FOO"
+	expect(conn2, "METADATA unknown subcommand", ":foohost FAIL METADATA SUBCOMMAND_INVALID FOO :Invalid subcommand")
+
+	conn2.inbound <- "METADATA * SUB avatar Display-Name"
+	expect(conn2, "METADATA SUB", ":foohost 770 nick2 :avatar display-name")
+	conn2.inbound <- "METADATA * SUBS"
+	expect(conn2, "METADATA SUBS", ":foohost 772 nick2 :avatar display-name")
+	conn2.inbound <- "METADATA * UNSUB display-name"
+	expect(conn2, "METADATA UNSUB", ":foohost 771 nick2 :display-name")
+
+	conn1.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn1.outbound
+	}
+	conn2.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn2.outbound
+	}
+	<-conn1.outbound
+	conn2.inbound <- "METADATA #foo SYNC"
+	expect(conn2, "METADATA SYNC", ":foohost 761 nick2 nick1 avatar * :http://example.com/a.png")
+
+	conn1.inbound <- "METADATA * SET avatar"
+	expect(conn1, "METADATA unset", ":foohost 766 nick1 nick1 avatar :key not set")
+	expect(conn2, "METADATA unset notification", ":nick1!foo@someclient METADATA nick1 avatar *")
+	conn2.inbound <- "METADATA #foo SET avatar :foo"
+	expect(conn2, "METADATA SET of room by non-operator", ":foohost FAIL METADATA KEY_NO_PERMISSION #foo * :You're not channel operator")
+	conn1.inbound <- "METADATA #foo SET avatar :http://example.com/b.png"
+	expect(conn1, "METADATA SET of room", ":foohost 761 nick1 #foo avatar * :http://example.com/b.png")
+	expect(conn2, "METADATA SET of room notification", ":nick1!foo@someclient METADATA #foo avatar * :http://example.com/b.png")
+	conn2.inbound <- "METADATA #foo LIST"
+	expect(conn2, "METADATA LIST of room", ":foohost 761 nick2 #foo avatar * :http://example.com/b.png")
+	for event := range stateSink {
+		if event.where == "#foo" && event.metadata != "" {
+			if event.metadata != "avatar http://example.com/b.png" {
+				t.Fatal("room metadata state", event.metadata)
+			}
+			break
+		}
+	}
+}
+
+func TestNewUserDelay(t *testing.T) {
+	delay := uint(60)
+	newUserDelay = &delay
+	defer func() {
+		delay := uint(0)
+		newUserDelay = &delay
+	}()
+	logSink = make(chan LogEvent, 16)
+	stateSink = make(chan StateEvent, 8)
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+	}()
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	go NewClient(conn1).Processor(events)
+	go NewClient(conn2).Processor(events)
+	conn1.inbound <- "CAP REQ standard-replies\r\nNICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\nCAP END"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
+	<-conn1.outbound
+	for i := 0; i < 13; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+
+	conn1.inbound <- "PRIVMSG nick2 :buy now"
+	if r := <-conn1.outbound; r != ":foohost FAIL PRIVMSG CANNOT_SEND nick2 :You can message only those sharing channels with you during 60 seconds after connection\r\n" {
+		t.Fatal("PRIVMSG of new user", r)
+	}
+	conn2.inbound <- "JOIN #bar"
+	for i := 0; i < 4; i++ {
+		<-conn2.outbound
+	}
+	conn2.inbound <- "PRIVMSG #bar :hello"
+	conn1.inbound <- "NOTICE #bar :buy now"
+	if r := <-conn1.outbound; r != ":foohost FAIL NOTICE CANNOT_SEND #bar :You can message only those sharing channels with you during 60 seconds after connection\r\n" {
+		t.Fatal("NOTICE of new user to channel", r)
+	}
+	conn1.inbound <- "JOIN #bar"
+	for i := 0; i < 4; i++ {
+		<-conn1.outbound
+	}
+	<-conn2.outbound
+	conn1.inbound <- "PRIVMSG nick2 :hello"
+	if r := <-conn2.outbound; r != ":nick1!foo1@someclient PRIVMSG nick2 :hello\r\n" {
+		t.Fatal("PRIVMSG of new user to member of shared channel", r)
+	}
 }
@@ -0,0 +1,88 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// How long DNSBL lookups of the connected client may take
+	DNSBLTimeout = 5 * time.Second
+)
+
+var (
+	// Resolver of DNSBL queries, replaceable in tests
+	dnsblLookup = net.DefaultResolver.LookupHost
+)
+
+// Name to look up in the DNSBL zone for the address: reversed octets
+// for IPv4 and reversed nibbles for IPv6 one.
+func DNSBLQuery(ip net.IP, zone string) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.%s", ip4[3], ip4[2], ip4[1], ip4[0], zone)
+	}
+	nibbles := make([]string, 0, 2*net.IPv6len+1)
+	for i := net.IPv6len - 1; i >= 0; i-- {
+		nibbles = append(nibbles, fmt.Sprintf("%x.%x", ip[i]&0x0f, ip[i]>>4))
+	}
+	return strings.Join(append(nibbles, zone), ".")
+}
+
+// Look the address up in all zones simultaneously. The first zone the
+// address is listed in is returned, or empty string if none.
+func DNSBLListed(ip net.IP, zones []string, timeout time.Duration) string {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	listed := make(chan string, len(zones))
+	lookup := dnsblLookup
+	for _, zone := range zones {
+		go func(zone string) {
+			if addrs, err := lookup(ctx, DNSBLQuery(ip, zone)); err == nil && len(addrs) > 0 {
+				listed <- zone
+			} else {
+				listed <- ""
+			}
+		}(zone)
+	}
+	for range zones {
+		if zone := <-listed; zone != "" {
+			return zone
+		}
+	}
+	return ""
+}
+
+// Check just connected client's address against -dnsbl zones. It does
+// not delay the client: its registration goes on meanwhile and listed
+// client is dealt with by the daemon when the answer comes.
+func CheckDNSBL(c *Client, sink chan ClientEvent) {
+	addr := c.Addr()
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return
+	}
+	if zone := DNSBLListed(ip, strings.Split(*dnsbl, ","), DNSBLTimeout); zone != "" {
+		sink <- ClientEvent{c, EventDNSBL, zone}
+	}
+}
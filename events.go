@@ -24,20 +24,31 @@ import (
 	"log"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 	"time"
 )
 
 const (
-	EventNew   = iota
-	EventDel   = iota
-	EventMsg   = iota
-	EventTopic = iota
-	EventWho   = iota
-	EventMode  = iota
-	EventTerm  = iota
-	EventTick  = iota
-	FormatMsg  = "[%s] <%s> %s\n"
-	FormatMeta = "[%s] * %s %s\n"
+	EventNew      = iota
+	EventDel      = iota
+	EventMsg      = iota
+	EventTopic    = iota
+	EventWho      = iota
+	EventMode     = iota
+	EventTerm     = iota
+	EventTick     = iota
+	EventAccess   = iota
+	EventRegister = iota
+	EventRename   = iota
+	EventEntryMsg = iota
+	EventDNSBL    = iota
+	EventStats    = iota
+	EventSamode   = iota
+	EventMetadata = iota
+	EventNick     = iota
+	FormatMsg     = "[%s] <%s> %s\n"
+	FormatMeta    = "[%s] * %s %s\n"
 )
 
 var (
@@ -54,7 +65,7 @@ type ClientEvent struct {
 }
 
 func (m ClientEvent) String() string {
-	return string(m.eventType) + ": " + m.client.String() + ": " + m.text
+	return strconv.Itoa(m.eventType) + ": " + m.client.String() + ": " + m.text
 }
 
 // Logging in-room events
@@ -69,7 +80,8 @@ type LogEvent struct {
 // Logging events logger itself
 // Each room's events are written to separate file in logdir
 // Events include messages, topic and keys changes, joining and leaving
-func Logger(logdir string, events <-chan LogEvent) {
+// Each line is prefixed with its time in the given layout
+func Logger(logdir, timeLayout string, events <-chan LogEvent) {
 	mode := os.O_CREATE | os.O_WRONLY | os.O_APPEND
 	perm := os.FileMode(0660)
 	var format string
@@ -88,7 +100,7 @@ func Logger(logdir string, events <-chan LogEvent) {
 		} else {
 			format = FormatMsg
 		}
-		_, err = fd.WriteString(fmt.Sprintf(format, time.Now(), event.who, event.what))
+		_, err = fd.WriteString(fmt.Sprintf(format, time.Now().Format(timeLayout), event.who, event.what))
 		fd.Close()
 		if err != nil {
 			log.Println("Error writing to logfile", logfile, err)
@@ -97,24 +109,77 @@ func Logger(logdir string, events <-chan LogEvent) {
 }
 
 type StateEvent struct {
-	where string
-	topic string
-	key   string
+	where   string
+	topic   string
+	key     string
+	modes   string
+	access  string
+	founder string
+	bans    string
+	quiets  string
+	entry   string
+	// Who changed the topic and the key and when, see setterState
+	topicSetter string
+	keySetter   string
+	// Metadata "key value" lines. Account metadata states, named
+	// by MetadataStateName, have nothing else
+	metadata string
+	removed  bool
 }
 
 // Room state events saver
-// Room states shows that either topic or key has been changed
-// Each room's state is written to separate file in statedir
+// Room states shows that either topic, key, modes, access list or founder has been changed
+// Each room's state is written to separate file in statedir, which is
+// removed when room's state is marked as removed
 func StateKeeper(statedir string, events <-chan StateEvent) {
 	var fn string
 	var data string
 	var err error
 	for event := range events {
 		fn = path.Join(statedir, event.where)
-		data = event.topic + "\n" + event.key + "\n"
-		err = ioutil.WriteFile(fn, []byte(data), os.FileMode(0660))
+		if event.removed {
+			if err = os.Remove(fn); err != nil && !os.IsNotExist(err) {
+				log.Printf("Can not remove statefile %s: %v", fn, err)
+			}
+			continue
+		}
+		if strings.HasPrefix(event.where, "@") {
+			data = event.metadata + "\n"
+		} else {
+			data = event.topic + "\n" + event.key + "\n" + event.modes + "\n" + event.access + "\n" + event.founder + "\n" + event.bans + "\n" + event.quiets + "\n" + event.entry + "\n" + event.topicSetter + "\n" + event.keySetter + "\n"
+			if event.metadata != "" {
+				data += event.metadata + "\n"
+			}
+		}
+		err = WriteFileAtomic(fn, []byte(data), os.FileMode(0660))
 		if err != nil {
 			log.Printf("Can not write statefile %s: %v", fn, err)
 		}
 	}
 }
+
+// Write file via synced temporary one, renamed over it, so after crash
+// it has either old or new contents, never partially written ones.
+// Temporary file name starts with "." and is not taken for room state.
+func WriteFileAtomic(fn string, data []byte, perm os.FileMode) error {
+	fd, err := ioutil.TempFile(path.Dir(fn), ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = fd.Write(data); err == nil {
+		err = fd.Sync()
+	}
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(fd.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(fd.Name(), fn)
+	}
+	if err != nil {
+		os.Remove(fd.Name())
+	}
+	return err
+}
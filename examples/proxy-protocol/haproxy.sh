@@ -26,7 +26,7 @@ listen ircd-demo
 __cfg
 }
 
-./goircd &
+./goircd -proxy 127.0.0.1 &
 trap "kill $!" EXIT 
 
 # direct connect
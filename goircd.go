@@ -20,13 +20,23 @@ package main
 
 import (
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	healthchecking "github.com/heptiolabs/healthcheck"
@@ -39,25 +49,66 @@ import (
 
 const (
 	PROXY_TIMEOUT   = 5
+	REG_TIMEOUT     = 30
 	HEALTCHECK_PORT = 8080
+	EVENTS_BUFFER   = 1024
+
+	// Environment variable with the number of listening sockets passed
+	// to the restarted process, starting from file descriptor 3
+	LISTEN_FDS_ENV = "GOIRCD_LISTEN_FDS"
+
+	ACCEPT_DELAY_MIN = 5 * time.Millisecond
+	ACCEPT_DELAY_MAX = time.Second
 )
 
 var (
 	version      string
+	buildDate    string
 	hostname     = flag.String("hostname", "localhost", "Hostname")
-	bind         = flag.String("bind", ":6667", "Address to bind to")
+	network      = flag.String("network", "", "Network name shown in welcome message and ISUPPORT")
+	serverInfo   = flag.String("serverinfo", "", "Server description shown by WHOIS, LINKS and INFO instead of hostname")
+	welcome      = flag.String("welcome", "", "Welcome message text instead of the default one")
+	bind         = flag.String("bind", ":6667", "Comma-separated addresses to bind to")
+	unixBind     = flag.String("unixbind", "", "Path to Unix domain socket to listen on")
 	motd         = flag.String("motd", "", "Path to MOTD file")
 	logdir       = flag.String("logdir", "", "Absolute path to directory for logs")
+	logTime      = flag.String("logtime", time.RFC3339, "Time layout of -logdir lines, in Go time package format")
 	statedir     = flag.String("statedir", "", "Absolute path to directory for states")
 	passwords    = flag.String("passwords", "", "Optional path to passwords file")
-	tlsBind      = flag.String("tlsbind", "", "TLS address to bind to")
+	autojoin     = flag.String("autojoin", "", "Comma-separated channels clients join after registration")
+	banner       = flag.String("banner", "", "Optional path to pre-registration notice banner file")
+	opers        = flag.String("opers", "", "Optional path to IRC operators passwords file")
+	webirc       = flag.String("webirc", "", "Optional path to trusted WEBIRC gateways passwords file")
+	peaks        = flag.String("peaks", "", "Optional path to file keeping all-time peak users and channels counts")
+	tlsBind      = flag.String("tlsbind", "", "Comma-separated TLS addresses to bind to")
 	tlsPEM       = flag.String("tlspem", "", "Path to TLS certificat+key PEM file")
 	tlsKEY       = flag.String("tlskey", "", "Path to TLS key PEM as seperate file")
 	tlsonly      = flag.Bool("tlsonly", false, "Disable listening on non tls-port")
+	proxy        = flag.String("proxy", "", "Comma-separated addresses or networks of trusted PROXY protocol upstreams")
 	proxyTimeout = flag.Uint("proxytimeout", PROXY_TIMEOUT, "Timeout when using proxy protocol")
+	regTimeout   = flag.Uint("regtimeout", REG_TIMEOUT, "Seconds unregistered client is given to complete registration")
 	metrics      = flag.Bool("metrics", false, "Enable metrics export")
 	verbose      = flag.Bool("v", false, "Enable verbose logging.")
 	healtcheck   = flag.Bool("healthcheck", false, "Enable healthcheck endpoint.")
+	floodAction  = flag.String("floodaction", "drop", "Action on exceeding +f channel limit: drop, mute or kick")
+	casemapping  = flag.String("casemapping", "ascii", "Nicknames and channels case mapping: ascii or rfc1459")
+	pingToken    = flag.String("pingtoken", "nonce", "PING argument clients have to echo in PONG: nonce or hostname")
+	chanCreate   = flag.String("chancreate", "all", "Who can create channels: all, identified or opers")
+	defChanModes = flag.String("defchanmodes", "", "Mode flags set on created channels, like +cs")
+	dnsbl        = flag.String("dnsbl", "", "Comma-separated DNS blacklist zones to check clients addresses in")
+	dnsblAction  = flag.String("dnsblaction", "reject", "Action on client listed in -dnsbl zone: reject or mark")
+	pprofBind    = flag.String("pprof", "", "Address to expose profiling endpoint on, like localhost:6060")
+	classesFile  = flag.String("classes", "", "Optional path to connection classes file")
+	aliasesFile  = flag.String("aliases", "", "Optional path to command aliases file")
+	disable      = flag.String("disable", "", "Comma-separated commands disabled for non-operators, like LIST,WHO")
+	maxClones    = flag.Uint("maxclones", 0, "Max number of registered clients from the same address, 0 is unlimited")
+	newUserDelay = flag.Uint("newuserdelay", 0, "Seconds new clients can message only those sharing channels with them, 0 disables")
+	awayQueue    = flag.Uint("awayqueue", 0, "Number of private messages kept for away clients and delivered on return")
+	runUser      = flag.String("user", "", "User to run as after listening sockets are created")
+	runGroup     = flag.String("group", "", "Group to run as instead of -user's primary one")
+	chroot       = flag.String("chroot", "", "Directory to chroot to after listening sockets are created")
+	check        = flag.Bool("check", false, "Check configuration and exit, without listening")
+	eventsBuffer = flag.Uint("eventsbuffer", EVENTS_BUFFER, "Capacity of clients events queue")
 
 	clients_tls_total = prometheus.NewCounter(
 		prometheus.CounterOpts{
@@ -87,50 +138,466 @@ var (
 			Help: "Number of connected clients.",
 		},
 	)
+
+	clients_listener_connected = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "clients_listener_connected",
+			Help: "Number of connected clients per listener.",
+		},
+		[]string{"kind", "listener"},
+	)
+
+	clients_failures_total = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "clients_failures_total",
+			Help: "Number of clients failures, like rejected nicknames or passwords, during the lifetime of the server.",
+		},
+		[]string{"reason"},
+	)
 )
 
-func listenerLoop(sock net.Listener, events chan ClientEvent) {
+// Accept connections until the listener is closed or broken. Temporary
+// errors, like file descriptors exhaustion, are retried with exponential
+// backoff. Accepted clients are assigned connection class matching the
+// kind of listener (raw, tls or unix) and their address.
+func listenerLoop(sock net.Listener, kind string, events chan ClientEvent) {
+	var delay time.Duration
 	for {
 		conn, err := sock.Accept()
-		if err != nil {
-			log.Println("Error during accepting connection", err)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if ne, ok := err.(net.Error); ok && ne.Temporary() {
+			if delay == 0 {
+				delay = ACCEPT_DELAY_MIN
+			} else if delay *= 2; delay > ACCEPT_DELAY_MAX {
+				delay = ACCEPT_DELAY_MAX
+			}
+			log.Println("Error during accepting connection, retrying in", delay, err)
+			time.Sleep(delay)
 			continue
 		}
-		client := NewClient(conn)
+		if err != nil {
+			log.Println("Can not accept connections", err)
+			return
+		}
+		delay = 0
+		client := NewClassClient(conn, ClassFor(kind, conn.RemoteAddr()))
+		client.kind = kind
+		client.listener = sock.Addr().String()
 		clients_tls_total.Inc()
 		go client.Processor(events)
 	}
 }
 
+// Listener accepting connections only from trusted PROXY protocol
+// upstreams. Others are closed at once, as they could forge the header.
+type upstreamListener struct {
+	net.Listener
+	upstreams []*net.IPNet
+}
+
+func (l *upstreamListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if UpstreamTrusted(conn.RemoteAddr(), l.upstreams) {
+			return conn, nil
+		}
+		log.Println(conn.RemoteAddr(), "is not trusted PROXY protocol upstream")
+		conn.Close()
+	}
+}
+
+// Parse comma-separated addresses and networks, like 10.0.0.1,fd00::/8.
+func ParseUpstreams(list string) ([]*net.IPNet, error) {
+	var upstreams []*net.IPNet
+	for _, upstream := range strings.Split(list, ",") {
+		if !strings.Contains(upstream, "/") {
+			if ip := net.ParseIP(upstream); ip != nil && ip.To4() != nil {
+				upstream = upstream + "/32"
+			} else {
+				upstream = upstream + "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(upstream)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, network)
+	}
+	return upstreams, nil
+}
+
+// Is connection's address within one of upstreams networks.
+func UpstreamTrusted(addr net.Addr, upstreams []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, network := range upstreams {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse the header of connections from trusted upstreams, if any.
+func proxyListener(listener net.Listener, upstreams []*net.IPNet, timeout time.Duration) net.Listener {
+	if len(upstreams) == 0 {
+		return listener
+	}
+	return &proxyproto.Listener{
+		Listener:           &upstreamListener{listener, upstreams},
+		ProxyHeaderTimeout: timeout,
+	}
+}
+
+// Listening sockets inherited from the previous process during restart
+var inherited []*os.File
+
+// Restart requests from operators, served like SIGHUP
+var restartSink = make(chan struct{}, 1)
+
+// Take listening sockets passed by the previous process or by systemd
+// socket activation, if any. They go in the same order as -bind,
+// -unixbind and -tlsbind addresses.
+func InheritListeners() {
+	n, err := strconv.Atoi(os.Getenv(LISTEN_FDS_ENV))
+	os.Unsetenv(LISTEN_FDS_ENV)
+	if err != nil && os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) {
+		n, err = strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil {
+		return
+	}
+	for fd := 3; fd < 3+n; fd++ {
+		syscall.CloseOnExec(fd)
+		inherited = append(inherited, os.NewFile(uintptr(fd), "listener"))
+	}
+}
+
+// Notify systemd about daemon's state, like "READY=1", if it is run
+// with Type=notify.
+func SdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Use next inherited listening socket or create a new one.
+func listen(network, addr string) (net.Listener, error) {
+	if len(inherited) == 0 {
+		if network == "unix" {
+			// Remove socket possibly left by previous run
+			if fi, err := os.Lstat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+				os.Remove(addr)
+			}
+		}
+		return net.Listen(network, addr)
+	}
+	f := inherited[0]
+	inherited = inherited[1:]
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// Duplicate listening sockets to be passed to the restarted process.
+// Unix domain socket file must survive closing of the listener.
+func listenerFiles(sockets []net.Listener) ([]*os.File, error) {
+	files := make([]*os.File, 0, len(sockets))
+	for _, socket := range sockets {
+		var f *os.File
+		var err error
+		switch l := socket.(type) {
+		case *net.TCPListener:
+			f, err = l.File()
+		case *net.UnixListener:
+			l.SetUnlinkOnClose(false)
+			f, err = l.File()
+		default:
+			err = errors.New("unsupported listener")
+		}
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// Execute the same binary with the same arguments, passing it listening
+// sockets. Connections waiting in their backlogs are accepted by it.
+func restart(files []*os.File) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), LISTEN_FDS_ENV+"="+strconv.Itoa(len(files)))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	// Restarted process becomes the main one for systemd
+	return SdNotify("MAINPID=" + strconv.Itoa(cmd.Process.Pid))
+}
+
+// Change root directory and drop root privileges, after privileged ports
+// are bound. User and group are looked up before chroot, while system
+// databases are still reachable.
+func DropPrivileges(username, group, root string) error {
+	uid, gid := -1, -1
+	if username != "" {
+		u, err := user.Lookup(username)
+		if err != nil {
+			return err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return err
+		}
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return err
+		}
+	}
+	if root != "" {
+		if err := syscall.Chroot(root); err != nil {
+			return err
+		}
+		if err := os.Chdir("/"); err != nil {
+			return err
+		}
+	}
+	if gid != -1 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return err
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return err
+		}
+	}
+	if uid != -1 {
+		if err := syscall.Setuid(uid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate flags values and files read during startup: enumerations,
+// absolute paths, proxy upstreams, classes and aliases files, default
+// channel modes, disabled commands and TLS certificate. It has no side effects and returns all found problems.
+func CheckConfig() (problems []error) {
+	for _, option := range []struct {
+		name, value string
+		allowed     []string
+	}{
+		{"floodaction", *floodAction, []string{"drop", "mute", "kick"}},
+		{"casemapping", *casemapping, []string{"ascii", "rfc1459"}},
+		{"pingtoken", *pingToken, []string{"nonce", "hostname"}},
+		{"chancreate", *chanCreate, []string{"all", "identified", "opers"}},
+		{"dnsblaction", *dnsblAction, []string{"reject", "mark"}},
+	} {
+		known := false
+		for _, allowed := range option.allowed {
+			known = known || option.value == allowed
+		}
+		if !known {
+			problems = append(problems, fmt.Errorf("unknown %s %s", option.name, option.value))
+		}
+	}
+	if *logdir != "" && !path.IsAbs(*logdir) {
+		problems = append(problems, errors.New("need absolute path for logdir"))
+	}
+	if *statedir != "" && !path.IsAbs(*statedir) {
+		problems = append(problems, errors.New("need absolute path for statedir"))
+	}
+	if *proxy != "" {
+		if _, err := ParseUpstreams(*proxy); err != nil {
+			problems = append(problems, fmt.Errorf("invalid proxy upstreams: %v", err))
+		}
+	}
+	if *classesFile != "" {
+		text, err := ioutil.ReadFile(*classesFile)
+		if err == nil {
+			_, err = ParseClasses(string(text))
+		}
+		if err != nil {
+			problems = append(problems, fmt.Errorf("classes file %s: %v", *classesFile, err))
+		}
+	}
+	if *aliasesFile != "" {
+		text, err := ioutil.ReadFile(*aliasesFile)
+		if err == nil {
+			_, err = ParseAliases(string(text))
+		}
+		if err != nil {
+			problems = append(problems, fmt.Errorf("aliases file %s: %v", *aliasesFile, err))
+		}
+	}
+	if err := CheckChanModes(*defChanModes); err != nil {
+		problems = append(problems, fmt.Errorf("invalid defchanmodes: %v", err))
+	}
+	if _, err := ParseDisabled(*disable); err != nil {
+		problems = append(problems, fmt.Errorf("invalid disable list: %v", err))
+	}
+	if *tlsBind != "" {
+		key := *tlsKEY
+		if key == "" {
+			key = *tlsPEM
+		}
+		if _, err := tls.LoadX509KeyPair(*tlsPEM, key); err != nil {
+			problems = append(problems, fmt.Errorf("can not load TLS certificate and key from %s and %s: %v", *tlsPEM, key, err))
+		}
+	}
+	return
+}
+
+// Check that login:password file is readable and every its non-empty
+// line has login and colon.
+func CheckCredentials(fn string) error {
+	contents, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	for n, entry := range strings.Split(string(contents), "\n") {
+		if entry != "" && strings.Index(entry, ":") < 1 {
+			return fmt.Errorf("line %d: expected login:password", n+1)
+		}
+	}
+	return nil
+}
+
+// Validate files and directories read after startup, as -check does:
+// passwords, opers, webirc, motd and banner files and logdir and
+// statedir directories. Paths are taken relative to -chroot, if any.
+func CheckFiles() (problems []error) {
+	for _, dir := range []struct{ name, path string }{
+		{"logdir", *logdir},
+		{"statedir", *statedir},
+	} {
+		// Relative paths are already reported by CheckConfig
+		if dir.path == "" || !path.IsAbs(dir.path) {
+			continue
+		}
+		if fi, err := os.Stat(filepath.Join(*chroot, dir.path)); err != nil {
+			problems = append(problems, fmt.Errorf("%s: %v", dir.name, err))
+		} else if !fi.IsDir() {
+			problems = append(problems, fmt.Errorf("%s %s is not a directory", dir.name, dir.path))
+		}
+	}
+	for _, file := range []struct {
+		name, path  string
+		credentials bool
+	}{
+		{"passwords", *passwords, true},
+		{"opers", *opers, true},
+		{"webirc", *webirc, true},
+		{"motd", *motd, false},
+		{"banner", *banner, false},
+	} {
+		if file.path == "" {
+			continue
+		}
+		fn := filepath.Join(*chroot, file.path)
+		var err error
+		if file.credentials {
+			err = CheckCredentials(fn)
+		} else {
+			_, err = ioutil.ReadFile(fn)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%s file %s: %v", file.name, file.path, err))
+		}
+	}
+	return
+}
+
 func Run() {
-	events := make(chan ClientEvent)
+	events := make(chan ClientEvent, *eventsBuffer)
 	log.SetFlags(log.Ldate | log.Lmicroseconds | log.Lshortfile)
 
+	// Logger and statekeeper are waited for during shutdown, to write
+	// all pending events
+	var sinksGroup sync.WaitGroup
+	sinksGroup.Add(2)
+	if problems := CheckConfig(); len(problems) > 0 {
+		for _, problem := range problems {
+			log.Println(problem)
+		}
+		log.Fatalln("Invalid configuration")
+	}
 	if *logdir == "" {
 		// Dummy logger
 		go func() {
 			for _ = range logSink {
 			}
+			sinksGroup.Done()
 		}()
 	} else {
-		if !path.IsAbs(*logdir) {
-			log.Fatalln("Need absolute path for logdir")
-		}
-		go Logger(*logdir, logSink)
+		go func() {
+			Logger(*logdir, *logTime, logSink)
+			sinksGroup.Done()
+		}()
 		log.Println(*logdir, "logger initialized")
 	}
 
 	log.Println("goircd " + version + " is starting")
+	if *classesFile != "" {
+		if err := LoadClasses(*classesFile); err != nil {
+			log.Fatalf("Can not load classes file %s: %v", *classesFile, err)
+		}
+	}
+	if *aliasesFile != "" {
+		if err := LoadAliases(*aliasesFile); err != nil {
+			log.Fatalf("Can not load aliases file %s: %v", *aliasesFile, err)
+		}
+	}
+	disabledCommands, _ = ParseDisabled(*disable)
+	if err := LoadMotd(); err != nil {
+		log.Printf("Can not read motd file %s: %v", *motd, err)
+	}
+	if *peaks != "" {
+		LoadPeaks(*peaks)
+	}
 	if *statedir == "" {
 		// Dummy statekeeper
 		go func() {
 			for _ = range stateSink {
 			}
+			sinksGroup.Done()
 		}()
 	} else {
-		if !path.IsAbs(*statedir) {
-			log.Fatalln("Need absolute path for statedir")
-		}
 		states, err := filepath.Glob(path.Join(*statedir, "#*"))
 		if err != nil {
 			log.Fatalln("Can not read statedir", err)
@@ -141,31 +608,106 @@ func Run() {
 				log.Fatalf("Can not read state %s: %v", state, err)
 			}
 			room, _ := RoomRegister(path.Base(state))
+			room.restored = true
 			contents := strings.Split(string(buf), "\n")
 			if len(contents) < 2 {
 				log.Printf("State corrupted for %s: %q", *room.name, contents)
 			} else {
 				room.topic = &contents[0]
 				room.key = &contents[1]
+				if len(contents) > 2 {
+					room.RestoreModes(contents[2])
+				}
+				if len(contents) > 3 {
+					room.RestoreAccess(contents[3])
+				}
+				if len(contents) > 4 && contents[4] != "" {
+					room.founder = &contents[4]
+				}
+				if len(contents) > 5 {
+					RestoreMasks(room.bans, contents[5])
+				}
+				if len(contents) > 6 {
+					RestoreMasks(room.quiets, contents[6])
+				}
+				if len(contents) > 7 {
+					room.entryMsg = contents[7]
+				}
+				if len(contents) > 8 {
+					room.topicWho, room.topicSet = RestoreSetter(contents[8])
+				}
+				if len(contents) > 9 {
+					room.keyWho, room.keySet = RestoreSetter(contents[9])
+				}
+				if len(contents) > 10 {
+					RestoreMetadata(room.metadata, contents[10:])
+				}
 				log.Println("Loaded state for room", *room.name)
 			}
 		}
-		go StateKeeper(*statedir, stateSink)
+		states, err = filepath.Glob(path.Join(*statedir, "@*"))
+		if err != nil {
+			log.Fatalln("Can not read statedir", err)
+		}
+		for _, state := range states {
+			account, ok := MetadataStateAccount(path.Base(state))
+			if !ok {
+				continue
+			}
+			buf, err := ioutil.ReadFile(state)
+			if err != nil {
+				log.Fatalf("Can not read state %s: %v", state, err)
+			}
+			metadata := make(map[string]string)
+			RestoreMetadata(metadata, strings.Split(string(buf), "\n"))
+			accountsMetadata[account] = metadata
+			log.Println("Loaded metadata for account", account)
+		}
+		go func() {
+			StateKeeper(*statedir, stateSink)
+			sinksGroup.Done()
+		}()
 		log.Println(*statedir, "statekeeper initialized")
 	}
 
 	proxyTimeout := time.Duration(uint(*proxyTimeout)) * time.Second
+	var upstreams []*net.IPNet
+	if *proxy != "" {
+		var err error
+		if upstreams, err = ParseUpstreams(*proxy); err != nil {
+			log.Fatalln("Invalid proxy upstreams", err)
+		}
+	}
+	InheritListeners()
+	// Listeners are closed during shutdown, while underlying sockets are
+	// passed to the restarted process
+	var listeners []net.Listener
+	var sockets []net.Listener
 
 	if *bind != "" && !*tlsonly {
-		listener, err := net.Listen("tcp", *bind)
-		if err != nil {
-			log.Fatalf("Can not listen on %s: %v", *bind, err)
+		for _, addr := range strings.Split(*bind, ",") {
+			listener, err := listen("tcp", addr)
+			if err != nil {
+				log.Fatalf("Can not listen on %s: %v", addr, err)
+			}
+			sockets = append(sockets, listener)
+			listener = proxyListener(listener, upstreams, proxyTimeout)
+
+			log.Println("Raw listening on", addr)
+			listeners = append(listeners, listener)
+			go listenerLoop(listener, "raw", events)
 		}
-		// Add PROXY-Protocol support
-		listener = &proxyproto.Listener{Listener: listener, ProxyHeaderTimeout: proxyTimeout}
+	}
 
-		log.Println("Raw listening on", *bind)
-		go listenerLoop(listener, events)
+	if *unixBind != "" {
+		listener, err := listen("unix", *unixBind)
+		if err != nil {
+			log.Fatalf("Can not listen on %s: %v", *unixBind, err)
+		}
+		sockets = append(sockets, listener)
+		log.Println("Unix socket listening on", *unixBind)
+		listeners = append(listeners, listener)
+		go listenerLoop(listener, "unix", events)
 	}
 
 	if *tlsBind != "" {
@@ -176,23 +718,32 @@ func Run() {
 		cert, err := tls.LoadX509KeyPair(*tlsPEM, *tlsKEY)
 
 		if err != nil {
-			log.Fatalf("Could not load Certificate and TLS keys from %s: %s", *tlsPEM, *tlsKEY, err)
+			log.Fatalf("Could not load Certificate and TLS keys from %s and %s: %v", *tlsPEM, *tlsKEY, err)
 		}
 		config := tls.Config{Certificates: []tls.Certificate{cert}}
 
-		listenerTLS, err := net.Listen("tcp", *tlsBind)
-		if err != nil {
-			log.Fatalf("Can not listen on %s: %v", *tlsBind, err)
-		}
-		log.Println("TLS listening on", *tlsBind)
+		for _, addr := range strings.Split(*tlsBind, ",") {
+			listenerTLS, err := listen("tcp", addr)
+			if err != nil {
+				log.Fatalf("Can not listen on %s: %v", addr, err)
+			}
+			sockets = append(sockets, listenerTLS)
+			log.Println("TLS listening on", addr)
 
-		// Add PROXY-Protocol support
+			listenerTLS = proxyListener(listenerTLS, upstreams, proxyTimeout)
 
-		listenerTLS = &proxyproto.Listener{Listener: listenerTLS, ProxyHeaderTimeout: proxyTimeout}
+			listenerTLS = tls.NewListener(listenerTLS, &config)
 
-		listenerTLS = tls.NewListener(listenerTLS, &config)
+			listeners = append(listeners, listenerTLS)
+			go listenerLoop(listenerTLS, "tls", events)
+		}
+	}
 
-		go listenerLoop(listenerTLS, events)
+	if *runUser != "" || *runGroup != "" || *chroot != "" {
+		if err := DropPrivileges(*runUser, *runGroup, *chroot); err != nil {
+			log.Fatalln("Can not drop privileges", err)
+		}
+		log.Printf("Dropped privileges to uid %d, gid %d, root %q", os.Getuid(), os.Getgid(), *chroot)
 	}
 
 	// Create endpoint for prometheus metrics export
@@ -202,8 +753,69 @@ func Run() {
 	if *healtcheck {
 		go health_endpoint()
 	}
+	if *pprofBind != "" {
+		go pprof_endpoint()
+	}
 
-	Processor(events, make(chan struct{}))
+	// Stop accepting new clients on termination signal and let daemon
+	// process already queued events. On SIGHUP or operator's RESTART
+	// listening sockets are kept open for the restarted process
+	var restartFiles []*os.File
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+		for {
+			var sig os.Signal
+			select {
+			case sig = <-signals:
+			case <-restartSink:
+				sig = syscall.SIGHUP
+			}
+			if sig != syscall.SIGHUP {
+				log.Println("Got", sig, "signal, shutting down")
+				SdNotify("STOPPING=1")
+				break
+			}
+			files, err := listenerFiles(sockets)
+			if err != nil {
+				log.Println("Can not restart", err)
+				continue
+			}
+			log.Println("Restarting")
+			SdNotify("RELOADING=1")
+			restartFiles = files
+			break
+		}
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		events <- ClientEvent{eventType: EventTerm}
+	}()
+
+	// Dump statistics to the log on demand
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGUSR1)
+		for range signals {
+			events <- ClientEvent{eventType: EventStats}
+		}
+	}()
+
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	if err := SdNotify("READY=1"); err != nil {
+		log.Println("Can not notify systemd", err)
+	}
+	<-finished
+	close(logSink)
+	close(stateSink)
+	sinksGroup.Wait()
+	if restartFiles != nil {
+		if err := restart(restartFiles); err != nil {
+			log.Fatalln("Can not restart", err)
+		}
+	}
+	log.Println("goircd is terminated")
 }
 
 func health_endpoint() {
@@ -221,12 +833,38 @@ func prom_export() {
 	prometheus.MustRegister(clients_irc_total)
 	prometheus.MustRegister(clients_irc_rooms_total)
 	prometheus.MustRegister(clients_connected)
+	prometheus.MustRegister(clients_listener_connected)
+	prometheus.MustRegister(clients_failures_total)
 
-	http.Handle("/metrics", promhttp.Handler())
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	// Own mux, not to expose profiling handlers together with metrics
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Fatal(http.ListenAndServe(":8080", mux))
+}
+
+func pprof_endpoint() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	log.Printf("Profiling listening on http://%s/debug/pprof/", *pprofBind)
+	log.Fatal(http.ListenAndServe(*pprofBind, mux))
 }
 
 func main() {
 	flag.Parse()
+	if *check {
+		problems := append(CheckConfig(), CheckFiles()...)
+		for _, problem := range problems {
+			log.Println(problem)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		log.Println("Configuration is valid")
+		return
+	}
 	Run()
 }
@@ -0,0 +1,82 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"strings"
+)
+
+// Max number of parameters of a message, the last one is always
+// considered trailing, even without ":"
+const MaxParams = 15
+
+// IRC message without tags: optional prefix, upper cased command and
+// parameters. The last parameter is trailing one, that may be empty or
+// have spaces, if it was given after ":".
+type Message struct {
+	prefix   string
+	command  string
+	params   []string
+	trailing bool
+}
+
+// Tokenize the line into prefix, command and parameters. Any number of
+// spaces separates them. Line without command, like empty or
+// prefix-only one, has empty command.
+func ParseMessage(line string) (msg Message) {
+	line = strings.TrimLeft(line, " ")
+	if strings.HasPrefix(line, ":") {
+		i := strings.IndexByte(line, ' ')
+		if i == -1 {
+			msg.prefix = line[1:]
+			return
+		}
+		msg.prefix, line = line[1:i], strings.TrimLeft(line[i:], " ")
+	}
+	if strings.HasPrefix(line, ":") {
+		return
+	}
+	for line != "" {
+		if msg.command != "" && (line[0] == ':' || len(msg.params) == MaxParams-1) {
+			msg.params = append(msg.params, strings.TrimPrefix(line, ":"))
+			msg.trailing = true
+			break
+		}
+		i := strings.IndexByte(line, ' ')
+		if i == -1 {
+			i = len(line)
+		}
+		if msg.command == "" {
+			msg.command = strings.ToUpper(line[:i])
+		} else {
+			msg.params = append(msg.params, line[:i])
+		}
+		line = strings.TrimLeft(line[i:], " ")
+	}
+	return
+}
+
+// Parameters joined back by single spaces, with ":" before trailing one.
+func (msg Message) Params() string {
+	params := append([]string{}, msg.params...)
+	if msg.trailing {
+		params[len(params)-1] = ":" + params[len(params)-1]
+	}
+	return strings.Join(params, " ")
+}
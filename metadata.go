@@ -0,0 +1,356 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// IRCv3 draft/metadata-2: public key-value metadata of clients and rooms
+const (
+	MetadataCap           = "draft/metadata-2"
+	MetadataMaxSubs       = 50
+	MetadataMaxKeys       = 20
+	MetadataMaxValueBytes = 300
+)
+
+var (
+	REMetadataKey = regexp.MustCompile("^[a-z0-9_./:-]{1,64}$")
+	// Metadata of accounts, folded, shared by their sessions. It is
+	// accessed by Daemon only
+	accountsMetadata = make(map[string]map[string]string)
+)
+
+// Client's own metadata: its account's one if it is identified, nil
+// if nothing was set yet. Only Daemon accesses it.
+func (c *Client) Metadata() map[string]string {
+	if c.account != nil {
+		return accountsMetadata[Fold(*c.account)]
+	}
+	return c.metadata
+}
+
+// Has the client subscribed to metadata key changes.
+func (c *Client) MetadataSubscribed(key string) bool {
+	c.Lock()
+	defer c.Unlock()
+	_, subscribed := c.metadataSubs[key]
+	return subscribed
+}
+
+// Metadata keys and values as "key value" lines, sorted by keys. That
+// is how they are kept in state files.
+func metadataState(metadata map[string]string) string {
+	entries := make([]string, 0, len(metadata))
+	for key, value := range metadata {
+		entries = append(entries, key+" "+value)
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, "\n")
+}
+
+// Restore metadata saved by metadataState, skipping malformed lines.
+func RestoreMetadata(metadata map[string]string, lines []string) {
+	for _, line := range lines {
+		if cols := strings.SplitN(line, " ", 2); len(cols) == 2 && REMetadataKey.MatchString(cols[0]) {
+			metadata[cols[0]] = cols[1]
+		}
+	}
+}
+
+// State file name of the account metadata. It can not be taken for
+// room's one and has no path separators.
+func MetadataStateName(account string) string {
+	return "@" + url.PathEscape(Fold(account))
+}
+
+// Account name of the metadata state file named by MetadataStateName.
+func MetadataStateAccount(name string) (string, bool) {
+	account, err := url.PathUnescape(strings.TrimPrefix(name, "@"))
+	return account, err == nil && strings.HasPrefix(name, "@")
+}
+
+// Send RPL_KEYVALUE reply, or RPL_KEYNOTSET if value is not set.
+func replyKeyValue(client *Client, target, key, value string, set bool) {
+	if set {
+		client.ReplyNicknamed("761", target, key, "*", value)
+	} else {
+		client.ReplyNicknamed("766", target, key, "key not set")
+	}
+}
+
+// METADATA notification of changed value, without value if it is unset.
+func metadataLine(source, target, key, value string, set bool) string {
+	if set {
+		return fmt.Sprintf(":%s METADATA %s %s * :%s", source, target, key, value)
+	}
+	return fmt.Sprintf(":%s METADATA %s %s *", source, target, key)
+}
+
+// Change or unset the client's own metadata key and notify subscribed
+// clients sharing rooms with it.
+func SetClientMetadata(client *Client, key, value string) {
+	metadata := client.Metadata()
+	if metadata == nil {
+		metadata = make(map[string]string)
+		if client.account != nil {
+			accountsMetadata[Fold(*client.account)] = metadata
+		} else {
+			client.metadata = metadata
+		}
+	}
+	if value == "" {
+		delete(metadata, key)
+	} else {
+		metadata[key] = value
+	}
+	replyKeyValue(client, *client.nickname, key, value, value != "")
+	line := metadataLine(client.String(), *client.nickname, key, value, value != "")
+	for c := range SharedClients(client) {
+		if c != client && c.HasCap(MetadataCap) && c.MetadataSubscribed(key) {
+			c.Relay(line)
+		}
+	}
+	if client.account == nil {
+		return
+	}
+	if len(metadata) == 0 {
+		stateSink <- StateEvent{where: MetadataStateName(*client.account), removed: true}
+	} else {
+		stateSink <- StateEvent{where: MetadataStateName(*client.account), metadata: metadataState(metadata)}
+	}
+}
+
+// METADATA command: GET, LIST, SET and CLEAR metadata of the client
+// itself (* target), another client or a room, SUB, UNSUB and SUBS to
+// manage keys subscriptions and SYNC to get subscribed keys of the
+// target, like just joined room and its members.
+func HandlerMetadata(client *Client, cols []string) {
+	var params []string
+	if len(cols) > 1 {
+		params = ParseMessage("METADATA " + cols[1]).params
+	}
+	if len(params) < 2 {
+		client.ReplyFail("METADATA", "NEED_MORE_PARAMS", "Missing parameters")
+		return
+	}
+	target, subcmd, args := params[0], strings.ToUpper(params[1]), params[2:]
+	switch subcmd {
+	case "SUB", "UNSUB", "SUBS":
+		HandlerMetadataSubs(client, subcmd, args)
+		return
+	case "GET", "LIST", "SET", "CLEAR", "SYNC":
+	default:
+		client.ReplyFail("METADATA", "SUBCOMMAND_INVALID", params[1], "Invalid subcommand")
+		return
+	}
+	if target == "*" {
+		target = *client.nickname
+	}
+	if subcmd == "GET" || subcmd == "SET" {
+		if len(args) == 0 {
+			client.ReplyFail("METADATA", "NEED_MORE_PARAMS", "Missing parameters")
+			return
+		}
+		for i, key := range args {
+			if subcmd == "SET" && i > 0 {
+				break
+			}
+			if !REMetadataKey.MatchString(strings.ToLower(key)) {
+				client.ReplyFail("METADATA", "KEY_INVALID", key, "Invalid key")
+				return
+			}
+			args[i] = strings.ToLower(key)
+		}
+	}
+	var value string
+	if subcmd == "SET" && len(args) > 1 {
+		value = args[1]
+		if len(value) > MetadataMaxValueBytes {
+			client.ReplyFail("METADATA", "VALUE_INVALID", "Value is too long")
+			return
+		}
+	}
+
+	if strings.HasPrefix(target, "#") {
+		roomsM.RLock()
+		r, found := GetRoom(target)
+		if !found || r.Hidden(client) {
+			roomsM.RUnlock()
+			client.ReplyFail("METADATA", "INVALID_TARGET", target, "Invalid target")
+			return
+		}
+		switch subcmd {
+		case "SET":
+			roomSinks[r] <- ClientEvent{client, EventMetadata, args[0] + " " + value}
+		case "CLEAR":
+			roomSinks[r] <- ClientEvent{client, EventMetadata, ""}
+		case "SYNC":
+			SyncMetadata(client, r)
+		default:
+			name := r.String()
+			r.RLock()
+			sendMetadata(client, name, r.metadata, args)
+			r.RUnlock()
+		}
+		roomsM.RUnlock()
+		return
+	}
+
+	c := FindClient(target)
+	if c == nil {
+		client.ReplyFail("METADATA", "INVALID_TARGET", target, "Invalid target")
+		return
+	}
+	switch subcmd {
+	case "SET":
+		if c != client {
+			client.ReplyFail("METADATA", "KEY_NO_PERMISSION", target, args[0], "You can not change metadata of others")
+			return
+		}
+		if _, set := c.Metadata()[args[0]]; !set && value != "" && len(c.Metadata()) >= MetadataMaxKeys {
+			client.ReplyFail("METADATA", "LIMIT_REACHED", target, "Metadata limit reached")
+			return
+		}
+		SetClientMetadata(client, args[0], value)
+	case "CLEAR":
+		if c != client {
+			client.ReplyFail("METADATA", "KEY_NO_PERMISSION", target, "*", "You can not change metadata of others")
+			return
+		}
+		keys := make([]string, 0, len(c.Metadata()))
+		for key := range c.Metadata() {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			SetClientMetadata(client, key, "")
+		}
+	case "SYNC":
+		syncClientMetadata(client, c)
+	default:
+		sendMetadata(client, *c.nickname, c.Metadata(), args)
+	}
+}
+
+// Reply with given keys values, or all of them if no keys are given.
+func sendMetadata(client *Client, target string, metadata map[string]string, keys []string) {
+	if len(keys) == 0 {
+		for key := range metadata {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+	}
+	for _, key := range keys {
+		value, set := metadata[key]
+		replyKeyValue(client, target, key, value, set)
+	}
+}
+
+// Send subscribed keys of the room and of all its members.
+func SyncMetadata(client *Client, r *Room) {
+	name := r.String()
+	r.RLock()
+	for _, key := range client.MetadataSubs() {
+		if value, set := r.metadata[key]; set {
+			replyKeyValue(client, name, key, value, true)
+		}
+	}
+	members := make([]*Client, 0, len(r.members))
+	for member := range r.members {
+		members = append(members, member)
+	}
+	r.RUnlock()
+	for _, member := range members {
+		syncClientMetadata(client, member)
+	}
+}
+
+func syncClientMetadata(client, c *Client) {
+	metadata := c.Metadata()
+	for _, key := range client.MetadataSubs() {
+		if value, set := metadata[key]; set {
+			replyKeyValue(client, *c.nickname, key, value, true)
+		}
+	}
+}
+
+// Subscribed keys, sorted.
+func (c *Client) MetadataSubs() []string {
+	c.Lock()
+	keys := make([]string, 0, len(c.metadataSubs))
+	for key := range c.metadataSubs {
+		keys = append(keys, key)
+	}
+	c.Unlock()
+	sort.Strings(keys)
+	return keys
+}
+
+func HandlerMetadataSubs(client *Client, subcmd string, keys []string) {
+	if subcmd == "SUBS" {
+		if subs := client.MetadataSubs(); len(subs) > 0 {
+			client.ReplyNicknamed("772", strings.Join(subs, " "))
+		}
+		return
+	}
+	if len(keys) == 0 {
+		client.ReplyFail("METADATA", "NEED_MORE_PARAMS", "Missing parameters")
+		return
+	}
+	var changed []string
+	for _, key := range keys {
+		key = strings.ToLower(key)
+		if !REMetadataKey.MatchString(key) {
+			client.ReplyFail("METADATA", "KEY_INVALID", key, "Invalid key")
+			continue
+		}
+		client.Lock()
+		if client.metadataSubs == nil {
+			client.metadataSubs = make(map[string]struct{})
+		}
+		_, subscribed := client.metadataSubs[key]
+		full := subcmd == "SUB" && !subscribed && len(client.metadataSubs) >= MetadataMaxSubs
+		switch {
+		case full:
+		case subcmd == "SUB":
+			client.metadataSubs[key] = struct{}{}
+		default:
+			delete(client.metadataSubs, key)
+		}
+		client.Unlock()
+		if full {
+			client.ReplyFail("METADATA", "TOO_MANY_SUBS", key, "Too many subscriptions")
+			break
+		}
+		changed = append(changed, key)
+	}
+	if len(changed) == 0 {
+		return
+	}
+	if subcmd == "SUB" {
+		client.ReplyNicknamed("770", strings.Join(changed, " "))
+	} else {
+		client.ReplyNicknamed("771", strings.Join(changed, " "))
+	}
+}
@@ -23,25 +23,99 @@ import (
 	"log"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+)
+
+const (
+	// Max length of the channel name, including "#"
+	ChannelLen = 50
+	// Max length of the channel key
+	KeyLen = 23
 )
 
 var (
-	RERoom = regexp.MustCompile("^#[^\x00\x07\x0a\x0d ,:/]{1,200}$")
+	// No control characters, spaces, commas, colons and slashes
+	RERoom = regexp.MustCompile(fmt.Sprintf("^#[^\x00-\x20\x7f,:/]{1,%d}$", ChannelLen-1))
+	// No control characters, spaces and commas
+	REKey = regexp.MustCompile(fmt.Sprintf("^[^\x00-\x20\x7f,]{1,%d}$", KeyLen))
+	// Channel modes without arguments and their descriptions for logging
+	RoomFlagModes = map[byte]string{
+		'c': "colours stripping",
+		'r': "registered users only",
+		's': "secret channel",
+	}
+	// Extended ban types: $a:account and $r:realname masks
+	ExtbanTypes = "ar"
+	// +f flood mode argument: lines:seconds
+	REFlood = regexp.MustCompile("^[1-9][0-9]{0,3}:[1-9][0-9]{0,3}$")
+	// mIRC colour codes with their optional foreground,background digits,
+	// hex colour codes and the bold, italic, underline, strikethrough,
+	// monospace, reverse and reset toggles
+	REFormatting = regexp.MustCompile("\x03(\\d{1,2}(,\\d{1,2})?)?|\x04([0-9a-fA-F]{6}(,[0-9a-fA-F]{6})?)?|[\x02\x0f\x11\x16\x1d\x1e\x1f]")
 )
 
-// Sanitize room's name. It can consist of 1 to 50 ASCII symbols
+// Sanitize room's name. It can consist of up to ChannelLen symbols
 // with some exclusions. All room names will have "#" prefix.
 func RoomNameValid(name string) bool {
 	return RERoom.MatchString(name)
 }
 
+// Sanitize room's key. It can consist of up to KeyLen symbols
+// with some exclusions.
+func KeyValid(key string) bool {
+	return REKey.MatchString(key)
+}
+
+// Remove colour and formatting control codes from the text.
+func StripFormatting(text string) string {
+	return REFormatting.ReplaceAllString(text, "")
+}
+
 type Room struct {
 	name    *string
 	topic   *string
 	key     *string
+	modes   map[byte]string
 	members map[*Client]struct{}
+	ops     map[*Client]struct{}
+	voiced  map[*Client]struct{}
+	// Formatted NAMES list, nil until it is requested after members,
+	// their statuses or nicknames have changed
+	names *string
+	// Modes automatically granted on join: account name or
+	// nick!user@host mask to either "o" or "v"
+	access map[string]string
+	// Ban masks: nick!user@host wildcards or extbans, like $a:account
+	bans map[string]struct{}
+	// Quiet masks, same as bans, but only forbidding sending messages
+	quiets map[string]struct{}
+	// Notice sent to each joining client, set via ChanServ
+	entryMsg string
+	// Public metadata keys and values, set via METADATA
+	metadata map[string]string
+	// Account of the founder who registered the room via ChanServ
+	founder *string
+	// Room was loaded from statedir
+	restored bool
+	// When the room was formed and its topic was changed the last time,
+	// zero if it never was
+	created  time.Time
+	topicSet time.Time
+	// Who changed the topic and the key the last time, as
+	// nick!user@host, and when the key was changed
+	topicWho string
+	keyWho   string
+	keySet   time.Time
+	// Client whose event is being processed. Only replies to it may
+	// belong to its labeled command
+	current *Client
+	// Recent messages times of each member, used by +f
+	floodStamps map[*Client][]time.Time
+	// Members muted by +f until specified time
+	muted map[*Client]time.Time
 	sync.RWMutex
 }
 
@@ -59,53 +133,495 @@ func NewRoom(name string) *Room {
 		name:    &name,
 		topic:   &topic,
 		key:     &key,
+		modes:   make(map[byte]string),
 		members: make(map[*Client]struct{}),
+		ops:     make(map[*Client]struct{}),
+		voiced:  make(map[*Client]struct{}),
+		access:  make(map[string]string),
+		bans:    make(map[string]struct{}),
+		quiets:  make(map[string]struct{}),
+
+		metadata:    make(map[string]string),
+		floodStamps: make(map[*Client][]time.Time),
+		muted:       make(map[*Client]time.Time),
+		created:     time.Now(),
 	}
 }
 
 func (room *Room) Match(other string) bool {
-	return strings.ToLower(*room.name) == strings.ToLower(other)
+	return Fold(*room.name) == Fold(other)
+}
+
+// Channel mode string, like "+cfk 5:10". The key value itself is not included.
+func (room *Room) ModeString() string {
+	modes := strings.SplitN(room.modesState(), " ", 2)
+	mode := "+" + modes[0]
+	if *room.key != "" {
+		mode = mode + "k"
+	}
+	if len(modes) > 1 {
+		mode = mode + " " + modes[1]
+	}
+	return mode
+}
+
+// Sorted letters of set modes, without the key, followed by their
+// arguments, like "cf 5:10". That is how they are kept in state files.
+func (room *Room) modesState() string {
+	flags := make([]string, 0, len(room.modes))
+	for m := range room.modes {
+		flags = append(flags, string(m))
+	}
+	sort.Strings(flags)
+	args := []string{strings.Join(flags, "")}
+	for _, m := range flags {
+		if arg := room.modes[m[0]]; arg != "" {
+			args = append(args, arg)
+		}
+	}
+	return strings.Join(args, " ")
+}
+
+// Restore modes saved by modesState.
+func (room *Room) RestoreModes(state string) {
+	args := strings.Split(state, " ")
+	for _, m := range []byte(args[0]) {
+		if _, flag := RoomFlagModes[m]; flag {
+			room.modes[m] = ""
+		} else if len(args) > 1 {
+			room.modes[m] = args[1]
+			args = args[1:]
+		}
+	}
+}
+
+// Check -defchanmodes value: mode flags, like "+cs", without arguments.
+func CheckChanModes(modes string) error {
+	for _, m := range []byte(strings.TrimPrefix(modes, "+")) {
+		if _, flag := RoomFlagModes[m]; !flag {
+			return fmt.Errorf("unknown channel mode flag %q", m)
+		}
+	}
+	return nil
+}
+
+// Set -defchanmodes mode flags on just created room.
+func (room *Room) SetDefaultModes() {
+	room.Lock()
+	for _, m := range []byte(strings.TrimPrefix(*defChanModes, "+")) {
+		room.modes[m] = ""
+	}
+	room.Unlock()
+}
+
+// Is the given mode flag set on the room.
+func (room *Room) HasMode(mode byte) bool {
+	room.RLock()
+	_, set := room.modes[mode]
+	room.RUnlock()
+	return set
+}
+
+// Is the room secret for the client, not its member nor an operator.
+func (room *Room) Hidden(client *Client) bool {
+	room.RLock()
+	defer room.RUnlock()
+	_, secret := room.modes['s']
+	_, member := room.members[client]
+	return secret && !member && !client.HasMode('o')
+}
+
+// Parse +f lines:seconds limit, if it is set.
+func (room *Room) floodLimit() (lines int, period time.Duration, set bool) {
+	room.RLock()
+	limit, set := room.modes['f']
+	room.RUnlock()
+	if !set {
+		return
+	}
+	cols := strings.Split(limit, ":")
+	lines, _ = strconv.Atoi(cols[0])
+	seconds, _ := strconv.Atoi(cols[1])
+	period = time.Duration(seconds) * time.Second
+	return
+}
+
+// Record client's message in the room and tell if it exceeds the +f
+// lines:seconds limit.
+func (room *Room) Flooded(client *Client, now time.Time) bool {
+	lines, period, set := room.floodLimit()
+	if !set {
+		return false
+	}
+	since := now.Add(-period)
+	stamps := room.floodStamps[client]
+	for len(stamps) > 0 && stamps[0].Before(since) {
+		stamps = stamps[1:]
+	}
+	room.floodStamps[client] = append(stamps, now)
+	return len(room.floodStamps[client]) > lines
+}
+
+// Punish flooding client according to -floodaction. Offending message
+// is dropped anyway.
+func (room *Room) FloodAction(client *Client, now time.Time) {
+	switch *floodAction {
+	case "kick":
+		room.Broadcast(fmt.Sprintf(":%s KICK %s %s :Flood", *hostname, room.String(), *client.nickname))
+		room.removeMember(client)
+		logSink <- LogEvent{room.String(), *client.nickname, "kicked for flooding", true}
+		LogFailure(client, "flood", "kicked from", room.String())
+		return
+	case "mute":
+		_, period, _ := room.floodLimit()
+		room.muted[client] = now.Add(period)
+		logSink <- LogEvent{room.String(), *client.nickname, "muted for flooding", true}
+		LogFailure(client, "flood", "muted in", room.String())
+	}
+	client.ReplyNicknamed("404", room.String(), "Cannot send to channel (flood)")
+}
+
+// Send NAMES list, formatting it only if it is not cached yet, so
+// repeated NAMES of large rooms are cheap.
+func (room *Room) SendNames(client *Client) {
+	room.Lock()
+	if room.names == nil {
+		nicknames := make([]string, 0, len(room.members))
+		for member := range room.members {
+			nicknames = append(nicknames, room.prefix(member)+*member.nickname)
+		}
+		sort.Strings(nicknames)
+		names := strings.Join(nicknames, " ")
+		room.names = &names
+	}
+	names := *room.names
+	room.Unlock()
+	room.reply(client, "353", "=", room.String(), names)
+	room.reply(client, "366", room.String(), "End of NAMES list")
+}
+
+// Tell all rooms the client is member of that its nickname has changed,
+// so they forget cached NAMES list in their own goroutines.
+func InvalidateNames(client *Client) {
+	roomsM.RLock()
+	for _, r := range rooms {
+		r.RLock()
+		_, subscribed := r.members[client]
+		r.RUnlock()
+		if subscribed {
+			roomSinks[r] <- ClientEvent{client, EventNick, ""}
+		}
+	}
+	roomsM.RUnlock()
 }
 
 func (room *Room) SendTopic(client *Client) {
 	room.RLock()
 	if *room.topic == "" {
-		client.ReplyNicknamed("331", room.String(), "No topic is set")
+		room.reply(client, "331", room.String(), "No topic is set")
 	} else {
-		client.ReplyNicknamed("332", room.String(), *room.topic)
+		room.reply(client, "332", room.String(), *room.topic)
+	}
+	room.RUnlock()
+}
+
+// Send message with tags to all room's subscribers supporting
+// them, except the sender and deaf (+D) ones. Tag-only message, TAGMSG, is
+// not sent to the others at all. Non-empty status limits recipients to
+// members having it.
+func (room *Room) BroadcastTags(tags, msg string, tagOnly bool, status string, sender *Client) {
+	// Both variants of the line are the same for all members
+	tagged, taggedLine := msg, Line(msg)
+	plainLine := taggedLine
+	if tags != "" {
+		tagged = AddTag(msg, tags)
+		taggedLine = Line(tagged)
+	}
+	room.RLock()
+	for member := range room.members {
+		if member == sender || member.HasMode('D') || !room.hasStatus(member, status) {
+			continue
+		}
+		if member.HasCap("message-tags") {
+			room.sendLine(member, tagged, taggedLine)
+		} else if !tagOnly {
+			room.sendLine(member, msg, plainLine)
+		}
 	}
 	room.RUnlock()
 }
 
+// WHO reply flag of bots.
+func botFlag(c *Client) string {
+	if c.HasMode('B') {
+		return "B"
+	}
+	return ""
+}
+
+// Send nicknamed server message to the client, as a reply only if it
+// caused the current event.
+func (room *Room) reply(client *Client, code string, text ...string) {
+	if client == room.current {
+		client.ReplyNicknamed(code, text...)
+	} else {
+		client.RelayNicknamed(code, text...)
+	}
+}
+
+// Send message to the client, as a reply only if it caused the current
+// event.
+func (room *Room) send(client *Client, msg string) {
+	if client == room.current {
+		client.Msg(msg)
+	} else {
+		client.Relay(msg)
+	}
+}
+
+// Send message, already formatted as the line, to the client, as a reply
+// only if it caused the current event. Others share the same line.
+func (room *Room) sendLine(client *Client, msg string, line []byte) {
+	if client == room.current {
+		client.Msg(msg)
+	} else {
+		client.RelayLine(line)
+	}
+}
+
 // Send message to all room's subscribers, possibly excluding someone.
+// The line is formatted once for all of them.
 func (room *Room) Broadcast(msg string, clientToIgnore ...*Client) {
+	line := Line(msg)
 	room.RLock()
 	for member := range room.members {
 		if (len(clientToIgnore) > 0) && member == clientToIgnore[0] {
 			continue
 		}
-		member.Msg(msg)
+		room.sendLine(member, msg, line)
 	}
 	room.RUnlock()
 }
 
+// Access list entries, like "o:alice v:*!*@example.com". That is how
+// they are kept in state files.
+func (room *Room) accessState() string {
+	entries := make([]string, 0, len(room.access))
+	for mask, mode := range room.access {
+		entries = append(entries, mode+":"+mask)
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, " ")
+}
+
+// Restore access list saved by accessState.
+func (room *Room) RestoreAccess(state string) {
+	for _, entry := range strings.Fields(state) {
+		if cols := strings.SplitN(entry, ":", 2); len(cols) == 2 {
+			room.access[cols[1]] = cols[0]
+		}
+	}
+}
+
+// Normalize ban mask: bare nicknames become nick!*@*, and so on.
+// Returns false for malformed or unsupported extbans.
+func BanMask(mask string) (string, bool) {
+	if strings.HasPrefix(mask, "$") {
+		valid := len(mask) > 3 && mask[2] == ':' && strings.IndexByte(ExtbanTypes, mask[1]) != -1
+		return mask, valid
+	}
+	if !strings.Contains(mask, "!") {
+		if strings.Contains(mask, "@") {
+			mask = "*!" + mask
+		} else {
+			mask = mask + "!*@*"
+		}
+	}
+	if !strings.Contains(mask, "@") {
+		mask = mask + "@*"
+	}
+	return mask, true
+}
+
+// Sorted ban or quiet masks, like "$a:spammer *!*@example.com". That
+// is how they are kept in state files.
+func masksState(masks map[string]struct{}) string {
+	sorted := make([]string, 0, len(masks))
+	for mask := range masks {
+		sorted = append(sorted, mask)
+	}
+	sort.Strings(sorted)
+	return strings.Join(sorted, " ")
+}
+
+// Restore ban or quiet list saved by masksState.
+func RestoreMasks(masks map[string]struct{}, state string) {
+	for _, mask := range strings.Fields(state) {
+		masks[mask] = struct{}{}
+	}
+}
+
+// Is the client matched by any of the room's masks.
+func (room *Room) matchMasks(masks map[string]struct{}, client *Client) bool {
+	room.RLock()
+	defer room.RUnlock()
+	for mask := range masks {
+		if client.MatchBan(mask) {
+			return true
+		}
+	}
+	return false
+}
+
+// Is the client matched by any of room's bans.
+func (room *Room) Banned(client *Client) bool {
+	return room.matchMasks(room.bans, client)
+}
+
+// Is the client matched by any of room's quiets.
+func (room *Room) Quieted(client *Client) bool {
+	return room.matchMasks(room.quiets, client)
+}
+
+// Mode granted to the client on join by the access list, if any.
+// Operator entries take precedence over voice ones.
+func (room *Room) AccessMode(client *Client) (mode string) {
+	room.RLock()
+	for mask, m := range room.access {
+		if client.MatchMask(mask) && (mode == "" || m == "o") {
+			mode = m
+		}
+	}
+	room.RUnlock()
+	return
+}
+
+// Member's status prefix: "@" for operators, "+" for voiced ones.
+// Room must be locked by the caller.
+func (room *Room) prefix(member *Client) string {
+	if _, op := room.ops[member]; op {
+		return "@"
+	}
+	if _, voiced := room.voiced[member]; voiced {
+		return "+"
+	}
+	return ""
+}
+
+// Has the member at least the given status: @ is satisfied only by
+// operators, + by voiced members and operators, empty one by anyone.
+func (room *Room) hasStatus(member *Client, status string) bool {
+	switch status {
+	case "@":
+		return room.prefix(member) == "@"
+	case "+":
+		return room.prefix(member) != ""
+	}
+	return true
+}
+
+// Is the client the room's operator.
+func (room *Room) IsOp(client *Client) bool {
+	room.RLock()
+	_, op := room.ops[client]
+	room.RUnlock()
+	return op
+}
+
+// Forget everything related to the leaving member.
+func (room *Room) removeMember(client *Client) {
+	room.Lock()
+	delete(room.members, client)
+	delete(room.ops, client)
+	delete(room.voiced, client)
+	room.names = nil
+	room.Unlock()
+	delete(room.floodStamps, client)
+	delete(room.muted, client)
+}
+
+// Find room's member by nickname.
+func (room *Room) member(nickname string) *Client {
+	room.RLock()
+	defer room.RUnlock()
+	for member := range room.members {
+		if member.Match(nickname) {
+			return member
+		}
+	}
+	return nil
+}
+
+// Who made the change and when, as "nick!user@host unixtime" state
+// line, empty if unknown.
+func setterState(who string, when time.Time) string {
+	if who == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s %d", who, when.Unix())
+}
+
+// Restore who made the change and when from setterState line.
+func RestoreSetter(line string) (who string, when time.Time) {
+	var unix int64
+	if _, err := fmt.Sscanf(line, "%s %d", &who, &unix); err != nil {
+		return "", time.Time{}
+	}
+	return who, time.Unix(unix, 0)
+}
+
 func (room *Room) StateSave() {
 	room.RLock()
-	stateSink <- StateEvent{room.String(), *room.topic, *room.key}
+	var founder string
+	if room.founder != nil {
+		founder = *room.founder
+	}
+	stateSink <- StateEvent{
+		room.String(),
+		*room.topic,
+		*room.key,
+		room.modesState(),
+		room.accessState(),
+		founder,
+		masksState(room.bans),
+		masksState(room.quiets),
+		room.entryMsg,
+		setterState(room.topicWho, room.topicSet),
+		setterState(room.keyWho, room.keySet),
+		metadataState(room.metadata),
+		false,
+	}
 	room.RUnlock()
 }
 
 func (room *Room) Processor(events <-chan ClientEvent) {
+	// Room's sink is closed when it is emptied, or it gets EventTerm
+	defer roomsGroup.Done()
 	var client *Client
 	for event := range events {
 		client = event.client
+		room.current = client
 		switch event.eventType {
 		case EventTerm:
-			roomsGroup.Done()
 			return
 		case EventNew:
+			room.RLock()
+			_, subscribed := room.members[client]
+			room.RUnlock()
+			if subscribed {
+				// Repeated JOIN just refreshes the topic and names
+				room.SendTopic(client)
+				room.SendNames(client)
+				continue
+			}
 			room.Lock()
+			// Registered and restored rooms already have their owners,
+			// so rejoining them does not grant operator status
+			if len(room.members) == 0 && room.founder == nil && !room.restored {
+				room.ops[client] = struct{}{}
+			}
 			room.members[client] = struct{}{}
+			room.names = nil
 			if *verbose {
 				log.Println(client, "joined", room.name)
 			}
@@ -113,15 +629,23 @@ func (room *Room) Processor(events <-chan ClientEvent) {
 			room.SendTopic(client)
 			room.Broadcast(fmt.Sprintf(":%s JOIN %s", client, room.String()))
 			logSink <- LogEvent{room.String(), *client.nickname, "joined", true}
-			nicknames := make([]string, 0)
+			if mode := room.AccessMode(client); mode != "" {
+				room.Lock()
+				if mode == "o" {
+					room.ops[client] = struct{}{}
+				} else {
+					room.voiced[client] = struct{}{}
+				}
+				room.names = nil
+				room.Unlock()
+				room.Broadcast(fmt.Sprintf(":%s MODE %s +%s %s", *hostname, room.String(), mode, *client.nickname))
+			}
+			room.SendNames(client)
 			room.RLock()
-			for member := range room.members {
-				nicknames = append(nicknames, *member.nickname)
+			if room.entryMsg != "" {
+				ChanServNotice(client, "["+*room.name+"] "+room.entryMsg)
 			}
 			room.RUnlock()
-			sort.Strings(nicknames)
-			client.ReplyNicknamed("353", "=", room.String(), strings.Join(nicknames, " "))
-			client.ReplyNicknamed("366", room.String(), "End of NAMES list")
 		case EventDel:
 			room.RLock()
 			if _, subscribed := room.members[client]; !subscribed {
@@ -133,9 +657,7 @@ func (room *Room) Processor(events <-chan ClientEvent) {
 			room.Broadcast(msg)
 			logSink <- LogEvent{room.String(), *client.nickname, "left", true}
 			room.RUnlock()
-			room.Lock()
-			delete(room.members, client)
-			room.Unlock()
+			room.removeMember(client)
 		case EventTopic:
 			room.RLock()
 			if _, subscribed := room.members[client]; !subscribed {
@@ -149,9 +671,11 @@ func (room *Room) Processor(events <-chan ClientEvent) {
 				continue
 			}
 			room.RUnlock()
-			topic := strings.TrimLeft(event.text, ":")
+			topic := Truncate(strings.TrimLeft(event.text, ":"), TopicLen)
 			room.Lock()
 			room.topic = &topic
+			room.topicSet = time.Now()
+			room.topicWho = client.String()
 			room.Unlock()
 			room.RLock()
 			msg := fmt.Sprintf(":%s TOPIC %s :%s", client, room.String(), *room.topic)
@@ -170,39 +694,68 @@ func (room *Room) Processor(events <-chan ClientEvent) {
 				client.ReplyNicknamed(
 					"352",
 					room.String(),
-					*m.username,
+					m.Username(),
 					m.Host(),
 					*hostname,
 					*m.nickname,
-					"H",
+					"H"+botFlag(m)+room.prefix(m),
 					"0 "+*m.realname,
 				)
 			}
 			client.ReplyNicknamed("315", room.String(), "End of /WHO list")
 			room.RUnlock()
-		case EventMode:
+		case EventMode, EventSamode:
+			// SAMODE of operator bypasses membership and +o checks
 			room.RLock()
 			if event.text == "" {
-				mode := "+"
+				mode := room.ModeString()
 				if *room.key != "" {
-					mode = mode + "k"
+					// Only members are allowed to know the key
+					if _, subscribed := room.members[client]; subscribed {
+						mode = mode + " " + *room.key
+					} else {
+						mode = mode + " *"
+					}
 				}
 				client.Msg(fmt.Sprintf("324 %s %s %s", *client.nickname, room.String(), mode))
 				room.RUnlock()
 				continue
 			}
-			if strings.HasPrefix(event.text, "b") {
+			if strings.HasPrefix(event.text, "b") || event.text == "+b" {
+				for _, mask := range strings.Fields(masksState(room.bans)) {
+					client.ReplyNicknamed("367", room.String(), mask)
+				}
 				client.ReplyNicknamed("368", room.String(), "End of channel ban list")
 				room.RUnlock()
 				continue
 			}
-			if strings.HasPrefix(event.text, "-k") || strings.HasPrefix(event.text, "+k") {
+			if event.text == "q" || event.text == "+q" {
+				for _, mask := range strings.Fields(masksState(room.quiets)) {
+					client.ReplyNicknamed("728", room.String(), "q", mask)
+				}
+				client.ReplyNicknamed("729", room.String(), "q", "End of channel quiet list")
+				room.RUnlock()
+				continue
+			}
+			cols := strings.Split(event.text, " ")
+			change := cols[0]
+			known := len(change) == 2 && (change[0] == '+' || change[0] == '-')
+			if known {
+				_, flagMode := RoomFlagModes[change[1]]
+				known = flagMode || strings.IndexByte("bqkfov", change[1]) != -1
+			}
+			if known && event.eventType == EventMode {
 				if _, subscribed := room.members[client]; !subscribed {
 					client.ReplyParts("442", room.String(), "You are not on that channel")
 					room.RUnlock()
 					continue
 				}
-			} else {
+				if _, op := room.ops[client]; !op {
+					client.ReplyNicknamed("482", room.String(), "You're not channel operator")
+					room.RUnlock()
+					continue
+				}
+			} else if !known {
 				client.ReplyNicknamed("472", event.text, "Unknown MODE flag")
 				room.RUnlock()
 				continue
@@ -210,42 +763,382 @@ func (room *Room) Processor(events <-chan ClientEvent) {
 			room.RUnlock()
 			var msg string
 			var msgLog string
-			if strings.HasPrefix(event.text, "+k") {
-				cols := strings.Split(event.text, " ")
+			if change[1] == 'o' || change[1] == 'v' {
+				if len(cols) == 1 {
+					client.ReplyNotEnoughParameters("MODE")
+					continue
+				}
+				member := room.member(cols[1])
+				if member == nil {
+					client.ReplyNicknamed("441", cols[1], room.String(), "They aren't on that channel")
+					continue
+				}
+				statuses := room.voiced
+				if change[1] == 'o' {
+					statuses = room.ops
+				}
+				room.Lock()
+				if change[0] == '+' {
+					statuses[member] = struct{}{}
+				} else {
+					delete(statuses, member)
+				}
+				room.names = nil
+				room.Unlock()
+				room.Broadcast(fmt.Sprintf(":%s MODE %s %s %s", client, room.String(), change, *member.nickname))
+				logSink <- LogEvent{room.String(), *client.nickname, "set " + change + " on " + *member.nickname, true}
+				continue
+			}
+			switch change {
+			case "+b", "-b", "+q", "-q":
 				if len(cols) == 1 {
 					client.ReplyNotEnoughParameters("MODE")
 					continue
 				}
+				mask, valid := BanMask(cols[1])
+				if !valid {
+					client.ReplyNicknamed("696", room.String(), change[1:], cols[1], "Invalid ban mask, extbans supported: $"+ExtbanTypes)
+					continue
+				}
+				masks, action := room.bans, "banned "
+				if change[1] == 'q' {
+					masks, action = room.quiets, "quieted "
+				}
+				room.Lock()
+				if change[0] == '+' {
+					masks[mask] = struct{}{}
+					msgLog = action + mask
+				} else {
+					delete(masks, mask)
+					msgLog = "un" + action + mask
+				}
+				msg = fmt.Sprintf(":%s MODE %s %s %s", client, *room.name, change, mask)
+				room.Unlock()
+			case "+f":
+				if len(cols) == 1 {
+					client.ReplyNotEnoughParameters("MODE")
+					continue
+				}
+				if !REFlood.MatchString(cols[1]) {
+					client.ReplyNicknamed("696", room.String(), "f", cols[1], "Invalid flood limit, use lines:seconds")
+					continue
+				}
+				room.Lock()
+				room.modes['f'] = cols[1]
+				msg = fmt.Sprintf(":%s MODE %s +f %s", client, *room.name, cols[1])
+				room.Unlock()
+				msgLog = "set flood limit to " + cols[1]
+			case "-f":
+				room.Lock()
+				delete(room.modes, 'f')
+				msg = fmt.Sprintf(":%s MODE %s -f", client, *room.name)
+				room.Unlock()
+				msgLog = "removed flood limit"
+			case "+k":
+				if len(cols) == 1 {
+					client.ReplyNotEnoughParameters("MODE")
+					continue
+				}
+				if !KeyValid(cols[1]) {
+					client.ReplyNicknamed("696", room.String(), "k", cols[1], "Invalid channel key")
+					continue
+				}
 				room.Lock()
 				room.key = &cols[1]
+				room.keyWho, room.keySet = client.String(), time.Now()
 				msg = fmt.Sprintf(":%s MODE %s +k %s", client, *room.name, *room.key)
 				msgLog = "set channel key to " + *room.key
 				room.Unlock()
-			} else {
+			case "-k":
 				key := ""
 				room.Lock()
 				room.key = &key
+				room.keyWho, room.keySet = client.String(), time.Now()
 				msg = fmt.Sprintf(":%s MODE %s -k", client, *room.name)
 				room.Unlock()
 				msgLog = "removed channel key"
+			default:
+				room.Lock()
+				if change[0] == '+' {
+					room.modes[change[1]] = ""
+					msgLog = "enabled " + RoomFlagModes[change[1]]
+				} else {
+					delete(room.modes, change[1])
+					msgLog = "disabled " + RoomFlagModes[change[1]]
+				}
+				msg = fmt.Sprintf(":%s MODE %s %s", client, *room.name, change)
+				room.Unlock()
 			}
 			room.Broadcast(msg)
 			logSink <- LogEvent{room.String(), *client.nickname, msgLog, true}
 			room.StateSave()
+		case EventAccess:
+			if !room.IsOp(client) {
+				client.ReplyNicknamed("482", room.String(), "You're not channel operator")
+				continue
+			}
+			cols := strings.Fields(event.text)
+			if len(cols) == 0 {
+				cols = []string{"LIST"}
+			}
+			switch strings.ToUpper(cols[0]) {
+			case "LIST":
+				room.RLock()
+				for _, entry := range strings.Fields(room.accessState()) {
+					client.Notice(room.String() + " access " + entry)
+				}
+				room.RUnlock()
+				client.Notice(room.String() + " end of access list")
+				continue
+			case "ADD":
+				if len(cols) < 3 {
+					client.ReplyNotEnoughParameters("ACCESS")
+					continue
+				}
+				if cols[1] != "o" && cols[1] != "v" {
+					client.ReplyNicknamed("472", cols[1], "Unknown MODE flag")
+					continue
+				}
+				// Entry is applied to already present members too
+				granted := make([]string, 0)
+				room.Lock()
+				room.access[cols[2]] = cols[1]
+				for member := range room.members {
+					status := room.prefix(member)
+					if !member.MatchMask(cols[2]) || status == "@" || (status == "+" && cols[1] == "v") {
+						continue
+					}
+					if cols[1] == "o" {
+						room.ops[member] = struct{}{}
+					} else {
+						room.voiced[member] = struct{}{}
+					}
+					room.names = nil
+					granted = append(granted, *member.nickname)
+				}
+				room.Unlock()
+				client.Notice(room.String() + " access " + cols[1] + ":" + cols[2] + " added")
+				for _, nickname := range granted {
+					room.Broadcast(fmt.Sprintf(":%s MODE %s +%s %s", *hostname, room.String(), cols[1], nickname))
+				}
+				logSink <- LogEvent{
+					room.String(),
+					*client.nickname,
+					"added " + cols[2] + " to access list with +" + cols[1],
+					true,
+				}
+			case "DEL":
+				if len(cols) < 2 {
+					client.ReplyNotEnoughParameters("ACCESS")
+					continue
+				}
+				room.Lock()
+				_, found := room.access[cols[1]]
+				delete(room.access, cols[1])
+				room.Unlock()
+				if !found {
+					client.Notice(room.String() + " access " + cols[1] + " not found")
+					continue
+				}
+				client.Notice(room.String() + " access " + cols[1] + " removed")
+				logSink <- LogEvent{
+					room.String(),
+					*client.nickname,
+					"removed " + cols[1] + " from access list",
+					true,
+				}
+			default:
+				client.ReplyNicknamed("421", "ACCESS "+cols[0], "Unknown command")
+				continue
+			}
+			room.StateSave()
+		case EventRegister:
+			if !room.IsOp(client) {
+				ChanServNotice(client, "You are not operator of "+room.String())
+				continue
+			}
+			room.Lock()
+			if room.founder != nil {
+				room.Unlock()
+				ChanServNotice(client, room.String()+" is already registered")
+				continue
+			}
+			founder := *client.account
+			room.founder = &founder
+			room.access[founder] = "o"
+			room.Unlock()
+			ChanServNotice(client, room.String()+" is now registered to "+founder)
+			logSink <- LogEvent{room.String(), *client.nickname, "registered channel to " + founder, true}
+			room.StateSave()
+		case EventEntryMsg:
+			if !room.IsOp(client) {
+				ChanServNotice(client, "You are not operator of "+room.String())
+				continue
+			}
+			room.Lock()
+			room.entryMsg = event.text
+			room.Unlock()
+			if event.text == "" {
+				ChanServNotice(client, "Entry message of "+room.String()+" is cleared")
+				logSink <- LogEvent{room.String(), *client.nickname, "cleared entry message", true}
+			} else {
+				ChanServNotice(client, "Entry message of "+room.String()+" is set")
+				logSink <- LogEvent{room.String(), *client.nickname, "set entry message to " + event.text, true}
+			}
+			room.StateSave()
+		case EventMetadata:
+			// Text is "key value" to set, "key " to unset, empty to clear
+			if !room.IsOp(client) && !client.HasMode('o') {
+				client.ReplyFail("METADATA", "KEY_NO_PERMISSION", room.String(), "*", "You're not channel operator")
+				continue
+			}
+			changes := make(map[string]string)
+			room.Lock()
+			if event.text == "" {
+				for key := range room.metadata {
+					changes[key] = ""
+				}
+			} else {
+				cols := strings.SplitN(event.text, " ", 2)
+				_, set := room.metadata[cols[0]]
+				if !set && cols[1] != "" && len(room.metadata) >= MetadataMaxKeys {
+					room.Unlock()
+					client.ReplyFail("METADATA", "LIMIT_REACHED", room.String(), "Metadata limit reached")
+					continue
+				}
+				changes[cols[0]] = cols[1]
+			}
+			keys := make([]string, 0, len(changes))
+			for key, value := range changes {
+				if value == "" {
+					delete(room.metadata, key)
+				} else {
+					room.metadata[key] = value
+				}
+				keys = append(keys, key)
+			}
+			room.Unlock()
+			sort.Strings(keys)
+			room.RLock()
+			for _, key := range keys {
+				value := changes[key]
+				replyKeyValue(client, room.String(), key, value, value != "")
+				line := metadataLine(client.String(), room.String(), key, value, value != "")
+				for member := range room.members {
+					if member != client && member.HasCap(MetadataCap) && member.MetadataSubscribed(key) {
+						room.send(member, line)
+					}
+				}
+			}
+			room.RUnlock()
+			if len(keys) > 0 {
+				logSink <- LogEvent{room.String(), *client.nickname, "changed metadata " + strings.Join(keys, " "), true}
+				room.StateSave()
+			}
+		case EventNick:
+			room.Lock()
+			room.names = nil
+			room.Unlock()
+		case EventRename:
+			// Text is "old new reason", the name is already changed by
+			// the Daemon
+			cols := strings.SplitN(event.text, " ", 3)
+			old, name, reason := cols[0], cols[1], cols[2]
+			rename := fmt.Sprintf(":%s RENAME %s %s :%s", client, old, name, reason)
+			renameLine := Line(rename)
+			room.RLock()
+			members := make([]*Client, 0, len(room.members))
+			for member := range room.members {
+				members = append(members, member)
+			}
+			room.RUnlock()
+			for _, member := range members {
+				if member.HasCap("draft/channel-rename") {
+					room.sendLine(member, rename, renameLine)
+					continue
+				}
+				room.send(member, fmt.Sprintf(":%s PART %s :%s", member, old, "Channel renamed: "+reason))
+				room.send(member, fmt.Sprintf(":%s JOIN %s", member, name))
+				room.SendTopic(member)
+				room.SendNames(member)
+			}
+			logSink <- LogEvent{old, *client.nickname, "renamed channel to " + name, true}
+			stateSink <- StateEvent{where: old, removed: true}
+			room.StateSave()
 		case EventMsg:
-			sep := strings.Index(event.text, " ")
-			room.Broadcast(fmt.Sprintf(
-				":%s %s %s :%s",
+			// Message is "[@tags ]CMD[status] text", tags are client-only
+			// ones, status is @ or + for messages only to members having it
+			tags, line := "", event.text
+			if strings.HasPrefix(line, "@") {
+				sep := strings.Index(line, " ")
+				tags, line = line[1:sep], line[sep+1:]
+			}
+			sep := strings.Index(line, " ")
+			cmd := strings.TrimRight(line[:sep], "@+")
+			statusmsg := line[len(cmd):sep]
+			now := time.Now()
+			denied := ""
+			if until, muted := room.muted[client]; muted {
+				if now.Before(until) {
+					denied = "flood"
+				} else {
+					delete(room.muted, client)
+				}
+			}
+			room.RLock()
+			status := room.prefix(client)
+			_, member := room.members[client]
+			room.RUnlock()
+			switch {
+			case denied != "":
+			case status == "" && room.Banned(client):
+				denied = "+b"
+			case status == "" && room.Quieted(client):
+				denied = "+q"
+			}
+			if cmd == "TAGMSG" {
+				// Tags, like typing notifications, of those who can
+				// not talk in the room are silently dropped
+				if denied != "" || !member {
+					continue
+				}
+			} else if denied != "" {
+				client.ReplyNicknamed("404", room.String(), "Cannot send to channel ("+denied+")")
+				continue
+			}
+			msgid := "msgid=" + NextMsgID(now)
+			if tags == "" {
+				tags = msgid
+			} else {
+				tags = msgid + ";" + tags
+			}
+			if cmd == "TAGMSG" {
+				room.BroadcastTags(tags, fmt.Sprintf(":%s TAGMSG %s%s", client, statusmsg, room.String()), true, statusmsg, client)
+				continue
+			}
+			if room.Flooded(client, now) {
+				room.FloodAction(client, now)
+				continue
+			}
+			text := line[sep+1:]
+			if room.HasMode('c') {
+				text = StripFormatting(text)
+			}
+			room.BroadcastTags(tags, fmt.Sprintf(
+				":%s %s %s%s :%s",
 				client,
-				event.text[:sep],
+				cmd,
+				statusmsg,
 				room.String(),
-				event.text[sep+1:]),
+				text),
+				false,
+				statusmsg,
 				client,
 			)
 			logSink <- LogEvent{
 				room.String(),
 				*client.nickname,
-				event.text[sep+1:],
+				text,
 				false,
 			}
 		}
@@ -19,8 +19,11 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
+	"fmt"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func noNickchan(t *testing.T, c *TestingConn) {
@@ -41,8 +44,26 @@ func notEnoughParams(t *testing.T, c *TestingConn) {
 	}
 }
 
+// Read the message tagged with msgid and return the identifier along
+// with the message having msgid tag removed.
+func msgID(t *testing.T, c *TestingConn) (int64, string) {
+	r := <-c.outbound
+	if !strings.HasPrefix(r, "@msgid=") {
+		t.Fatal("no msgid", r)
+	}
+	sep := strings.IndexAny(r, "; ")
+	id, err := strconv.ParseInt(r[len("@msgid="):sep], 36, 64)
+	if err != nil {
+		t.Fatal("invalid msgid", r)
+	}
+	if r[sep] == ';' {
+		return id, "@" + r[sep+1:]
+	}
+	return id, r[sep+1:]
+}
+
 func TestTwoUsers(t *testing.T) {
-	logSink = make(chan LogEvent, 8)
+	logSink = make(chan LogEvent, 16)
 	stateSink = make(chan StateEvent, 8)
 	host := "foohost"
 	hostname = &host
@@ -68,7 +89,7 @@ func TestTwoUsers(t *testing.T) {
 
 	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
 	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
-	for i := 0; i < 6; i++ {
+	for i := 0; i < 13; i++ {
 		<-conn1.outbound
 		<-conn2.outbound
 	}
@@ -77,24 +98,44 @@ func TestTwoUsers(t *testing.T) {
 	if r := <-conn1.outbound; !strings.Contains(r, "There are 2 users") {
 		t.Fatal("LUSERS", r)
 	}
+	for i := 0; i < 6; i++ {
+		<-conn1.outbound
+	}
 
 	conn1.inbound <- "WHOIS"
 	notEnoughParams(t, conn1)
 	conn1.inbound <- "WHOIS nick3"
 	noNickchan(t, conn1)
 	conn1.inbound <- "WHOIS nick2"
-	if r := <-conn1.outbound; r != ":foohost 311 nick1 nick2 foo2 Unknown * :Long name2\r\n" {
+	if r := <-conn1.outbound; r != ":foohost 311 nick1 nick2 foo2 someclient * :Long name2\r\n" {
 		t.Fatal("first WHOIS 311", r)
 	}
 	if r := <-conn1.outbound; r != ":foohost 312 nick1 nick2 foohost :foohost\r\n" {
 		t.Fatal("first WHOIS 312", r)
 	}
+	if r := <-conn1.outbound; r != fmt.Sprintf(":foohost 317 nick1 nick2 0 %d :seconds idle, signon time\r\n", client2.signon.Unix()) {
+		t.Fatal("first WHOIS 317", r)
+	}
 	if r := <-conn1.outbound; r != ":foohost 319 nick1 nick2 :\r\n" {
 		t.Fatal("first WHOIS 319", r)
 	}
 	if r := <-conn1.outbound; r != ":foohost 318 nick1 nick2 :End of /WHOIS list\r\n" {
 		t.Fatal("first WHOIS 318", r)
 	}
+	conn1.inbound <- "WHOIS foohost nick1"
+	if r := <-conn1.outbound; r != ":foohost 311 nick1 nick1 foo1 someclient * :Long name1\r\n" {
+		t.Fatal("self WHOIS 311", r)
+	}
+	<-conn1.outbound
+	if r := <-conn1.outbound; r != ":foohost 378 nick1 nick1 :is connecting from *@someclient\r\n" {
+		t.Fatal("self WHOIS 378", r)
+	}
+	if r := <-conn1.outbound; r != ":foohost 379 nick1 nick1 :is using modes +\r\n" {
+		t.Fatal("self WHOIS 379", r)
+	}
+	for i := 0; i < 3; i++ {
+		<-conn1.outbound
+	}
 
 	conn1.inbound <- "LIST"
 	if r := <-conn1.outbound; r != ":foohost 323 nick1 :End of /LIST\r\n" {
@@ -106,12 +147,30 @@ func TestTwoUsers(t *testing.T) {
 	conn1.inbound <- "WHO #fooroom"
 	noChan(t, conn1)
 
+	// Join one by one, so nick1 is the operator and all JOINs are read
 	conn1.inbound <- "JOIN #foo"
-	conn2.inbound <- "JOIN #foo"
 	for i := 0; i < 4; i++ {
 		<-conn1.outbound
+	}
+	conn2.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
 		<-conn2.outbound
 	}
+	if r := <-conn1.outbound; r != ":nick2!foo2@someclient JOIN #foo\r\n" {
+		t.Fatal("second JOIN", r)
+	}
+	conn2.inbound <- "JOIN #foo"
+	if r := <-conn2.outbound; r != ":foohost 331 nick2 #foo :No topic is set\r\n" {
+		t.Fatal("repeated JOIN topic", r)
+	}
+	if r := <-conn2.outbound; r != ":foohost 353 nick2 = #foo :@nick1 nick2\r\n" {
+		t.Fatal("repeated JOIN names", r)
+	}
+	<-conn2.outbound
+	conn1.inbound <- "MODE nick1"
+	if r := <-conn1.outbound; r != "221 nick1 +\r\n" {
+		t.Fatal("repeated JOIN is broadcasted", r)
+	}
 	conn1.inbound <- "PRIVMSG nick2 :Hello"
 	conn1.inbound <- "PRIVMSG #foo :world"
 	conn1.inbound <- "NOTICE #foo :world"
@@ -130,6 +189,217 @@ func TestTwoUsers(t *testing.T) {
 	if m2 = <-conn2.outbound; m2 != ":nick1!foo1@someclient NOTICE #foo :world\r\n" {
 		t.Fatal("third message", m2)
 	}
+	conn2.inbound <- "AWAY :" + strings.Repeat("a", AwayLen+10)
+	if r := <-conn2.outbound; r != ":foohost 306 nick2 :You have been marked as being away\r\n" {
+		t.Fatal("AWAY", r)
+	}
+	conn1.inbound <- "PRIVMSG nick2 :Hello"
+	<-conn2.outbound
+	if r := <-conn1.outbound; r != ":foohost 301 nick1 nick2 :"+strings.Repeat("a", AwayLen)+"\r\n" {
+		t.Fatal("truncated AWAY message", r)
+	}
+	conn2.inbound <- "AWAY :"
+	if r := <-conn2.outbound; r != ":foohost 305 nick2 :You are no longer marked as being away\r\n" {
+		t.Fatal("AWAY with empty message", r)
+	}
+	conn2.inbound <- "CAP REQ message-tags"
+	<-conn2.outbound
+	conn1.inbound <- "@+typing=active;+draft/react=a\\sb TAGMSG #foo"
+	id1, m := msgID(t, conn2)
+	if m != "@+draft/react=a\\sb;+typing=active :nick1!foo1@someclient TAGMSG #foo\r\n" {
+		t.Fatal("TAGMSG to channel", m)
+	}
+	conn1.inbound <- "PRIVMSG #foo :identified"
+	id2, m := msgID(t, conn2)
+	if m != ":nick1!foo1@someclient PRIVMSG #foo :identified\r\n" {
+		t.Fatal("channel message with msgid", m)
+	}
+	if id2 <= id1 {
+		t.Fatal("msgid is not increasing", id1, id2)
+	}
+	reply := "+draft/reply=" + strconv.FormatInt(id2, 36)
+	conn1.inbound <- "@" + reply + " PRIVMSG #foo :answer"
+	if _, m = msgID(t, conn2); m != "@"+reply+" :nick1!foo1@someclient PRIVMSG #foo :answer\r\n" {
+		t.Fatal("reply to channel message", m)
+	}
+	conn1.inbound <- "@+typing=done;time=x PRIVMSG nick2 :tagged"
+	if r := <-conn2.outbound; r != "@+typing=done :nick1!foo1@someclient PRIVMSG nick2 :tagged\r\n" {
+		t.Fatal("message with client-only tags", r)
+	}
+	conn1.inbound <- "@+typing=paused TAGMSG nick2"
+	if r := <-conn2.outbound; r != "@+typing=paused :nick1!foo1@someclient TAGMSG nick2\r\n" {
+		t.Fatal("TAGMSG to user", r)
+	}
+	conn2.inbound <- "CAP REQ -message-tags"
+	<-conn2.outbound
+	conn1.inbound <- "@+typing=active TAGMSG #foo"
+	conn1.inbound <- "@+typing=done PRIVMSG #foo :untagged"
+	if r := <-conn2.outbound; r != ":nick1!foo1@someclient PRIVMSG #foo :untagged\r\n" {
+		t.Fatal("tags without message-tags", r)
+	}
+	conn1.inbound <- "TAGMSG"
+	if r := <-conn1.outbound; r != ":foohost 411 nick1 :No recipient given (TAGMSG)\r\n" {
+		t.Fatal("TAGMSG without target", r)
+	}
+
+	conn1.inbound <- "PRIVMSG nick2,nick3 :multi"
+	if r := <-conn2.outbound; r != ":nick1!foo1@someclient PRIVMSG nick2 :multi\r\n" {
+		t.Fatal("multi-target message", r)
+	}
+	noNickchan(t, conn1)
+	conn1.inbound <- "PRIVMSG a,b,c,d,e :multi"
+	if r := <-conn1.outbound; r != ":foohost 407 nick1 a,b,c,d,e :Too many recipients\r\n" {
+		t.Fatal("too many targets", r)
+	}
+
+	conn1.inbound <- "CAP REQ :setname unknown"
+	if r := <-conn1.outbound; r != ":foohost CAP nick1 NAK :setname unknown\r\n" {
+		t.Fatal("CAP NAK", r)
+	}
+	conn1.inbound <- "CAP REQ :setname"
+	if r := <-conn1.outbound; r != ":foohost CAP nick1 ACK :setname\r\n" {
+		t.Fatal("CAP ACK", r)
+	}
+	conn2.inbound <- "SETNAME :New name2"
+	if r := <-conn1.outbound; r != ":nick2!foo2@someclient SETNAME :New name2\r\n" {
+		t.Fatal("SETNAME", r)
+	}
+	conn1.inbound <- "WHOIS nick2"
+	if r := <-conn1.outbound; r != ":foohost 311 nick1 nick2 foo2 someclient * :New name2\r\n" {
+		t.Fatal("WHOIS after SETNAME", r)
+	}
+	for i := 0; i < 4; i++ {
+		<-conn1.outbound
+	}
+
+	conn1.inbound <- "CAP REQ :chghost"
+	<-conn1.outbound
+	conn2.inbound <- "CAP LIST"
+	if r := <-conn2.outbound; r != ":foohost CAP nick2 LIST :\r\n" {
+		t.Fatal("CAP LIST", r)
+	}
+	ChangeHost(client1, "user1", "vhost1")
+	if r := <-conn1.outbound; r != ":nick1!foo1@someclient CHGHOST user1 vhost1\r\n" {
+		t.Fatal("CHGHOST to itself", r)
+	}
+	if r := <-conn2.outbound; r != ":nick1!foo1@someclient QUIT :Changing host\r\n" {
+		t.Fatal("CHGHOST fallback QUIT", r)
+	}
+	if r := <-conn2.outbound; r != ":nick1!user1@vhost1 JOIN #foo\r\n" {
+		t.Fatal("CHGHOST fallback JOIN", r)
+	}
+	if r := <-conn2.outbound; r != ":foohost MODE #foo +o nick1\r\n" {
+		t.Fatal("CHGHOST fallback MODE", r)
+	}
+	ChangeHost(client2, "user2", "vhost2")
+	if r := <-conn1.outbound; r != ":nick2!foo2@someclient CHGHOST user2 vhost2\r\n" {
+		t.Fatal("CHGHOST", r)
+	}
+	if r := <-conn2.outbound; r != ":foohost 396 nick2 vhost2 :is now your displayed host\r\n" {
+		t.Fatal("CHGHOST without capability", r)
+	}
+	ChangeHost(client1, "foo1", "someclient")
+	<-conn1.outbound
+	ChangeHost(client2, "foo2", "someclient")
+	<-conn1.outbound
+	for i := 0; i < 4; i++ {
+		<-conn2.outbound
+	}
+
+	conn1.inbound <- "CAP REQ :batch labeled-response"
+	<-conn1.outbound
+	conn1.inbound <- "@label=a\\sb PING x"
+	if r := <-conn1.outbound; r != "@label=a\\sb :foohost PONG foohost :x\r\n" {
+		t.Fatal("labeled single reply", r)
+	}
+	conn1.inbound <- "@label=c PONG x"
+	if r := <-conn1.outbound; r != "@label=c :foohost ACK\r\n" {
+		t.Fatal("labeled ACK", r)
+	}
+	conn1.inbound <- "@label=d WHO #foo"
+	r := <-conn1.outbound
+	if !strings.HasPrefix(r, "@label=d :foohost BATCH +") || !strings.HasSuffix(r, " labeled-response\r\n") {
+		t.Fatal("labeled BATCH start", r)
+	}
+	ref := strings.Fields(r)[3][1:]
+	for i := 0; i < 3; i++ {
+		if r = <-conn1.outbound; !strings.HasPrefix(r, "@batch="+ref+" :foohost ") {
+			t.Fatal("labeled BATCH reply", r)
+		}
+	}
+	if r = <-conn1.outbound; r != ":foohost BATCH -"+ref+"\r\n" {
+		t.Fatal("labeled BATCH end", r)
+	}
+	conn2.inbound <- "PRIVMSG #foo :unlabeled"
+	conn1.inbound <- "@label=e PONG x"
+	got := map[string]bool{<-conn1.outbound: true, <-conn1.outbound: true}
+	if !got["@label=e :foohost ACK\r\n"] || !got[":nick2!foo2@someclient PRIVMSG #foo :unlabeled\r\n"] {
+		t.Fatal("labeled response with foreign traffic", got)
+	}
+
+	conn1.inbound <- "MODE #foo +f 2:60"
+	for _, c := range []*TestingConn{conn1, conn2} {
+		if r := <-c.outbound; r != ":nick1!foo1@someclient MODE #foo +f 2:60\r\n" {
+			t.Fatal("+f MODE setting", r)
+		}
+	}
+	conn1.inbound <- "PRIVMSG #foo :one\r\nPRIVMSG #foo :two\r\nPRIVMSG #foo :three"
+	for _, m := range []string{"one", "two"} {
+		if r := <-conn2.outbound; r != ":nick1!foo1@someclient PRIVMSG #foo :"+m+"\r\n" {
+			t.Fatal("message within flood limit", r)
+		}
+	}
+	if r := <-conn1.outbound; r != ":foohost 404 nick1 #foo :Cannot send to channel (flood)\r\n" {
+		t.Fatal("message exceeding flood limit", r)
+	}
+
+	conn2.inbound <- "MODE nick2 +R"
+	if r := <-conn2.outbound; r != ":nick2 MODE nick2 :+R\r\n" {
+		t.Fatal("+R user MODE", r)
+	}
+	conn2.inbound <- "MODE nick2"
+	if r := <-conn2.outbound; r != "221 nick2 +R\r\n" {
+		t.Fatal("user MODE query", r)
+	}
+	conn1.inbound <- "PRIVMSG nick2 :Hello"
+	if r := <-conn1.outbound; r != ":foohost 716 nick1 nick2 :is in +R mode (only identified users may message)\r\n" {
+		t.Fatal("message to +R user", r)
+	}
+	if r := <-conn1.outbound; r != ":foohost 717 nick1 nick2 :has been informed that you messaged them\r\n" {
+		t.Fatal("message to +R user notification", r)
+	}
+	if r := <-conn2.outbound; r != ":foohost 718 nick2 nick1 foo1@someclient :is messaging you, but you are in +R mode\r\n" {
+		t.Fatal("+R user notification", r)
+	}
+	account := "nick1"
+	client1.account = &account
+	conn1.inbound <- "PRIVMSG nick2 :Hello"
+	if r := <-conn2.outbound; r != mNeeded {
+		t.Fatal("identified message to +R user", r)
+	}
+
+	conn1.inbound <- "MODE nick1 +D"
+	if r := <-conn1.outbound; r != ":nick1 MODE nick1 :+D\r\n" {
+		t.Fatal("+D user MODE", r)
+	}
+	conn2.inbound <- "PRIVMSG #foo :unheard"
+	conn2.inbound <- "PART #foo"
+	if r := <-conn1.outbound; r != ":nick2!foo2@someclient PART #foo :nick2\r\n" {
+		t.Fatal("channel message to deaf member", r)
+	}
+	<-conn2.outbound
+
+	conn2.inbound <- "MODE nick2 +iwo-Rx"
+	if r := <-conn2.outbound; r != ":foohost 501 nick2 :Unknown MODE flag\r\n" {
+		t.Fatal("unknown user MODE flag", r)
+	}
+	if r := <-conn2.outbound; r != ":nick2 MODE nick2 :+iw-R\r\n" {
+		t.Fatal("several user MODE changes", r)
+	}
+	conn2.inbound <- "MODE nick2"
+	if r := <-conn2.outbound; r != "221 nick2 +iw\r\n" {
+		t.Fatal("user MODE query after changes", r)
+	}
 }
 
 func TestJoin(t *testing.T) {
@@ -152,7 +422,7 @@ func TestJoin(t *testing.T) {
 	go client.Processor(events)
 
 	conn.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
-	for i := 0; i < 6; i++ {
+	for i := 0; i < 13; i++ {
 		<-conn.outbound
 	}
 
@@ -170,7 +440,7 @@ func TestJoin(t *testing.T) {
 	if r := <-conn.outbound; r != ":nick2!foo2@someclient JOIN #foo\r\n" {
 		t.Fatal("no JOIN message", r)
 	}
-	if r := <-conn.outbound; r != ":foohost 353 nick2 = #foo :nick2\r\n" {
+	if r := <-conn.outbound; r != ":foohost 353 nick2 = #foo :@nick2\r\n" {
 		t.Fatal("no NAMES list", r)
 	}
 	if r := <-conn.outbound; r != ":foohost 366 nick2 #foo :End of NAMES list\r\n" {
@@ -241,18 +511,30 @@ func TestJoin(t *testing.T) {
 	}
 
 	conn.inbound <- "PART #bazenc\r\nMODE #bazenc -k"
+	if r := <-conn.outbound; r != ":nick2!foo2@someclient PART #bazenc :nick2\r\n" {
+		t.Fatal("PART", r)
+	}
 	if r := <-conn.outbound; r != ":foohost 442 #bazenc :You are not on that channel\r\n" {
 		t.Fatal("not on that channel", r)
 	}
 	if r := <-logSink; (r.what != "left") || (r.where != "#bazenc") || (r.who != "nick2") || (r.meta != true) {
 		t.Fatal("left #bazenc log", r)
 	}
+	conn.inbound <- "MODE #bazenc"
+	if r := <-conn.outbound; r != "324 nick2 #bazenc +k *\r\n" {
+		t.Fatal("MODE query by non-member", r)
+	}
 
 	conn.inbound <- "MODE #barenc +i"
 	if r := <-conn.outbound; r != ":foohost 472 nick2 +i :Unknown MODE flag\r\n" {
 		t.Fatal("unknown MODE flag", r)
 	}
 
+	conn.inbound <- "MODE #barenc +k new\x01key"
+	if r := <-conn.outbound; r != ":foohost 696 nick2 #barenc k new\x01key :Invalid channel key\r\n" {
+		t.Fatal("+k MODE with invalid key", r)
+	}
+
 	conn.inbound <- "MODE #barenc +k newkey"
 	if r := <-conn.outbound; r != ":nick2!foo2@someclient MODE #barenc +k newkey\r\n" {
 		t.Fatal("+k MODE setting", r)
@@ -260,10 +542,33 @@ func TestJoin(t *testing.T) {
 	if r := <-logSink; (r.what != "set channel key to newkey") || (r.where != "#barenc") || (r.who != "nick2") || (r.meta != true) {
 		t.Fatal("set channel key", r)
 	}
-	if r := <-stateSink; (r.topic != "") || (r.where != "#barenc") || (r.key != "newkey") {
+	if r := <-stateSink; (r.topic != "") || (r.where != "#barenc") || (r.key != "newkey") || !strings.HasPrefix(r.keySetter, "nick2!foo2@someclient ") {
 		t.Fatal("set channel newkey state", r)
 	}
 
+	conn.inbound <- "MODE #barenc +c"
+	if r := <-conn.outbound; r != ":nick2!foo2@someclient MODE #barenc +c\r\n" {
+		t.Fatal("+c MODE setting", r)
+	}
+	if r := <-logSink; (r.what != "enabled colours stripping") || (r.where != "#barenc") || (r.who != "nick2") || (r.meta != true) {
+		t.Fatal("enable colours stripping log", r)
+	}
+	if r := <-stateSink; (r.where != "#barenc") || (r.key != "newkey") || (r.modes != "c") {
+		t.Fatal("set channel +c state", r)
+	}
+	conn.inbound <- "MODE #barenc"
+	if r := <-conn.outbound; r != "324 nick2 #barenc +ck newkey\r\n" {
+		t.Fatal("MODE query", r)
+	}
+	conn.inbound <- "MODE #barenc -c"
+	if r := <-conn.outbound; r != ":nick2!foo2@someclient MODE #barenc -c\r\n" {
+		t.Fatal("-c MODE setting", r)
+	}
+	<-logSink
+	if r := <-stateSink; (r.where != "#barenc") || (r.modes != "") {
+		t.Fatal("unset channel +c state", r)
+	}
+
 	conn.inbound <- "TOPIC #barenc :New topic"
 	if r := <-conn.outbound; r != ":nick2!foo2@someclient TOPIC #barenc :New topic\r\n" {
 		t.Fatal("set TOPIC", r)
@@ -271,15 +576,996 @@ func TestJoin(t *testing.T) {
 	if r := <-logSink; (r.what != "set topic to New topic") || (r.where != "#barenc") || (r.who != "nick2") || (r.meta != true) {
 		t.Fatal("set TOPIC log", r)
 	}
-	if r := <-stateSink; (r.topic != "New topic") || (r.where != "#barenc") || (r.key != "newkey") {
+	if r := <-stateSink; (r.topic != "New topic") || (r.where != "#barenc") || (r.key != "newkey") || !strings.HasPrefix(r.topicSetter, "nick2!foo2@someclient ") {
 		t.Fatal("set channel TOPIC state", r)
 	}
 
 	conn.inbound <- "WHO #barenc"
-	if r := <-conn.outbound; r != ":foohost 352 nick2 #barenc foo2 someclient foohost nick2 H :0 Long name2\r\n" {
+	if r := <-conn.outbound; r != ":foohost 352 nick2 #barenc foo2 someclient foohost nick2 H@ :0 Long name2\r\n" {
 		t.Fatal("WHO", r)
 	}
 	if r := <-conn.outbound; r != ":foohost 315 nick2 #barenc :End of /WHO list\r\n" {
 		t.Fatal("end of WHO", r)
 	}
+	conn.inbound <- "MODE nick2 +B"
+	if r := <-conn.outbound; r != ":nick2 MODE nick2 :+B\r\n" {
+		t.Fatal("+B user MODE", r)
+	}
+	conn.inbound <- "WHO #barenc"
+	if r := <-conn.outbound; r != ":foohost 352 nick2 #barenc foo2 someclient foohost nick2 HB@ :0 Long name2\r\n" {
+		t.Fatal("WHO of bot", r)
+	}
+	<-conn.outbound
+	conn.inbound <- "WHOIS nick2"
+	<-conn.outbound
+	<-conn.outbound
+	if r := <-conn.outbound; r != ":foohost 335 nick2 nick2 :is a bot\r\n" {
+		t.Fatal("WHOIS of bot", r)
+	}
+	for i := 0; i < 5; i++ {
+		<-conn.outbound
+	}
+
+	conn.inbound <- "MODE #barenc +r"
+	if r := <-conn.outbound; r != ":nick2!foo2@someclient MODE #barenc +r\r\n" {
+		t.Fatal("+r MODE setting", r)
+	}
+	if r := <-logSink; r.what != "enabled registered users only" {
+		t.Fatal("+r MODE log", r)
+	}
+	if r := <-stateSink; r.modes != "r" {
+		t.Fatal("set channel +r state", r)
+	}
+	conn.inbound <- "PART #barenc"
+	<-conn.outbound
+	<-logSink
+	conn.inbound <- "JOIN #barenc newkey"
+	if r := <-conn.outbound; r != ":foohost 477 nick2 #barenc :Cannot join channel (+r) - you need to be identified\r\n" {
+		t.Fatal("joining +r channel unidentified", r)
+	}
+	account := "nick2"
+	client.account = &account
+	conn.inbound <- "JOIN #barenc newkey"
+	if r := <-conn.outbound; r != ":foohost 332 nick2 #barenc :New topic\r\n" {
+		t.Fatal("joining +r channel identified", r)
+	}
+}
+
+func TestAccess(t *testing.T) {
+	logSink = make(chan LogEvent, 16)
+	stateSink = make(chan StateEvent, 8)
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	rooms = make(map[string]*Room)
+	clients = make(map[*Client]struct{})
+	roomSinks = make(map[*Room]chan ClientEvent)
+	whowas = nil
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+	}()
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	client1 := NewClient(conn1)
+	client2 := NewClient(conn2)
+	go client1.Processor(events)
+	go client2.Processor(events)
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
+	for i := 0; i < 13; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+
+	conn1.inbound <- "JOIN #acc"
+	for i := 0; i < 4; i++ {
+		<-conn1.outbound
+	}
+	conn1.inbound <- "ACCESS #acc ADD v nick2!*@*"
+	if r := <-conn1.outbound; r != ":foohost NOTICE nick1 :#acc access v:nick2!*@* added\r\n" {
+		t.Fatal("ACCESS ADD", r)
+	}
+	if r := <-stateSink; r.where != "#acc" || r.access != "v:nick2!*@*" {
+		t.Fatal("access list state", r)
+	}
+	conn1.inbound <- "ACCESS #acc"
+	if r := <-conn1.outbound; r != ":foohost NOTICE nick1 :#acc access v:nick2!*@*\r\n" {
+		t.Fatal("ACCESS LIST", r)
+	}
+	if r := <-conn1.outbound; r != ":foohost NOTICE nick1 :#acc end of access list\r\n" {
+		t.Fatal("ACCESS LIST end", r)
+	}
+	conn2.inbound <- "ACCESS #acc"
+	if r := <-conn2.outbound; r != ":foohost 482 nick2 #acc :You're not channel operator\r\n" {
+		t.Fatal("ACCESS by non-operator", r)
+	}
+
+	conn2.inbound <- "PRIVMSG ChanServ :ENTRYMSG #acc Be nice"
+	if r := <-conn2.outbound; r != ":ChanServ!ChanServ@foohost NOTICE nick2 :You are not operator of #acc\r\n" {
+		t.Fatal("ChanServ ENTRYMSG by non-operator", r)
+	}
+	conn1.inbound <- "PRIVMSG ChanServ :ENTRYMSG #acc Be  nice"
+	if r := <-conn1.outbound; r != ":ChanServ!ChanServ@foohost NOTICE nick1 :Entry message of #acc is set\r\n" {
+		t.Fatal("ChanServ ENTRYMSG", r)
+	}
+	if r := <-stateSink; r.entry != "Be  nice" {
+		t.Fatal("entry message state", r)
+	}
+
+	conn2.inbound <- "JOIN #acc"
+	<-conn2.outbound
+	if r := <-conn2.outbound; r != ":nick2!foo2@someclient JOIN #acc\r\n" {
+		t.Fatal("JOIN", r)
+	}
+	for _, c := range []*TestingConn{conn1, conn2} {
+		if c == conn1 {
+			<-c.outbound
+		}
+		if r := <-c.outbound; r != ":foohost MODE #acc +v nick2\r\n" {
+			t.Fatal("auto voice", r)
+		}
+	}
+	if r := <-conn2.outbound; r != ":foohost 353 nick2 = #acc :+nick2 @nick1\r\n" {
+		t.Fatal("NAMES with statuses", r)
+	}
+	<-conn2.outbound
+	if r := <-conn2.outbound; r != ":ChanServ!ChanServ@foohost NOTICE nick2 :[#acc] Be  nice\r\n" {
+		t.Fatal("entry message", r)
+	}
+
+	conn2.inbound <- "MODE #acc +o nick2"
+	if r := <-conn2.outbound; r != ":foohost 482 nick2 #acc :You're not channel operator\r\n" {
+		t.Fatal("+o by non-operator", r)
+	}
+	for _, mode := range []string{"+k secret", "-k", "+c", "+r", "+f 5:10"} {
+		conn2.inbound <- "MODE #acc " + mode
+		if r := <-conn2.outbound; r != ":foohost 482 nick2 #acc :You're not channel operator\r\n" {
+			t.Fatal(mode+" by non-operator", r)
+		}
+	}
+	conn1.inbound <- "ACCESS #acc ADD o nick2!*@*"
+	<-conn1.outbound
+	for _, c := range []*TestingConn{conn1, conn2} {
+		if r := <-c.outbound; r != ":foohost MODE #acc +o nick2\r\n" {
+			t.Fatal("ACCESS ADD of present member", r)
+		}
+	}
+	if r := <-stateSink; r.access != "o:nick2!*@*" {
+		t.Fatal("access list state", r)
+	}
+	conn1.inbound <- "MODE #acc +o nobody"
+	if r := <-conn1.outbound; r != ":foohost 441 nick1 nobody #acc :They aren't on that channel\r\n" {
+		t.Fatal("+o of non-member", r)
+	}
+	conn1.inbound <- "MODE #acc +o nick2"
+	for _, c := range []*TestingConn{conn1, conn2} {
+		if r := <-c.outbound; r != ":nick1!foo1@someclient MODE #acc +o nick2\r\n" {
+			t.Fatal("+o MODE", r)
+		}
+	}
+
+	conn1.inbound <- "PRIVMSG ChanServ :REGISTER #acc"
+	if r := <-conn1.outbound; r != ":ChanServ!ChanServ@foohost NOTICE nick1 :You need to be identified to register channels\r\n" {
+		t.Fatal("ChanServ REGISTER unidentified", r)
+	}
+	account := "founder"
+	client1.account = &account
+	conn1.inbound <- "PRIVMSG ChanServ :REGISTER #acc"
+	if r := <-conn1.outbound; r != ":ChanServ!ChanServ@foohost NOTICE nick1 :#acc is now registered to founder\r\n" {
+		t.Fatal("ChanServ REGISTER", r)
+	}
+	if r := <-stateSink; r.founder != "founder" || r.access != "o:founder o:nick2!*@*" {
+		t.Fatal("registered channel state", r)
+	}
+	conn1.inbound <- "PRIVMSG ChanServ :REGISTER #acc"
+	if r := <-conn1.outbound; r != ":ChanServ!ChanServ@foohost NOTICE nick1 :#acc is already registered\r\n" {
+		t.Fatal("ChanServ REGISTER twice", r)
+	}
+	conn2.inbound <- "NICK chanserv"
+	if r := <-conn2.outbound; r != ":foohost 433 * chanserv :Nickname is already in use\r\n" {
+		t.Fatal("ChanServ nickname reserved", r)
+	}
+
+	conn1.inbound <- "RENAME #acc bad"
+	if r := <-conn1.outbound; r != ":foohost NOTICE nick1 :RENAME: Invalid channel name\r\n" {
+		t.Fatal("RENAME to invalid name", r)
+	}
+	conn1.inbound <- "CAP REQ draft/channel-rename"
+	<-conn1.outbound
+	conn1.inbound <- "RENAME #acc #acc2 :tidy up"
+	if r := <-conn1.outbound; r != ":nick1!foo1@someclient RENAME #acc #acc2 :tidy up\r\n" {
+		t.Fatal("RENAME", r)
+	}
+	for _, expected := range []string{
+		":nick2!foo2@someclient PART #acc :Channel renamed: tidy up\r\n",
+		":nick2!foo2@someclient JOIN #acc2\r\n",
+		":foohost 331 nick2 #acc2 :No topic is set\r\n",
+		":foohost 353 nick2 = #acc2 :@nick1 @nick2\r\n",
+		":foohost 366 nick2 #acc2 :End of NAMES list\r\n",
+	} {
+		if r := <-conn2.outbound; r != expected {
+			t.Fatal("RENAME fallback", r)
+		}
+	}
+	if r := <-stateSink; r.where != "#acc" || !r.removed {
+		t.Fatal("RENAME old state removal", r)
+	}
+	if r := <-stateSink; r.where != "#acc2" || r.founder != "founder" {
+		t.Fatal("RENAME new state", r)
+	}
+	roomsM.RLock()
+	if _, found := rooms["#acc"]; found {
+		t.Fatal("#acc still exists")
+	}
+	if r, found := rooms["#acc2"]; !found || r.String() != "#acc2" {
+		t.Fatal("#acc2 does not exist")
+	}
+	roomsM.RUnlock()
+
+	conn1.inbound <- "WHOWAS nick2"
+	if r := <-conn1.outbound; r != ":foohost 406 nick1 nick2 :There was no such nickname\r\n" {
+		t.Fatal("WHOWAS of connected client", r)
+	}
+	<-conn1.outbound
+	conn2.inbound <- "PART #acc2"
+	<-conn1.outbound
+	conn2.inbound <- "QUIT"
+	conn2.inbound <- ""
+	for {
+		conn1.inbound <- "WHOWAS nick2"
+		if r := <-conn1.outbound; strings.HasPrefix(r, ":foohost 406 ") {
+			<-conn1.outbound
+			continue
+		} else if r != ":foohost 314 nick1 nick2 foo2 someclient * :Long name2\r\n" {
+			t.Fatal("WHOWAS", r)
+		}
+		if r := <-conn1.outbound; r != ":foohost 312 nick1 nick2 foohost :Signed on "+client2.signon.Format(time.RFC1123)+"\r\n" {
+			t.Fatal("WHOWAS signon", r)
+		}
+		if r := <-conn1.outbound; r != ":foohost 369 nick1 nick2 :End of WHOWAS\r\n" {
+			t.Fatal("WHOWAS end", r)
+		}
+		break
+	}
+}
+
+func TestWildcardMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern, text string
+		match         bool
+	}{
+		{"*", "", true},
+		{"*!*@*", "nick!user@host", true},
+		{"nick!*@ho?t", "nick!user@host", true},
+		{"nick!*@ho?t", "nick!user@hoost", false},
+		{"*@*.example.com", "a!b@c.example.com", true},
+		{"*@*.example.com", "a!b@example.com", false},
+		{"a*b*c", "aXXbYYc", true},
+		{"a*b*c", "aXXbYY", false},
+	} {
+		if got := WildcardMatch(c.pattern, c.text); got != c.match {
+			t.Errorf("WildcardMatch(%q, %q): got %v", c.pattern, c.text, got)
+		}
+	}
+}
+
+func TestStripFormatting(t *testing.T) {
+	for in, out := range map[string]string{
+		"plain text":                     "plain text",
+		"\x02bold\x02 and \x1funder\x1f": "bold and under",
+		"\x034red\x03 \x0304,12pair\x0f": "red pair",
+		"\x03,5not a bg":                 ",5not a bg",
+		"\x04ff00ffhex\x04":              "hex",
+		"\x1ditalic\x1e\x11\x16":         "italic",
+	} {
+		if got := StripFormatting(in); got != out {
+			t.Errorf("StripFormatting(%q): got %q, want %q", in, got, out)
+		}
+	}
+}
+
+func TestRoomNameValid(t *testing.T) {
+	for _, name := range []string{"#foo", "#Foo-bar_1", "#" + strings.Repeat("a", ChannelLen-1)} {
+		if !RoomNameValid(name) {
+			t.Fatal("valid channel name rejected", name)
+		}
+	}
+	for _, name := range []string{
+		"foo", "#", "#foo bar", "#foo,bar", "#foo:bar", "#foo/bar",
+		"#foo\x07", "#foo\x00", "#foo\tbar", "#foo\x7f",
+		"#" + strings.Repeat("a", ChannelLen),
+	} {
+		if RoomNameValid(name) {
+			t.Fatal("invalid channel name accepted", name)
+		}
+	}
+	if !KeyValid("secret") || !KeyValid(strings.Repeat("k", KeyLen)) {
+		t.Fatal("valid key rejected")
+	}
+	for _, key := range []string{"", "foo bar", "foo,bar", "foo\x07", strings.Repeat("k", KeyLen+1)} {
+		if KeyValid(key) {
+			t.Fatal("invalid key accepted", key)
+		}
+	}
+}
+
+func TestRoomModesState(t *testing.T) {
+	room := NewRoom("#foo")
+	room.RestoreModes("cfr 5:10")
+	if state := room.modesState(); state != "cfr 5:10" {
+		t.Fatal("modes state", state)
+	}
+	key := "secret"
+	room.key = &key
+	if mode := room.ModeString(); mode != "+cfrk 5:10" {
+		t.Fatal("mode string", mode)
+	}
+	if lines, period, set := room.floodLimit(); !set || lines != 5 || period != 10*time.Second {
+		t.Fatal("flood limit", lines, period, set)
+	}
+}
+
+func TestListFilter(t *testing.T) {
+	host := "foohost"
+	hostname = &host
+	now := time.Now()
+	foo := NewRoom("#foo")
+	foo.created = now.Add(-time.Hour)
+	foo.members[NewClient(NewTestingConn())] = struct{}{}
+	foo.members[NewClient(NewTestingConn())] = struct{}{}
+	founder := "founder"
+	foo.founder = &founder
+	topic := "Foo topic"
+	foo.topic = &topic
+	foo.topicSet = now.Add(-5 * time.Minute)
+	bar := NewRoom("#bar")
+	bar.created = now.Add(-time.Minute)
+	for _, c := range []struct {
+		params   string
+		foo, bar bool
+	}{
+		{"", true, true},
+		{">1", true, false},
+		{"<2", false, true},
+		{"#f*", true, false},
+		{"!#f*", false, true},
+		{"C>30", true, false},
+		{"C<30", false, true},
+		{"T<10", true, false},
+		{"T>10", false, true},
+		{">0,C>30,#*o*", true, false},
+		{"<bad C>bad", true, true},
+	} {
+		names, filter := ParseListFilter(strings.Fields(c.params))
+		if len(names) != 0 {
+			t.Fatal("names in conditions", c.params, names)
+		}
+		if filter.Match(foo, now) != c.foo || filter.Match(bar, now) != c.bar {
+			t.Fatal("LIST conditions", c.params)
+		}
+	}
+	if names, _ := ParseListFilter([]string{"#foo,#bar", ">1"}); len(names) != 2 {
+		t.Fatal("LIST names", names)
+	}
+
+	roomsM.Lock()
+	rooms = map[string]*Room{"#foo": foo, "#bar": bar}
+	roomsM.Unlock()
+	defer func() {
+		roomsM.Lock()
+		rooms = make(map[string]*Room)
+		roomsM.Unlock()
+	}()
+	conn := NewTestingConn()
+	client := NewClient(conn)
+	nickname := "nick1"
+	client.nickname = &nickname
+	SendList(client, []string{"LIST", "T<10"})
+	if r := <-conn.outbound; r != ":foohost 322 nick1 #foo 2 :[registered] Foo topic\r\n" {
+		t.Fatal("LIST of registered channel", r)
+	}
+	if r := <-conn.outbound; r != ":foohost 323 nick1 :End of /LIST\r\n" {
+		t.Fatal("LIST end", r)
+	}
+}
+
+func TestSafelist(t *testing.T) {
+	host := "foohost"
+	hostname = &host
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("#r%d", i)
+		rooms[name] = NewRoom(name)
+	}
+	roomsM.Unlock()
+	defer func() {
+		roomsM.Lock()
+		rooms = make(map[string]*Room)
+		roomsM.Unlock()
+	}()
+	conn := NewTestingConn()
+	client := NewClassClient(conn, &Class{name: "small", match: "*", sendq: 8, pingFreq: PingThreshold})
+	nickname := "nick1"
+	client.nickname = &nickname
+	SendList(client, []string{"LIST"})
+	SendList(client, []string{"LIST"})
+	for i := 0; i < 4; i++ {
+		if r := <-conn.outbound; r != fmt.Sprintf(":foohost 322 nick1 #r%d 0 :\r\n", i) {
+			t.Fatal("LIST at once", r)
+		}
+	}
+	if r := <-conn.outbound; !strings.HasPrefix(r, ":foohost 263 nick1 LIST :") {
+		t.Fatal("LIST while streaming", r)
+	}
+	for i := 4; i < 10; i++ {
+		if r := <-conn.outbound; r != fmt.Sprintf(":foohost 322 nick1 #r%d 0 :\r\n", i) {
+			t.Fatal("streamed LIST", r)
+		}
+	}
+	if r := <-conn.outbound; r != ":foohost 323 nick1 :End of /LIST\r\n" {
+		t.Fatal("streamed LIST end", r)
+	}
+	if !client.Alive() {
+		t.Fatal("client is killed by LIST")
+	}
+}
+
+// Benchmark driver: n clients register, join one of the rooms each and
+// exchange messages in them.
+func benchmarkRooms(b *testing.B, n, roomsNum int) {
+	logSink = make(chan LogEvent, 8)
+	stateSink = make(chan StateEvent, 8)
+	go func() {
+		for range logSink {
+		}
+	}()
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent, EVENTS_BUFFER)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+
+	conns := make([]*TestingConn, n)
+	pongs := make([]chan struct{}, n)
+	for i := range conns {
+		conns[i] = NewTestingConn()
+		pongs[i] = make(chan struct{}, 1)
+		go func(conn *TestingConn, pong chan struct{}) {
+			for r := range conn.outbound {
+				if strings.Contains(r, " PONG ") {
+					pong <- struct{}{}
+				}
+			}
+		}(conns[i], pongs[i])
+		go NewClient(conns[i]).Processor(events)
+		conns[i].inbound <- fmt.Sprintf("NICK nick%d\r\nUSER foo bar baz :Long name", i)
+		conns[i].inbound <- fmt.Sprintf("JOIN #room%d", i%roomsNum)
+	}
+	// Tagged PINGs are answered by the Daemon after all preceding
+	// messages were passed to rooms
+	barrier := func() {
+		for i, conn := range conns {
+			conn.inbound <- "@foo PING sync"
+			<-pongs[i]
+		}
+	}
+	barrier()
+	b.ResetTimer()
+	done := make(chan struct{})
+	for i, conn := range conns {
+		go func(conn *TestingConn, room string) {
+			for m := 0; m < b.N/n; m++ {
+				conn.inbound <- "PRIVMSG " + room + " :hello"
+			}
+			done <- struct{}{}
+		}(conn, fmt.Sprintf("#room%d", i%roomsNum))
+	}
+	for range conns {
+		<-done
+	}
+	barrier()
+	b.StopTimer()
+	for _, conn := range conns {
+		conn.inbound <- ""
+	}
+	events <- ClientEvent{eventType: EventTerm}
+	<-finished
+}
+
+func BenchmarkRooms(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("clients%d", n), func(b *testing.B) {
+			benchmarkRooms(b, n, 10)
+		})
+	}
+}
+
+// Termination must not wait for rooms already emptied and removed
+func TestTermEmptiedRoom(t *testing.T) {
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	r, sink := RoomRegister("#foo")
+	RoomRegister("#bar")
+	roomsM.Lock()
+	delete(rooms, "#foo")
+	delete(roomSinks, r)
+	close(sink)
+	roomsM.Unlock()
+	events <- ClientEvent{eventType: EventTerm}
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("termination hangs")
+	}
+}
+
+func TestBanMask(t *testing.T) {
+	for mask, expected := range map[string]string{
+		"nick":          "nick!*@*",
+		"nick!user":     "nick!user@*",
+		"*@example.com": "*!*@example.com",
+		"n!u@h":         "n!u@h",
+		"$a:spammer":    "$a:spammer",
+		"$r:*bot*":      "$r:*bot*",
+		"$x:foo":        "",
+		"$a:":           "",
+		"$afoo":         "",
+	} {
+		result, valid := BanMask(mask)
+		if expected == "" {
+			if valid {
+				t.Fatal("invalid mask accepted", mask)
+			}
+			continue
+		}
+		if !valid || result != expected {
+			t.Fatal("mask normalization", mask, result)
+		}
+	}
+}
+
+func TestBans(t *testing.T) {
+	logSink = make(chan LogEvent, 8)
+	stateSink = make(chan StateEvent, 8)
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+	}()
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	go NewClient(conn1).Processor(events)
+	go NewClient(conn2).Processor(events)
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
+	for i := 0; i < 13; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+	conn1.inbound <- "JOIN #ban"
+	for i := 0; i < 4; i++ {
+		<-conn1.outbound
+	}
+	<-logSink
+	conn2.inbound <- "JOIN #ban"
+	for i := 0; i < 4; i++ {
+		<-conn2.outbound
+	}
+	<-conn1.outbound
+	<-logSink
+
+	conn2.inbound <- "MODE #ban +b foo"
+	if r := <-conn2.outbound; r != ":foohost 482 nick2 #ban :You're not channel operator\r\n" {
+		t.Fatal("+b by non-operator", r)
+	}
+	conn1.inbound <- "MODE #ban +b $x:foo"
+	if r := <-conn1.outbound; !strings.HasPrefix(r, ":foohost 696 nick1 #ban b $x:foo :") {
+		t.Fatal("unsupported extban", r)
+	}
+	conn1.inbound <- "MODE #ban +b $r:*name2"
+	for _, conn := range []*TestingConn{conn1, conn2} {
+		if r := <-conn.outbound; r != ":nick1!foo1@someclient MODE #ban +b $r:*name2\r\n" {
+			t.Fatal("+b extban", r)
+		}
+	}
+	if r := <-logSink; r.what != "banned $r:*name2" {
+		t.Fatal("+b log", r)
+	}
+	if r := <-stateSink; r.bans != "$r:*name2" {
+		t.Fatal("+b state", r)
+	}
+	conn1.inbound <- "MODE #ban +b nick3"
+	for _, conn := range []*TestingConn{conn1, conn2} {
+		if r := <-conn.outbound; r != ":nick1!foo1@someclient MODE #ban +b nick3!*@*\r\n" {
+			t.Fatal("+b nickname", r)
+		}
+	}
+	<-logSink
+	if r := <-stateSink; r.bans != "$r:*name2 nick3!*@*" {
+		t.Fatal("+b state", r)
+	}
+	conn1.inbound <- "MODE #ban b"
+	for _, expected := range []string{
+		":foohost 367 nick1 #ban :$r:*name2\r\n",
+		":foohost 367 nick1 #ban :nick3!*@*\r\n",
+		":foohost 368 nick1 #ban :End of channel ban list\r\n",
+	} {
+		if r := <-conn1.outbound; r != expected {
+			t.Fatal("ban list", r)
+		}
+	}
+
+	conn2.inbound <- "PRIVMSG #ban :hi"
+	if r := <-conn2.outbound; r != ":foohost 404 nick2 #ban :Cannot send to channel (+b)\r\n" {
+		t.Fatal("banned member sending", r)
+	}
+	conn1.inbound <- "MODE #ban -b nick3"
+	for _, conn := range []*TestingConn{conn1, conn2} {
+		if r := <-conn.outbound; r != ":nick1!foo1@someclient MODE #ban -b nick3!*@*\r\n" {
+			t.Fatal("-b", r)
+		}
+	}
+	if r := <-logSink; r.what != "unbanned nick3!*@*" {
+		t.Fatal("-b log", r)
+	}
+	if r := <-stateSink; r.bans != "$r:*name2" {
+		t.Fatal("-b state", r)
+	}
+
+	conn1.inbound <- "MODE #ban +q nick1"
+	for _, conn := range []*TestingConn{conn1, conn2} {
+		if r := <-conn.outbound; r != ":nick1!foo1@someclient MODE #ban +q nick1!*@*\r\n" {
+			t.Fatal("+q", r)
+		}
+	}
+	if r := <-logSink; r.what != "quieted nick1!*@*" {
+		t.Fatal("+q log", r)
+	}
+	if r := <-stateSink; r.quiets != "nick1!*@*" || r.bans != "$r:*name2" {
+		t.Fatal("+q state", r)
+	}
+	conn1.inbound <- "MODE #ban q"
+	if r := <-conn1.outbound; r != ":foohost 728 nick1 #ban q :nick1!*@*\r\n" {
+		t.Fatal("quiet list", r)
+	}
+	if r := <-conn1.outbound; r != ":foohost 729 nick1 #ban q :End of channel quiet list\r\n" {
+		t.Fatal("quiet list end", r)
+	}
+	conn1.inbound <- "MODE #ban -o nick1"
+	<-conn1.outbound
+	<-conn2.outbound
+	<-logSink
+	conn2.inbound <- "CAP REQ message-tags"
+	<-conn2.outbound
+	conn1.inbound <- "@+typing=active TAGMSG #ban"
+	conn1.inbound <- "PRIVMSG #ban :hi"
+	if r := <-conn1.outbound; r != ":foohost 404 nick1 #ban :Cannot send to channel (+q)\r\n" {
+		t.Fatal("quieted member sending", r)
+	}
+	conn1.inbound <- "MODE #ban +o nick2"
+	if r := <-conn1.outbound; r != ":foohost 482 nick1 #ban :You're not channel operator\r\n" {
+		t.Fatal("deopped member", r)
+	}
+	roomsM.RLock()
+	r := rooms["#ban"]
+	roomsM.RUnlock()
+	r.Lock()
+	for c := range r.members {
+		if *c.nickname == "nick1" {
+			r.ops[c] = struct{}{}
+		}
+	}
+	r.Unlock()
+
+	conn1.inbound <- "MODE #ban +v nick2"
+	<-conn1.outbound
+	if r := <-conn2.outbound; r != ":nick1!foo1@someclient MODE #ban +v nick2\r\n" {
+		t.Fatal("typing notification of quieted member", r)
+	}
+	<-logSink
+	conn2.inbound <- "PRIVMSG #ban :hi"
+	if r := <-conn1.outbound; r != ":nick2!foo2@someclient PRIVMSG #ban :hi\r\n" {
+		t.Fatal("voiced banned member sending", r)
+	}
+	<-logSink
+
+	conn2.inbound <- "PART #ban"
+	<-conn1.outbound
+	<-conn2.outbound
+	<-logSink
+	conn2.inbound <- "JOIN #ban"
+	if r := <-conn2.outbound; r != ":foohost 474 nick2 #ban :Cannot join channel (+b)\r\n" {
+		t.Fatal("banned client joining", r)
+	}
+}
+
+// The first one joining registered room must not become its operator
+func TestFounderRoomJoin(t *testing.T) {
+	logSink = make(chan LogEvent, 8)
+	stateSink = make(chan StateEvent, 8)
+	host := "foohost"
+	hostname = &host
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	r, sink := RoomRegister("#owned")
+	defer func() {
+		sink <- ClientEvent{eventType: EventTerm}
+	}()
+	founder := "founder"
+	r.founder = &founder
+	conn := NewTestingConn()
+	client := NewClient(conn)
+	nickname := "nick1"
+	client.nickname = &nickname
+	sink <- ClientEvent{client, EventNew, ""}
+	<-conn.outbound
+	<-conn.outbound
+	if r := <-conn.outbound; r != ":foohost 353 nick1 = #owned :nick1\r\n" {
+		t.Fatal("operator status in registered room", r)
+	}
+}
+
+func TestSecretChannel(t *testing.T) {
+	logSink = make(chan LogEvent, 8)
+	stateSink = make(chan StateEvent, 8)
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+	}()
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	go NewClient(conn1).Processor(events)
+	go NewClient(conn2).Processor(events)
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
+	for i := 0; i < 13; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+	conn1.inbound <- "JOIN #secret"
+	for i := 0; i < 4; i++ {
+		<-conn1.outbound
+	}
+	<-logSink
+	conn1.inbound <- "MODE #secret +s"
+	if r := <-conn1.outbound; r != ":nick1!foo1@someclient MODE #secret +s\r\n" {
+		t.Fatal("MODE +s", r)
+	}
+	<-logSink
+	<-stateSink
+
+	conn2.inbound <- "LIST"
+	if r := <-conn2.outbound; r != ":foohost 323 nick2 :End of /LIST\r\n" {
+		t.Fatal("secret channel is listed", r)
+	}
+	conn2.inbound <- "WHOIS nick1"
+	for i := 0; i < 3; i++ {
+		<-conn2.outbound
+	}
+	if r := <-conn2.outbound; r != ":foohost 319 nick2 nick1 :\r\n" {
+		t.Fatal("secret channel in WHOIS", r)
+	}
+	<-conn2.outbound
+	conn1.inbound <- "WHOIS nick1"
+	for i := 0; i < 5; i++ {
+		<-conn1.outbound
+	}
+	if r := <-conn1.outbound; r != ":foohost 319 nick1 nick1 :@#secret\r\n" {
+		t.Fatal("secret channel in own WHOIS", r)
+	}
+	<-conn1.outbound
+
+	conn2.inbound <- "JOIN #secret"
+	for i := 0; i < 4; i++ {
+		<-conn2.outbound
+	}
+	<-conn1.outbound
+	<-logSink
+	conn2.inbound <- "LIST"
+	if r := <-conn2.outbound; r != ":foohost 322 nick2 #secret 2 :\r\n" {
+		t.Fatal("secret channel is not listed to member", r)
+	}
+	<-conn2.outbound
+	conn2.inbound <- "WHOIS nick1"
+	for i := 0; i < 3; i++ {
+		<-conn2.outbound
+	}
+	if r := <-conn2.outbound; r != ":foohost 319 nick2 nick1 :@#secret\r\n" {
+		t.Fatal("shared secret channel in WHOIS", r)
+	}
+	<-conn2.outbound
+}
+
+func TestStatusMsg(t *testing.T) {
+	logSink = make(chan LogEvent, 32)
+	stateSink = make(chan StateEvent, 32)
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+	}()
+
+	conns := []*TestingConn{NewTestingConn(), NewTestingConn(), NewTestingConn()}
+	for i, conn := range conns {
+		go NewClient(conn).Processor(events)
+		conn.inbound <- fmt.Sprintf("NICK nick%d\r\nUSER foo%d bar baz :Long name", i+1, i+1)
+		for j := 0; j < 13; j++ {
+			<-conn.outbound
+		}
+	}
+	for i, conn := range conns {
+		conn.inbound <- "JOIN #foo"
+		for j := 0; j < 4; j++ {
+			<-conn.outbound
+		}
+		for _, member := range conns[:i] {
+			<-member.outbound
+		}
+	}
+	conns[0].inbound <- "MODE #foo +v nick2"
+	for _, conn := range conns {
+		<-conn.outbound
+	}
+
+	conns[2].inbound <- "PRIVMSG @#foo :hi ops"
+	if r := <-conns[0].outbound; r != ":nick3!foo3@someclient PRIVMSG @#foo :hi ops\r\n" {
+		t.Fatal("PRIVMSG to operators", r)
+	}
+	conns[2].inbound <- "NOTICE +#foo :hi voiced"
+	for _, conn := range conns[:2] {
+		if r := <-conn.outbound; r != ":nick3!foo3@someclient NOTICE +#foo :hi voiced\r\n" {
+			t.Fatal("NOTICE to voiced", r)
+		}
+	}
+	conns[1].inbound <- "WALLCHOPS #foo :hi again"
+	if r := <-conns[0].outbound; r != ":nick2!foo2@someclient NOTICE @#foo :hi again\r\n" {
+		t.Fatal("WALLCHOPS", r)
+	}
+	conns[0].inbound <- "PRIVMSG @#bar :hi"
+	if r := <-conns[0].outbound; r != ":foohost 401 nick1 @#bar :No such nick/channel\r\n" {
+		t.Fatal("PRIVMSG to operators of unknown channel", r)
+	}
+	conns[0].inbound <- "PRIVMSG #foo :hi all"
+	for _, conn := range conns[1:] {
+		if r := <-conn.outbound; r != ":nick1!foo1@someclient PRIVMSG #foo :hi all\r\n" {
+			t.Fatal("PRIVMSG to all after status messages", r)
+		}
+	}
+}
+
+func TestNamesCache(t *testing.T) {
+	logSink = make(chan LogEvent, 32)
+	stateSink = make(chan StateEvent, 32)
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+	}()
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	go NewClient(conn1).Processor(events)
+	go NewClient(conn2).Processor(events)
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
+	for i := 0; i < 13; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+	conn1.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn1.outbound
+	}
+	conn2.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn2.outbound
+	}
+	<-conn1.outbound
+	names := func(expected string) {
+		conn1.inbound <- "JOIN #foo"
+		<-conn1.outbound
+		if r := <-conn1.outbound; r != ":foohost 353 nick1 = #foo :"+expected+"\r\n" {
+			t.Fatal("NAMES", r)
+		}
+		<-conn1.outbound
+	}
+	names("@nick1 nick2")
+	names("@nick1 nick2")
+
+	conn2.inbound <- "NICK nick3"
+	<-conn1.outbound
+	<-conn2.outbound
+	names("@nick1 nick3")
+	conn1.inbound <- "MODE #foo +v nick3"
+	<-conn1.outbound
+	<-conn2.outbound
+	names("+nick3 @nick1")
+	conn2.inbound <- "PART #foo"
+	<-conn1.outbound
+	<-conn2.outbound
+	names("@nick1")
+}
+
+// Renamed room must be found by its new name as soon as the Daemon has
+// handled RENAME, before the room itself processes the event
+func TestRenameName(t *testing.T) {
+	host := "foohost"
+	hostname = &host
+	r := NewRoom("#old")
+	sink := make(chan ClientEvent, 1)
+	roomsM.Lock()
+	rooms = map[string]*Room{"#old": r}
+	roomSinks = map[*Room]chan ClientEvent{r: sink}
+	roomsM.Unlock()
+	conn := NewTestingConn()
+	client := NewClient(conn)
+	nickname := "nick1"
+	client.nickname = &nickname
+	client.registered = true
+	r.members[client] = struct{}{}
+	r.ops[client] = struct{}{}
+
+	ClientCommand(client, "RENAME", []string{"RENAME", "#old #new :tidy up"}, "", time.Now())
+	if r.String() != "#new" || !r.Match("#new") {
+		t.Fatal("name is not changed", r.String())
+	}
+	if e := <-sink; e.eventType != EventRename || e.text != "#old #new tidy up" {
+		t.Fatal("rename event", e)
+	}
 }